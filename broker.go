@@ -1,21 +1,73 @@
 package ps
 
 import (
+	"math/rand/v2"
 	"slices"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // Broker is a pub/sub coördination point for values of type T. See the Publish,
 // Subscribe, and Unsubscribe methods for more information.
 type Broker[T any] struct {
-	mtx  sync.Mutex
-	subs []*subscriber[T]
+	mtx         sync.Mutex
+	subs        []*subscriber[T]
+	dedupWindow time.Duration
+	maxKeys     int
+	keys        map[string]Stats
+	keyOrder    []dedupKey // oldest first
+	replay      int
+	retained    []Message[T] // ring, oldest first from head
+	head        int
+	idPrefix    string
+	seq         uint64
+	idSubs      int // subscribers which receive IDs
 }
 
-// NewBroker returns a new broker for values of type T.
+// BrokerConfig enumerates the optional parameters for a broker.
+type BrokerConfig struct {
+	// DedupWindow is how long the outcome of a publish with a key is
+	// remembered, see [Broker.PublishKey]. If zero, 5m is used.
+	DedupWindow time.Duration
+
+	// MaxDedupKeys is the maximum number of remembered keys. When it's
+	// exceeded, the oldest keys are forgotten before their window ends. If
+	// zero, 100000 is used.
+	MaxDedupKeys int
+
+	// Replay is the number of most recently published values retained by the
+	// broker, so that subscribers can resume after the last value they
+	// received, see [Broker.Resume]. If zero, values aren't retained.
+	Replay int
+}
+
+// Message is a published value, and its ID. The ID of a value published with
+// a key is the key, see [Broker.PublishKey], the ID of a message published via
+// [Broker.PublishMessage] is its own, and otherwise it's unique to the broker.
+type Message[T any] struct {
+	ID    string
+	Value T
+}
+
+// NewBroker returns a new broker for values of type T, with a default config.
 func NewBroker[T any]() *Broker[T] {
+	return NewBrokerConfig[T](BrokerConfig{})
+}
+
+// NewBrokerConfig returns a new broker for values of type T.
+func NewBrokerConfig[T any](config BrokerConfig) *Broker[T] {
+	if config.DedupWindow <= 0 {
+		config.DedupWindow = 5 * time.Minute
+	}
+	if config.MaxDedupKeys <= 0 {
+		config.MaxDedupKeys = 100000
+	}
 	return &Broker[T]{
-		//
+		dedupWindow: config.DedupWindow,
+		maxKeys:     config.MaxDedupKeys,
+		replay:      max(config.Replay, 0),
+		idPrefix:    strconv.FormatUint(rand.Uint64(), 36) + "-",
 	}
 }
 
@@ -28,27 +80,107 @@ func (b *Broker[T]) Publish(v T) Stats {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
 
+	return b.publish("", v)
+}
+
+// PublishKey publishes the value like Publish, unless a value was already
+// published with the same key within the dedup window of the broker. In that
+// case, the value isn't published, and the stats of the original publish are
+// returned with duplicate true. This makes publishes safe to retry, when the
+// outcome of a previous attempt is unknown. Values with an empty key are
+// always published.
+func (b *Broker[T]) PublishKey(key string, v T) (stats Stats, duplicate bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if key == "" {
+		return b.publish("", v), false
+	}
+
+	now := time.Now()
+	b.expireKeys(now)
+
+	if stats, ok := b.keys[key]; ok {
+		return stats, true
+	}
+
+	stats = b.publish(key, v)
+
+	if b.keys == nil {
+		b.keys = map[string]Stats{}
+	}
+	b.keys[key] = stats
+	b.keyOrder = append(b.keyOrder, dedupKey{key: key, expires: now.Add(b.dedupWindow)})
+
+	return stats, false
+}
+
+// PublishMessage publishes the value of the message like Publish, with the ID
+// of the message rather than a generated ID, so the same value can have the
+// same ID on several brokers. Unlike keys, IDs aren't deduplicated. If the ID
+// is empty, an ID is generated.
+func (b *Broker[T]) PublishMessage(m Message[T]) Stats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.publish(m.ID, m.Value)
+}
+
+func (b *Broker[T]) publish(id string, v T) Stats {
+	if id == "" && (b.replay > 0 || b.idSubs > 0) {
+		b.seq++
+		id = b.idPrefix + strconv.FormatUint(b.seq, 10)
+	}
+
 	var stats Stats
 
 	for _, s := range b.subs {
 		if !s.allow(v) {
 			s.stats.Skips++
 			stats.Skips++
-		} else {
-			select {
-			case s.c <- v:
-				s.stats.Sends++
-				stats.Sends++
-			default:
-				s.stats.Drops++
-				stats.Drops++
+			continue
+		}
+
+		// The ID is sent after the value, so there must be room for it
+		// before the value is sent.
+		if s.ids != nil && len(s.ids) >= cap(s.ids) {
+			s.stats.Drops++
+			stats.Drops++
+			continue
+		}
+
+		select {
+		case s.c <- v:
+			s.stats.Sends++
+			stats.Sends++
+			if s.ids != nil {
+				s.ids <- id
 			}
+		default:
+			s.stats.Drops++
+			stats.Drops++
 		}
 	}
 
+	b.retain(id, v)
+
 	return stats
 }
 
+// retain adds the value to the retained values, evicting the oldest value if
+// the broker retains enough already. The caller must hold the mutex.
+func (b *Broker[T]) retain(id string, v T) {
+	switch {
+	case b.replay <= 0:
+		return
+	case len(b.retained) < b.replay:
+		b.retained = append(b.retained, Message[T]{ID: id, Value: v})
+	default:
+		b.retained[b.head] = Message[T]{ID: id, Value: v}
+		b.head = (b.head + 1) % len(b.retained)
+	}
+}
+
 // Subscribe adds c to the broker, and forwards every published value that
 // passes the allow func to c.
 func (b *Broker[T]) Subscribe(c chan<- T, allow func(T) bool) error {
@@ -75,6 +207,61 @@ func (b *Broker[T]) Subscribe(c chan<- T, allow func(T) bool) error {
 	return nil
 }
 
+// Resume subscribes c like Subscribe, and also sends the ID of every value sent
+// to c to ids, in the same order, so receivers know the ID of the last value
+// they received. The ID is sent right after the value, so receivers should
+// receive from ids after every value received from c. Values are dropped
+// unless ids has room for their ID, so ids should have a larger buffer than c.
+//
+// If after is the ID of a value retained by the broker, see
+// [BrokerConfig.Replay], Resume also returns the retained values published
+// after it which pass the allow func. They precede every value sent to c, and
+// count as sends in the stats of the subscription. If after is non-empty and
+// isn't retained, no values are returned, ok is false, and values published
+// after it may have been missed.
+func (b *Broker[T]) Resume(c chan<- T, ids chan<- string, allow func(T) bool, after string) (replay []Message[T], ok bool, err error) {
+	if allow == nil {
+		allow = func(T) bool { return true }
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, s := range b.subs {
+		if s.c == c {
+			return nil, false, ErrAlreadySubscribed
+		}
+	}
+
+	s := &subscriber[T]{
+		c:     c,
+		ids:   ids,
+		allow: allow,
+	}
+
+	if after == "" {
+		ok = true
+	} else {
+		for i := range b.retained {
+			m := b.retained[(b.head+i)%len(b.retained)]
+			switch {
+			case m.ID == after:
+				ok, replay, s.stats = true, nil, Stats{} // resume after the latest
+			case ok && allow(m.Value):
+				replay = append(replay, m)
+				s.stats.Sends++
+			}
+		}
+	}
+
+	b.subs = append(b.subs, s)
+	if ids != nil {
+		b.idSubs++
+	}
+
+	return replay, ok, nil
+}
+
 // SubscribeAll subscribes to every published value.
 func (b *Broker[T]) SubscribeAll(c chan<- T) error {
 	return b.Subscribe(c, nil)
@@ -100,6 +287,9 @@ func (b *Broker[T]) Unsubscribe(c chan<- T) (Stats, error) {
 	b.subs = slices.DeleteFunc(b.subs, func(s *subscriber[T]) bool {
 		return s == target
 	})
+	if target.ids != nil {
+		b.idSubs--
+	}
 
 	return target.stats, nil
 }
@@ -133,6 +323,25 @@ func (b *Broker[T]) ActiveSubscribers() []Stats {
 
 type subscriber[T any] struct {
 	c     chan<- T
+	ids   chan<- string
 	allow func(T) bool
 	stats Stats
 }
+
+type dedupKey struct {
+	key     string
+	expires time.Time
+}
+
+// expireKeys forgets keys whose dedup window has ended, and the oldest keys
+// beyond the maximum. The caller must hold the mutex.
+func (b *Broker[T]) expireKeys(now time.Time) {
+	var n int
+	for n < len(b.keyOrder) && (now.After(b.keyOrder[n].expires) || len(b.keyOrder)-n >= max(b.maxKeys, 1)) {
+		delete(b.keys, b.keyOrder[n].key)
+		n++
+	}
+	if n > 0 {
+		b.keyOrder = slices.Delete(b.keyOrder, 0, n)
+	}
+}
@@ -0,0 +1,463 @@
+// Command ps is a command-line client for pub/sub brokers served by package
+// pshttp. Values are JSON.
+//
+//	ps pub [flags] URL [VALUE ...]   publish values from args, or NDJSON on stdin
+//	ps sub [flags] URL               subscribe and print values
+//	ps stats [flags] URL             print subscriber stats
+//
+// Exit status is 0 on success, 1 on errors, and 2 on usage errors. Run a
+// command with -h for its flags.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `USAGE
+  ps <command> [flags] URL
+
+COMMANDS
+  pub     publish JSON values from args, or NDJSON on stdin
+  sub     subscribe and print JSON values until interrupted
+  stats   print subscriber stats of a registry or admin handler
+
+Run ps <command> -h for the flags of a command.
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	var cmd func(context.Context, []string, io.Reader, io.Writer, io.Writer) error
+	switch args[0] {
+	case "pub", "publish":
+		cmd = runPub
+	case "sub", "subscribe":
+		cmd = runSub
+	case "stats":
+		cmd = runStats
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "ps: unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+
+	err := cmd(ctx, args[1:], stdin, stdout, stderr)
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(stderr, "ps %s: %v\n", args[0], err)
+		return exitUsage
+	default:
+		fmt.Fprintf(stderr, "ps %s: %v\n", args[0], err)
+		return exitError
+	}
+}
+
+// usageError is returned by commands for invalid flags or arguments.
+type usageError struct{ err error }
+
+func (e *usageError) Error() string { return e.err.Error() }
+
+func usagef(format string, args ...any) error {
+	return &usageError{fmt.Errorf(format, args...)}
+}
+
+// clientFlags are the flags shared by every command.
+type clientFlags struct {
+	topic   string
+	headers headerFlags
+	timeout time.Duration
+}
+
+func (f *clientFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.topic, "topic", "", "topic of a registry handler, if URL is its root")
+	fs.Var(&f.headers, "H", "request header as 'Key: Value', repeatable")
+	fs.DurationVar(&f.timeout, "timeout", 10*time.Second, "timeout of each request, except subscriptions")
+}
+
+// parse parses args into fs, and returns the single URL argument, plus any
+// remaining arguments if rest is true.
+func parse(fs *flag.FlagSet, args []string, rest bool) (string, []string, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "", nil, err
+		}
+		return "", nil, &usageError{err}
+	}
+	switch {
+	case fs.NArg() == 0:
+		return "", nil, usagef("URL is required")
+	case fs.NArg() > 1 && !rest:
+		return "", nil, usagef("unexpected arguments %q", fs.Args()[1:])
+	}
+	uri := fs.Arg(0)
+	if u, err := url.Parse(uri); err != nil || u.Scheme == "" || u.Host == "" {
+		return "", nil, usagef("invalid URL %q", uri)
+	}
+	return uri, fs.Args()[1:], nil
+}
+
+func (f *clientFlags) client(uri string, options ...pshttp.ClientOption[json.RawMessage]) (*pshttp.Client[json.RawMessage], error) {
+	for _, h := range f.headers {
+		key, value, _ := strings.Cut(h, ":")
+		options = append(options, pshttp.WithHeader[json.RawMessage](strings.TrimSpace(key), strings.TrimSpace(value)))
+	}
+	client, err := pshttp.NewClientWithOptions[json.RawMessage](uri, options...)
+	if err != nil {
+		return nil, err
+	}
+	if f.topic != "" {
+		client = client.Topic(f.topic)
+	}
+	return client, nil
+}
+
+// headerFlags is a repeatable flag of request headers.
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(s string) error {
+	if key, _, ok := strings.Cut(s, ":"); !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("header %q must be 'Key: Value'", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+func newFlagSet(name, synopsis string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("ps "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "USAGE\n  ps %s %s\n\nFLAGS\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runPub(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		fs      = newFlagSet("pub", "[flags] URL [VALUE ...]", stderr)
+		cf      clientFlags
+		strs    = fs.Bool("s", false, "publish each value as a JSON string, instead of parsing it as JSON")
+		verbose = fs.Bool("v", false, "print the stats of every published value")
+	)
+	cf.register(fs)
+	uri, values, err := parse(fs, args, true)
+	if err != nil {
+		return err
+	}
+
+	client, err := cf.client(uri)
+	if err != nil {
+		return &usageError{err}
+	}
+
+	toJSON := func(s string) (json.RawMessage, error) {
+		if *strs {
+			return json.Marshal(s)
+		}
+		if !json.Valid([]byte(s)) {
+			return nil, fmt.Errorf("invalid JSON %q (use -s for strings)", s)
+		}
+		return json.RawMessage(s), nil
+	}
+
+	var (
+		count int
+		total ps.Stats
+	)
+	publish := func(v json.RawMessage) error {
+		ctx, cancel := context.WithTimeout(ctx, cf.timeout)
+		defer cancel()
+		stats, err := client.Publish(ctx, v)
+		if err != nil {
+			return err
+		}
+		count++
+		total = addStats(total, stats)
+		if *verbose {
+			fmt.Fprintf(stdout, "%s\n", stats)
+		}
+		return nil
+	}
+
+	if len(values) > 0 {
+		msgs := make([]json.RawMessage, len(values))
+		for i, s := range values {
+			if msgs[i], err = toJSON(s); err != nil {
+				return &usageError{err}
+			}
+		}
+		for _, v := range msgs {
+			if err := publish(v); err != nil {
+				return fmt.Errorf("publish: %w", err)
+			}
+		}
+	} else {
+		s := bufio.NewScanner(stdin)
+		s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for line := 1; s.Scan(); line++ {
+			text := strings.TrimSpace(s.Text())
+			if text == "" {
+				continue
+			}
+			v, err := toJSON(text)
+			if err != nil {
+				return fmt.Errorf("stdin line %d: %w", line, err)
+			}
+			if err := publish(v); err != nil {
+				return fmt.Errorf("stdin line %d: publish: %w", line, err)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return fmt.Errorf("read stdin: %w", err)
+		}
+	}
+
+	fmt.Fprintf(stderr, "published %d value(s): %s\n", count, total)
+	return nil
+}
+
+func runSub(ctx context.Context, args []string, _ io.Reader, stdout, stderr io.Writer) error {
+	var (
+		fs         = newFlagSet("sub", "[flags] URL", stderr)
+		cf         clientFlags
+		filter     = fs.String("filter", "", "filter expression, passed to the handler")
+		raw        = fs.Bool("raw", false, "print values as received, one per line, instead of indented")
+		heartbeats = fs.Bool("heartbeats", false, "print heartbeats and subscription stats to stderr")
+		quiet      = fs.Bool("q", false, "don't print connection state changes to stderr")
+		count      = fs.Int("n", 0, "exit after receiving this many values, if non-zero")
+		buffer     = fs.Int("buffer", 0, "buffer requested for the subscription, if non-zero")
+		heartbeat  = fs.Duration("heartbeat", 0, "heartbeat interval requested for the subscription, if non-zero")
+		retry      = fs.Duration("retry", time.Second, "initial delay between reconnect attempts")
+		retryMax   = fs.Duration("retry-max", 30*time.Second, "maximum delay between reconnect attempts")
+		attempts   = fs.Int("max-attempts", 0, "give up after this many consecutive failed reconnect attempts, if non-zero")
+	)
+	cf.register(fs)
+	uri, _, err := parse(fs, args, false)
+	if err != nil {
+		return err
+	}
+	if *count < 0 || *buffer < 0 || *attempts < 0 {
+		return usagef("-n, -buffer, and -max-attempts must not be negative")
+	}
+
+	client, err := cf.client(uri)
+	if err != nil {
+		return &usageError{err}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		ch      = make(chan json.RawMessage)
+		errc    = make(chan error, 1)
+		timefmt = "15:04:05.000"
+	)
+	go func() {
+		errc <- client.SubscribeConfig(ctx, ch, pshttp.SubscribeConfig{
+			Reconnect: &pshttp.ExponentialBackoff{
+				Initial:     *retry,
+				Max:         *retryMax,
+				Jitter:      0.2,
+				MaxAttempts: *attempts,
+			},
+			OnStateChange: func(state pshttp.ConnState, err error) {
+				switch {
+				case *quiet:
+				case err != nil && !errors.Is(err, context.Canceled):
+					fmt.Fprintf(stderr, "%s %s: %v\n", time.Now().Format(timefmt), state, err)
+				case err == nil:
+					fmt.Fprintf(stderr, "%s %s\n", time.Now().Format(timefmt), state)
+				}
+			},
+			OnHeartbeat: func(ev pshttp.HeartbeatEvent) {
+				switch {
+				case !*heartbeats:
+				case ev.Error != "":
+					fmt.Fprintf(stderr, "%s heartbeat: %s, error: %s\n", ev.Timestamp.Local().Format(timefmt), ev.Stats, ev.Error)
+				default:
+					fmt.Fprintf(stderr, "%s heartbeat: %s\n", ev.Timestamp.Local().Format(timefmt), ev.Stats)
+				}
+			},
+			Filter:    *filter,
+			Buffer:    *buffer,
+			Heartbeat: *heartbeat,
+		})
+	}()
+
+	var (
+		received int
+		buf      bytes.Buffer
+	)
+	for {
+		select {
+		case v := <-ch:
+			buf.Reset()
+			if *raw {
+				err = json.Compact(&buf, v)
+			} else {
+				err = json.Indent(&buf, v, "", "  ")
+			}
+			if err != nil {
+				buf.Reset()
+				buf.Write(bytes.TrimSpace(v))
+			}
+			buf.WriteByte('\n')
+			if _, err := stdout.Write(buf.Bytes()); err != nil {
+				return fmt.Errorf("write output: %w", err)
+			}
+			if received++; *count > 0 && received >= *count {
+				cancel()
+				<-errc
+				return nil
+			}
+
+		case err := <-errc:
+			if errors.Is(err, context.Canceled) {
+				return nil // interrupted
+			}
+			return fmt.Errorf("subscribe: %w", err)
+		}
+	}
+}
+
+func runStats(ctx context.Context, args []string, _ io.Reader, stdout, stderr io.Writer) error {
+	var (
+		fs     = newFlagSet("stats", "[flags] URL", stderr)
+		cf     clientFlags
+		asJSON = fs.Bool("json", false, "print stats as JSON")
+	)
+	cf.register(fs)
+	uri, _, err := parse(fs, args, false)
+	if err != nil {
+		return err
+	}
+	if cf.topic != "" {
+		return usagef("-topic isn't supported, stats cover every topic")
+	}
+
+	client, err := cf.client(uri)
+	if err != nil {
+		return &usageError{err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cf.timeout)
+	defer cancel()
+
+	// URL is either the root of a registry handler, which lists topics, or
+	// the root of an admin handler, which summarizes every broker. A single
+	// broker handler serves GET /topics as a subscription, and rejects it
+	// because it doesn't accept text/event-stream. It has no stats endpoint,
+	// but its admin handler does.
+	var admin pshttp.AdminStats
+	topics, err := client.Topics(ctx)
+	var statusErr *pshttp.StatusError
+	switch {
+	case err == nil:
+		admin.Topics = topics
+		for _, t := range topics {
+			admin.Subscribers += t.Subscribers
+			admin.Stats = addStats(admin.Stats, t.Stats)
+		}
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusMethodNotAllowed):
+		if admin, err = getAdminStats(ctx, uri, cf.headers); err != nil {
+			return err
+		}
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest:
+		return fmt.Errorf("%s looks like a broker handler, which has no stats, point ps stats at its admin handler instead", uri)
+	default:
+		return fmt.Errorf("list topics: %w", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(admin)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "TOPIC\tSUBSCRIBERS\tSKIPS\tSENDS\tDROPS\n")
+	for _, t := range admin.Topics {
+		name := t.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", name, t.Subscribers, t.Stats.Skips, t.Stats.Sends, t.Stats.Drops)
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%d\t%d\n", admin.Subscribers, admin.Stats.Skips, admin.Stats.Sends, admin.Stats.Drops)
+	return tw.Flush()
+}
+
+func getAdminStats(ctx context.Context, uri string, headers headerFlags) (pshttp.AdminStats, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(uri, "/")+"/stats", nil)
+	if err != nil {
+		return pshttp.AdminStats{}, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("accept", "application/json")
+	for _, h := range headers {
+		key, value, _ := strings.Cut(h, ":")
+		req.Header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return pshttp.AdminStats{}, fmt.Errorf("get stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return pshttp.AdminStats{}, fmt.Errorf("get stats: %w", &pshttp.StatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	var admin pshttp.AdminStats
+	if err := json.NewDecoder(resp.Body).Decode(&admin); err != nil {
+		return pshttp.AdminStats{}, fmt.Errorf("decode stats: %w", err)
+	}
+	return admin, nil
+}
+
+func addStats(a, b ps.Stats) ps.Stats {
+	return ps.Stats{Skips: a.Skips + b.Skips, Sends: a.Sends + b.Sends, Drops: a.Drops + b.Drops}
+}
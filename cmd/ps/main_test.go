@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+func TestCommands(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	registry := ps.NewRegistry[json.RawMessage](ps.RegistryConfig{})
+	handler := pshttp.NewRegistryHandler(registry, pshttp.EncodeJSON, pshttp.DecodeJSON, io.Discard)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var (
+		subout = &syncBuffer{}
+		suberr = &syncBuffer{}
+		subc   = make(chan int, 1)
+	)
+	go func() {
+		subc <- run(ctx, []string{"sub", "-topic", "events", "-raw", "-n", "3", "-heartbeats", "-heartbeat", "100ms", server.URL}, nil, subout, suberr)
+	}()
+
+	for topics := registry.Topics(); len(topics) == 0 || topics[0].Subscribers == 0; topics = registry.Topics() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("pub args", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if want, have := exitOK, run(ctx, []string{"pub", "-topic", "events", "-v", server.URL, `{"a":1}`, `2`}, nil, &stdout, &stderr); want != have {
+			t.Fatalf("exit: want %d, have %d (%s)", want, have, stderr.String())
+		}
+		if want, have := "skips=0 sends=1 drops=0\nskips=0 sends=1 drops=0\n", stdout.String(); want != have {
+			t.Errorf("stdout: want %q, have %q", want, have)
+		}
+		if want, have := "published 2 value(s): skips=0 sends=2 drops=0\n", stderr.String(); want != have {
+			t.Errorf("stderr: want %q, have %q", want, have)
+		}
+	})
+
+	t.Run("pub stdin", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if want, have := exitOK, run(ctx, []string{"pub", "-topic", "events", "-s", server.URL}, strings.NewReader("hello world\n\n"), &stdout, &stderr); want != have {
+			t.Fatalf("exit: want %d, have %d (%s)", want, have, stderr.String())
+		}
+	})
+
+	select {
+	case code := <-subc:
+		if want, have := exitOK, code; want != have {
+			t.Fatalf("sub exit: want %d, have %d (%s)", want, have, suberr.String())
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	if want, have := "{\"a\":1}\n2\n\"hello world\"\n", subout.String(); want != have {
+		t.Errorf("sub stdout: want %q, have %q", want, have)
+	}
+	if want, have := "connected", suberr.String(); !strings.Contains(have, want) {
+		t.Errorf("sub stderr: want %q, have %q", want, have)
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if want, have := exitOK, run(ctx, []string{"stats", "-json", server.URL}, nil, &stdout, &stderr); want != have {
+			t.Fatalf("exit: want %d, have %d (%s)", want, have, stderr.String())
+		}
+		var admin pshttp.AdminStats
+		if err := json.Unmarshal(stdout.Bytes(), &admin); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := 1, len(admin.Topics); want != have {
+			t.Fatalf("topics: want %d, have %d", want, have)
+		}
+		if want, have := "events", admin.Topics[0].Name; want != have {
+			t.Errorf("topic: want %q, have %q", want, have)
+		}
+	})
+
+	t.Run("admin stats", func(t *testing.T) {
+		admin := httptest.NewServer(handler.AdminHandler())
+		defer admin.Close()
+		var stdout, stderr bytes.Buffer
+		if want, have := exitOK, run(ctx, []string{"stats", admin.URL}, nil, &stdout, &stderr); want != have {
+			t.Fatalf("exit: want %d, have %d (%s)", want, have, stderr.String())
+		}
+		if want, have := "TOTAL", stdout.String(); !strings.Contains(have, want) {
+			t.Errorf("stdout: want %q, have %q", want, have)
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"no command", nil, exitUsage},
+		{"unknown command", []string{"frob"}, exitUsage},
+		{"missing URL", []string{"pub"}, exitUsage},
+		{"invalid URL", []string{"sub", "localhost"}, exitUsage},
+		{"invalid JSON", []string{"pub", server.URL, "{"}, exitUsage},
+		{"invalid topic", []string{"pub", "-topic", "/", server.URL, "1"}, exitError},
+		{"unreachable", []string{"sub", "-retry", "1ms", "-max-attempts", "2", "http://127.0.0.1:1"}, exitError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			if want, have := tc.want, run(ctx, tc.args, nil, io.Discard, &stderr); want != have {
+				t.Errorf("exit: want %d, have %d (%s)", want, have, stderr.String())
+			}
+		})
+	}
+}
+
+func TestStatsBroker(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	broker := ps.NewBroker[json.RawMessage]()
+	server := httptest.NewServer(pshttp.NewHandler(broker, pshttp.EncodeJSON, pshttp.DecodeJSON, io.Discard))
+	defer server.Close()
+
+	var stderr bytes.Buffer
+	if want, have := exitError, run(ctx, []string{"stats", server.URL}, nil, io.Discard, &stderr); want != have {
+		t.Fatalf("exit: want %d, have %d (%s)", want, have, stderr.String())
+	}
+	if want, have := "admin handler", stderr.String(); !strings.Contains(have, want) {
+		t.Errorf("stderr: want %q, have %q", want, have)
+	}
+}
+
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
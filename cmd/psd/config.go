@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+// config is the contents of the config file.
+type config struct {
+	// Listen is the address of the pub/sub server. If empty, :8080 is used.
+	// Changes require a restart.
+	Listen string `json:"listen"`
+
+	// AdminListen, if non-empty, is the address of a separate server with
+	// the admin endpoints of [pshttp.NewAdminHandler], covering the handlers
+	// of previous configs until their subscriptions drain. The admin server
+	// isn't authenticated, so it should be bound to a private address. Changes
+	// require a restart.
+	AdminListen string `json:"admin_listen"`
+
+	// TLS, if non-nil, serves the pub/sub server over TLS. Certificates are
+	// reloaded with the config, but enabling or disabling TLS requires a
+	// restart.
+	TLS *tlsConfig `json:"tls"`
+
+	// Topics, if non-empty, is the complete set of topics served under
+	// /topics/{topic}. If empty, topics are created on demand.
+	Topics []string `json:"topics"`
+
+	// IdleTimeout, if non-zero, garbage collects topics created on demand
+	// which haven't been used for at least that long.
+	IdleTimeout duration `json:"idle_timeout"`
+
+	// Replay is the number of recent values retained by every topic, so that
+	// subscribers which reconnect resume after the last value they received.
+	// If zero, values aren't retained. Changes require a restart.
+	Replay int `json:"replay"`
+
+	// Buffer bounds the buffer of subscriptions.
+	Buffer struct {
+		Default int `json:"default"`
+		Min     int `json:"min"`
+		Max     int `json:"max"`
+	} `json:"buffer"`
+
+	// Heartbeat bounds the heartbeat interval of subscriptions.
+	Heartbeat struct {
+		Default duration `json:"default"`
+		Min     duration `json:"min"`
+		Max     duration `json:"max"`
+	} `json:"heartbeat"`
+
+	// Limits are enforced by the handler, see [pshttp.Limits].
+	Limits struct {
+		MaxSubscriptions        int     `json:"max_subscriptions"`
+		MaxSubscriptionsPerAddr int     `json:"max_subscriptions_per_addr"`
+		MaxPublishBytes         int64   `json:"max_publish_bytes"`
+		PublishRate             float64 `json:"publish_rate"`
+		PublishBurst            int     `json:"publish_burst"`
+	} `json:"limits"`
+
+	// Auth, if any method is configured, requires every pub/sub request to
+	// authenticate. Health endpoints are never authenticated.
+	Auth authConfig `json:"auth"`
+
+	// ShutdownDelay is the reconnect delay suggested to subscribers on
+	// shutdown. If zero, 5s is used.
+	ShutdownDelay duration `json:"shutdown_delay"`
+
+	// ShutdownTimeout is the maximum time to wait for subscriptions and
+	// requests to drain on shutdown. If zero, 30s is used.
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+
+	// LogLevel is debug, info, warn, or error. If empty, info is used.
+	LogLevel slog.Level `json:"log_level"`
+}
+
+type tlsConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// ClientCAFile, if non-empty, is a PEM bundle of CAs used to verify
+	// client certificates, which are requested but not required.
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+type authConfig struct {
+	// BearerTokens maps valid bearer tokens to principal names.
+	BearerTokens map[string]string `json:"bearer_tokens"`
+
+	// Basic maps usernames to passwords for HTTP basic auth.
+	Basic map[string]string `json:"basic"`
+
+	// ClientCertificates authenticates clients with verified TLS client
+	// certificates, which requires tls.client_ca_file.
+	ClientCertificates bool `json:"client_certificates"`
+}
+
+// duration is a time.Duration which is a string like "1m30s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads, validates, and applies defaults to the config file at
+// path. Unknown fields are errors, to catch typos.
+func loadConfig(path string) (config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config{}, fmt.Errorf("read config: %w", err)
+	}
+
+	var c config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return config{}, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	if c.Listen == "" {
+		c.Listen = ":8080"
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = duration(30 * time.Second)
+	}
+
+	if err := c.validate(); err != nil {
+		return config{}, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+func (c config) validate() error {
+	var errs []error
+	for _, name := range c.Topics {
+		if name == "" || strings.ContainsAny(name, "/\x00") {
+			errs = append(errs, fmt.Errorf("topics: invalid topic %q", name))
+		}
+	}
+	if c.Buffer.Min < 0 || c.Buffer.Max < 0 || c.Buffer.Default < 0 || c.Buffer.Max > 0 && c.Buffer.Min > c.Buffer.Max {
+		errs = append(errs, errors.New("buffer: invalid bounds"))
+	}
+	if c.Heartbeat.Min < 0 || c.Heartbeat.Max < 0 || c.Heartbeat.Default < 0 || c.Heartbeat.Max > 0 && c.Heartbeat.Min > c.Heartbeat.Max {
+		errs = append(errs, errors.New("heartbeat: invalid bounds"))
+	}
+	if c.Replay < 0 {
+		errs = append(errs, errors.New("replay: must not be negative"))
+	}
+	if c.TLS != nil && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file are required"))
+	}
+	if c.Auth.ClientCertificates && (c.TLS == nil || c.TLS.ClientCAFile == "") {
+		errs = append(errs, errors.New("auth: client_certificates requires tls.client_ca_file"))
+	}
+	for token := range c.Auth.BearerTokens {
+		if token == "" {
+			errs = append(errs, errors.New("auth: empty bearer token"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// handlerConfig returns the config of a handler serving the registry.
+func (c config) handlerConfig() pshttp.HandlerConfig[json.RawMessage] {
+	return pshttp.HandlerConfig[json.RawMessage]{
+		Authenticator: c.Auth.authenticator(),
+		Limits: pshttp.Limits{
+			MinBuffer:               c.Buffer.Min,
+			MaxBuffer:               c.Buffer.Max,
+			MaxSubscriptions:        c.Limits.MaxSubscriptions,
+			MaxSubscriptionsPerAddr: c.Limits.MaxSubscriptionsPerAddr,
+			MaxPublishBytes:         c.Limits.MaxPublishBytes,
+			PublishRate:             c.Limits.PublishRate,
+			PublishBurst:            c.Limits.PublishBurst,
+		},
+		ShutdownDelay:    time.Duration(c.ShutdownDelay),
+		DefaultBuffer:    c.Buffer.Default,
+		DefaultHeartbeat: time.Duration(c.Heartbeat.Default),
+		MinHeartbeat:     time.Duration(c.Heartbeat.Min),
+		MaxHeartbeat:     time.Duration(c.Heartbeat.Max),
+	}
+}
+
+// authenticator returns nil if no auth method is configured.
+func (a authConfig) authenticator() pshttp.Authenticator {
+	var authenticators []pshttp.Authenticator
+	if len(a.BearerTokens) > 0 {
+		authenticators = append(authenticators, pshttp.BearerTokens(a.BearerTokens))
+	}
+	if len(a.Basic) > 0 {
+		users := a.Basic
+		authenticators = append(authenticators, pshttp.BasicAuth(func(username, password string) bool {
+			want, ok := users[username]
+			return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+		}))
+	}
+	if a.ClientCertificates {
+		authenticators = append(authenticators, pshttp.ClientCertificate())
+	}
+
+	switch len(authenticators) {
+	case 0:
+		return nil
+	case 1:
+		return authenticators[0]
+	default:
+		return pshttp.FirstOf(authenticators...)
+	}
+}
+
+// load reads the certificate files into a server TLS config.
+func (t *tlsConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+// daemon serves a registry of brokers of JSON values. The registry lives as
+// long as the daemon, so topics and their subscribers survive config reloads.
+// Every reload constructs a new handler, which serves new requests; requests
+// already in flight, including long-lived subscriptions, finish on the
+// handler which accepted them, which remains in the admin view until they do.
+type daemon struct {
+	path     string
+	base     *slog.Logger
+	logger   *slog.Logger
+	level    *slog.LevelVar
+	registry *ps.Registry[json.RawMessage]
+
+	pruneInterval time.Duration
+
+	mtx      sync.RWMutex
+	config   config
+	handler  *pshttp.Handler[json.RawMessage]
+	previous []*pshttp.Handler[json.RawMessage]
+	allow    map[string]bool   // nil allows any topic
+	holds    map[string]func() // configured topics are never collected
+	tls      *tls.Config
+	draining bool
+
+	server      *http.Server
+	adminServer *http.Server
+	listener    net.Listener
+	adminLn     net.Listener
+}
+
+// newDaemon constructs a daemon from the config file at path, and binds its
+// listeners. The daemon doesn't serve requests until serve is called.
+func newDaemon(path string, logger *slog.Logger, level *slog.LevelVar) (*daemon, error) {
+	c, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &daemon{
+		path:   path,
+		base:   logger,
+		logger: logger.With("component", "psd"),
+		level:  level,
+		registry: ps.NewRegistry[json.RawMessage](ps.RegistryConfig{
+			IdleTimeout: time.Duration(c.IdleTimeout),
+			Broker:      ps.BrokerConfig{Replay: c.Replay},
+		}),
+		holds:         map[string]func(){},
+		pruneInterval: 10 * time.Second,
+	}
+	if err := d.apply(c); err != nil {
+		return nil, err
+	}
+
+	d.listener, err = net.Listen("tcp", c.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	d.server = &http.Server{
+		Handler:           d,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(d.logger.Handler(), slog.LevelWarn),
+	}
+	if c.TLS != nil {
+		d.listener = tls.NewListener(d.listener, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				d.mtx.RLock()
+				defer d.mtx.RUnlock()
+				return d.tls, nil
+			},
+		})
+	}
+
+	if c.AdminListen != "" {
+		d.adminLn, err = net.Listen("tcp", c.AdminListen)
+		if err != nil {
+			d.listener.Close()
+			return nil, fmt.Errorf("admin listen: %w", err)
+		}
+		admin := pshttp.NewAdminHandler(d.handlers)
+		d.adminServer = &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !d.serveHealth(w, r) {
+					admin.ServeHTTP(w, r)
+				}
+			}),
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          slog.NewLogLogger(d.logger.Handler(), slog.LevelWarn),
+		}
+	}
+
+	return d, nil
+}
+
+// apply makes c the current config. It fails without any effect if the TLS
+// certificates can't be loaded.
+func (d *daemon) apply(c config) error {
+	var tlsConfig *tls.Config
+	if c.TLS != nil {
+		var err error
+		if tlsConfig, err = c.TLS.load(); err != nil {
+			return err
+		}
+	}
+
+	hc := c.handlerConfig()
+	hc.Registry = d.registry
+	hc.Logger = d.base
+	d.mtx.Lock()
+	hc.Replaces = d.handler // keep limits across reloads
+	d.mtx.Unlock()
+	handler := pshttp.NewHandlerConfig(hc)
+
+	var allow map[string]bool
+	if len(c.Topics) > 0 {
+		allow = map[string]bool{}
+		for _, name := range c.Topics {
+			allow[name] = true
+		}
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for name := range allow {
+		if _, ok := d.holds[name]; !ok {
+			_, release, err := d.registry.Acquire(name)
+			if err != nil {
+				return fmt.Errorf("topic %q: %w", name, err) // validated already
+			}
+			d.holds[name] = release
+		}
+	}
+	for name, release := range d.holds {
+		if !allow[name] {
+			release()
+			delete(d.holds, name)
+		}
+	}
+
+	if d.handler != nil {
+		d.previous = append(d.previous, d.handler)
+	}
+	d.config = c
+	d.handler = handler
+	d.allow = allow
+	d.tls = tlsConfig
+	d.level.Set(c.LogLevel)
+
+	return nil
+}
+
+// reload re-reads the config file, and applies it. If the config is invalid,
+// the current config remains in effect.
+func (d *daemon) reload() error {
+	c, err := loadConfig(d.path)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.RLock()
+	prev := d.config
+	d.mtx.RUnlock()
+
+	if (c.TLS == nil) != (prev.TLS == nil) {
+		return errors.New("enabling or disabling TLS requires a restart")
+	}
+	if c.Listen != prev.Listen {
+		d.logger.Warn("reload: listen changes require a restart", "listen", prev.Listen)
+		c.Listen = prev.Listen
+	}
+	if c.AdminListen != prev.AdminListen {
+		d.logger.Warn("reload: admin_listen changes require a restart", "admin_listen", prev.AdminListen)
+		c.AdminListen = prev.AdminListen
+	}
+	if c.IdleTimeout != prev.IdleTimeout {
+		d.logger.Warn("reload: idle_timeout changes require a restart", "idle_timeout", time.Duration(prev.IdleTimeout))
+		c.IdleTimeout = prev.IdleTimeout
+	}
+	if c.Replay != prev.Replay {
+		d.logger.Warn("reload: replay changes require a restart", "replay", prev.Replay)
+		c.Replay = prev.Replay
+	}
+
+	if err := d.apply(c); err != nil {
+		return err
+	}
+
+	d.prune()
+	d.logger.Info("reloaded config", "path", d.path, "topics", len(c.Topics))
+	return nil
+}
+
+// handlers returns the current handler, and then every previous handler which
+// still serves subscriptions, as of the last prune.
+func (d *daemon) handlers() []*pshttp.Handler[json.RawMessage] {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return append([]*pshttp.Handler[json.RawMessage]{d.handler}, d.previous...)
+}
+
+// prune forgets previous handlers which no longer serve any subscriptions.
+func (d *daemon) prune() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	active := d.previous[:0]
+	for _, h := range d.previous {
+		if len(h.Subscriptions()) > 0 {
+			active = append(active, h)
+		}
+	}
+	clear(d.previous[len(active):])
+	d.previous = active
+}
+
+// serve blocks serving requests until shutdown. Previous handlers are pruned
+// periodically while serving.
+func (d *daemon) serve() error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(d.pruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.prune()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	errc := make(chan error, 2)
+	go func() {
+		d.logger.Info("serving", "addr", d.listener.Addr())
+		errc <- d.server.Serve(d.listener)
+	}()
+	if d.adminServer != nil {
+		go func() {
+			d.logger.Info("serving admin", "addr", d.adminLn.Addr())
+			errc <- d.adminServer.Serve(d.adminLn)
+		}()
+	}
+
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// shutdown fails readiness checks, drains every subscription with a suggested
+// reconnect delay, and then waits for remaining requests to finish.
+func (d *daemon) shutdown() error {
+	d.mtx.Lock()
+	d.draining = true
+	timeout := time.Duration(d.config.ShutdownTimeout)
+	d.mtx.Unlock()
+
+	handlers := d.handlers()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(handlers)+2)
+	)
+	for i, h := range handlers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = h.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+
+	errs[len(handlers)] = d.server.Shutdown(ctx)
+	if d.adminServer != nil {
+		errs[len(handlers)+1] = d.adminServer.Shutdown(ctx)
+	}
+
+	d.mtx.Lock()
+	for name, release := range d.holds {
+		release()
+		delete(d.holds, name)
+	}
+	d.mtx.Unlock()
+
+	return errors.Join(errs...)
+}
+
+// ServeHTTP implements http.Handler. Requests for topics which aren't in the
+// configured set of topics receive 404 Not Found.
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.serveHealth(w, r) {
+		return
+	}
+
+	d.mtx.RLock()
+	handler, allow := d.handler, d.allow
+	d.mtx.RUnlock()
+
+	if name, ok := topicName(r); ok && allow != nil && !allow[name] {
+		respondJSON(w, http.StatusNotFound, map[string]string{"error": ps.ErrUnknownTopic.Error()})
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// serveHealth serves GET /healthz, which succeeds while the process is up,
+// and GET /readyz, which fails once the daemon starts shutting down.
+func (d *daemon) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	switch r.URL.Path {
+	case "/healthz":
+		respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return true
+	case "/readyz":
+		d.mtx.RLock()
+		draining := d.draining
+		d.mtx.RUnlock()
+		if draining {
+			respondJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		} else {
+			respondJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// topicName returns the topic of requests under /topics/{topic}.
+func topicName(r *http.Request) (string, bool) {
+	rest, ok := strings.CutPrefix(r.URL.EscapedPath(), "/topics/")
+	if !ok {
+		return "", false
+	}
+	segment, _, _ := strings.Cut(rest, "/")
+	name, err := url.PathUnescape(segment)
+	if err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+func respondJSON(w http.ResponseWriter, code int, response any) {
+	body, _ := json.MarshalIndent(response, "", "    ")
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// addr returns the address of the pub/sub server.
+func (d *daemon) addr() string {
+	return d.listener.Addr().String()
+}
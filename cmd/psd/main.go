@@ -0,0 +1,131 @@
+// Command psd is a daemon serving pub/sub brokers of JSON values over HTTP,
+// with package pshttp. Brokers are named topics, served under /topics/{topic},
+// and GET /topics lists every topic. Use command ps as a client.
+//
+// psd is configured with a JSON file, see -config. Every field is optional.
+//
+//	{
+//	    "listen": ":8080",
+//	    "admin_listen": "127.0.0.1:8081",
+//	    "tls": {"cert_file": "server.crt", "key_file": "server.key", "client_ca_file": ""},
+//	    "topics": ["orders", "events"],
+//	    "idle_timeout": "10m",
+//	    "replay": 1000,
+//	    "buffer": {"default": 100, "min": 1, "max": 1000},
+//	    "heartbeat": {"default": "3s", "min": "1s", "max": "60s"},
+//	    "limits": {
+//	        "max_subscriptions": 10000,
+//	        "max_subscriptions_per_addr": 100,
+//	        "max_publish_bytes": 1048576,
+//	        "publish_rate": 100,
+//	        "publish_burst": 200
+//	    },
+//	    "auth": {
+//	        "bearer_tokens": {"s3cr3t": "alice"},
+//	        "basic": {"bob": "hunter2"},
+//	        "client_certificates": false
+//	    },
+//	    "shutdown_delay": "5s",
+//	    "shutdown_timeout": "30s",
+//	    "log_level": "info"
+//	}
+//
+// If topics is empty, topics are created on demand. GET /healthz and GET
+// /readyz are served without authentication on both servers; readiness fails
+// once shutdown begins. The admin server also serves the endpoints of
+// [pshttp.NewAdminHandler], without authentication, covering subscriptions
+// accepted before any reload.
+//
+// SIGHUP reloads the config file. Topics, TLS certificates, limits, auth, and
+// the log level take effect for new requests, and existing subscriptions are
+// unaffected. An invalid config is logged, and the previous config remains in
+// effect. SIGTERM and SIGINT shut down gracefully: subscribers are told when
+// to reconnect, and requests are drained, up to the shutdown timeout.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	os.Exit(run(os.Args[1:], signals, os.Stderr))
+}
+
+func run(args []string, signals <-chan os.Signal, stderr io.Writer) int {
+	fs := flag.NewFlagSet("psd", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		configFile = fs.String("config", "psd.json", "path to the JSON config file")
+		check      = fs.Bool("check", false, "validate the config file and exit")
+	)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "psd: unexpected arguments %q\n", fs.Args())
+		return 2
+	}
+
+	if *check {
+		if _, err := loadConfig(*configFile); err != nil {
+			fmt.Fprintf(stderr, "psd: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stderr, "psd: %s is valid\n", *configFile)
+		return 0
+	}
+
+	var (
+		level  = new(slog.LevelVar)
+		logger = slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level}))
+	)
+
+	d, err := newDaemon(*configFile, logger, level)
+	if err != nil {
+		fmt.Fprintf(stderr, "psd: %v\n", err)
+		return 1
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- d.serve() }()
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := d.reload(); err != nil {
+					d.logger.Error("reload failed, keeping previous config", "error", err)
+				}
+				continue
+			}
+
+			d.logger.Info("shutting down", "signal", sig)
+			if err := d.shutdown(); err != nil {
+				d.logger.Error("shutdown", "error", err)
+				return 1
+			}
+			if err := <-errc; err != nil {
+				d.logger.Error("serve", "error", err)
+				return 1
+			}
+			d.logger.Info("shutdown complete")
+			return 0
+
+		case err := <-errc:
+			d.logger.Error("serve", "error", err)
+			return 1
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+func TestDaemon(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "psd.json")
+	writeConfig := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{
+		"listen": "127.0.0.1:0",
+		"admin_listen": "127.0.0.1:0",
+		"topics": ["a"],
+		"auth": {"bearer_tokens": {"t1": "alice"}},
+		"heartbeat": {"default": "100ms", "min": "10ms"},
+		"shutdown_delay": "1s",
+		"log_level": "warn"
+	}`)
+
+	d, err := newDaemon(path, slog.New(slog.NewTextHandler(io.Discard, nil)), new(slog.LevelVar))
+	if err != nil {
+		t.Fatalf("new daemon: %v", err)
+	}
+	servec := make(chan error, 1)
+	go func() { servec <- d.serve() }()
+
+	base := "http://" + d.addr()
+	get := func(url string) int {
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if want, have := http.StatusOK, get(base+"/healthz"); want != have {
+		t.Errorf("healthz: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusOK, get("http://"+d.adminLn.Addr().String()+"/readyz"); want != have {
+		t.Errorf("admin readyz: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusUnauthorized, get(base+"/topics"); want != have {
+		t.Errorf("topics without token: want %d, have %d", want, have)
+	}
+
+	newClient := func(topic, token string) *pshttp.Client[json.RawMessage] {
+		client, err := pshttp.NewClientWithOptions[json.RawMessage](base, pshttp.WithHeader[json.RawMessage]("authorization", "Bearer "+token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if topic == "" {
+			return client
+		}
+		return client.Topic(topic)
+	}
+
+	topics, err := newClient("", "t1").Topics(ctx)
+	if err != nil {
+		t.Fatalf("topics: %v", err)
+	}
+	if want, have := 1, len(topics); want != have {
+		t.Fatalf("topics: want %d, have %d", want, have)
+	}
+
+	var statusErr *pshttp.StatusError
+	if _, err := newClient("b", "t1").Publish(ctx, json.RawMessage(`1`)); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("publish to unknown topic: want 404, have %v", err)
+	}
+
+	var (
+		valc   = make(chan json.RawMessage, 10)
+		states = make(chan pshttp.ConnState, 10)
+		subc   = make(chan error, 1)
+	)
+	go func() {
+		subc <- newClient("a", "t1").SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{
+			Reconnect:     pshttp.ConstantBackoff(time.Minute),
+			OnStateChange: func(state pshttp.ConnState, _ error) { states <- state },
+		})
+	}()
+	for state := range states {
+		if state == pshttp.StateConnected {
+			break
+		}
+	}
+
+	writeConfig(`{
+		"listen": "127.0.0.1:0",
+		"admin_listen": "127.0.0.1:0",
+		"topics": ["a", "b"],
+		"auth": {"bearer_tokens": {"t2": "bob"}},
+		"shutdown_delay": "1s"
+	}`)
+	if err := d.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if _, err := newClient("a", "t1").Publish(ctx, json.RawMessage(`1`)); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("publish with revoked token: want 401, have %v", err)
+	}
+	stats, err := newClient("a", "t2").Publish(ctx, json.RawMessage(`2`))
+	if err != nil {
+		t.Fatalf("publish after reload: %v", err)
+	}
+	if want, have := uint64(1), stats.Sends; want != have {
+		t.Errorf("existing subscription after reload: want %d send(s), have %d", want, have)
+	}
+	if want, have := `2`, string(<-valc); want != have {
+		t.Errorf("value: want %s, have %s", want, have)
+	}
+	if _, err := newClient("b", "t2").Publish(ctx, json.RawMessage(`3`)); err != nil {
+		t.Errorf("publish to added topic: %v", err)
+	}
+
+	writeConfig(`{"topics": ["/"]}`)
+	if err := d.reload(); err == nil {
+		t.Errorf("reload with invalid config: want error, have none")
+	}
+	if _, err := newClient("b", "t2").Publish(ctx, json.RawMessage(`4`)); err != nil {
+		t.Errorf("publish after failed reload: %v", err)
+	}
+
+	if err := d.shutdown(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-servec; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	for state := range states {
+		if state == pshttp.StateDisconnected {
+			break // drained with a suggested reconnect delay
+		}
+	}
+	cancel()
+	<-subc
+}
+
+func TestDaemonReloadAdmin(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "psd.json")
+	config := `{"listen": "127.0.0.1:0", "admin_listen": "127.0.0.1:0", "shutdown_delay": "1s"}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDaemon(path, slog.New(slog.NewTextHandler(io.Discard, nil)), new(slog.LevelVar))
+	if err != nil {
+		t.Fatalf("new daemon: %v", err)
+	}
+	d.pruneInterval = 10 * time.Millisecond
+	servec := make(chan error, 1)
+	go func() { servec <- d.serve() }()
+	defer func() {
+		if err := d.shutdown(); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-servec
+	}()
+
+	client, err := pshttp.NewClientWithOptions[json.RawMessage]("http://" + d.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subctx, subcancel := context.WithCancel(ctx)
+	defer subcancel()
+	var (
+		connected = make(chan struct{}, 1)
+		subc      = make(chan error, 1)
+	)
+	go func() {
+		subc <- client.Topic("a").SubscribeConfig(subctx, make(chan json.RawMessage, 10), pshttp.SubscribeConfig{
+			OnStateChange: func(state pshttp.ConnState, _ error) {
+				if state == pshttp.StateConnected {
+					connected <- struct{}{}
+				}
+			},
+		})
+	}()
+	<-connected
+
+	if err := d.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	admin := "http://" + d.adminLn.Addr().String()
+	req, _ := http.NewRequestWithContext(ctx, "GET", admin+"/subscriptions", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("list subscriptions: %v", err)
+	}
+	var subs []pshttp.SubscriptionInfo
+	err = json.NewDecoder(resp.Body).Decode(&subs)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("decode subscriptions: %v", err)
+	}
+	if want, have := 1, len(subs); want != have {
+		t.Fatalf("subscriptions after reload: want %d, have %d", want, have)
+	}
+
+	// Once the subscription ends, the previous handler is pruned without
+	// another reload.
+	subcancel()
+	<-subc
+	for len(d.handlers()) > 1 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("previous handler wasn't pruned: %v", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestDaemonReloadLimits(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "psd.json")
+	config := `{
+		"listen": "127.0.0.1:0",
+		"shutdown_delay": "1s",
+		"limits": {"max_subscriptions_per_addr": 1, "publish_rate": 0.001, "publish_burst": 1}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDaemon(path, slog.New(slog.NewTextHandler(io.Discard, nil)), new(slog.LevelVar))
+	if err != nil {
+		t.Fatalf("new daemon: %v", err)
+	}
+	servec := make(chan error, 1)
+	go func() { servec <- d.serve() }()
+	defer func() {
+		if err := d.shutdown(); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-servec
+	}()
+
+	url := "http://" + d.addr() + "/topics/a"
+	subscribe := func() *http.Response {
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		req.Header.Set("accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		return resp
+	}
+	publish := func() int {
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(`1`))
+		req.Header.Set("content-type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	first := subscribe()
+	defer first.Body.Close()
+	if want, have := http.StatusOK, first.StatusCode; want != have {
+		t.Fatalf("first subscribe: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusOK, publish(); want != have {
+		t.Fatalf("first publish: want %d, have %d", want, have)
+	}
+
+	if err := d.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	// The subscription and publish before the reload still count toward the
+	// limits of the new handler.
+	second := subscribe()
+	second.Body.Close()
+	if want, have := http.StatusTooManyRequests, second.StatusCode; want != have {
+		t.Errorf("subscribe after reload: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusTooManyRequests, publish(); want != have {
+		t.Errorf("publish after reload: want %d, have %d", want, have)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name   string
+		config string
+		want   int
+		output string
+	}{
+		{"valid", `{"listen": ":0", "heartbeat": {"default": "5s"}}`, 0, "is valid"},
+		{"unknown field", `{"listne": ":0"}`, 1, "unknown field"},
+		{"invalid duration", `{"shutdown_delay": 5}`, 1, "duration"},
+		{"negative replay", `{"replay": -1}`, 1, "replay"},
+		{"missing key", `{"tls": {"cert_file": "a.crt"}}`, 1, "key_file"},
+		{"client certificates", `{"auth": {"client_certificates": true}}`, 1, "client_ca_file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".json")
+			if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var stderr bytes.Buffer
+			if want, have := tc.want, run([]string{"-check", "-config", path}, nil, &stderr); want != have {
+				t.Errorf("exit: want %d, have %d (%s)", want, have, stderr.String())
+			}
+			if want, have := tc.output, stderr.String(); !strings.Contains(have, want) {
+				t.Errorf("output: want %q, have %q", want, have)
+			}
+		})
+	}
+}
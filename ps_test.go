@@ -1,7 +1,9 @@
 package ps_test
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/peterbourgon/ps"
 )
@@ -97,6 +99,199 @@ func TestBasics(t *testing.T) {
 	})
 }
 
+func TestPublishKey(t *testing.T) {
+	t.Parallel()
+
+	t.Run("duplicates", func(t *testing.T) {
+		broker := ps.NewBroker[int]()
+
+		c := make(chan int, 10)
+		broker.SubscribeAll(c)
+
+		stats, duplicate := broker.PublishKey("k1", 1)
+		compareStats(t, stats, ps.Stats{Sends: 1})
+		expectEqual(t, false, duplicate)
+
+		broker.Unsubscribe(c)
+
+		stats, duplicate = broker.PublishKey("k1", 2)
+		compareStats(t, stats, ps.Stats{Sends: 1}) // original stats
+		expectEqual(t, true, duplicate)
+
+		stats, duplicate = broker.PublishKey("", 3)
+		compareStats(t, stats, ps.Stats{})
+		expectEqual(t, false, duplicate)
+
+		expectEqual(t, 1, <-c)
+		expectEqual(t, 0, len(c))
+	})
+
+	t.Run("window", func(t *testing.T) {
+		broker := ps.NewBrokerConfig[int](ps.BrokerConfig{DedupWindow: 10 * time.Millisecond})
+
+		_, duplicate := broker.PublishKey("k", 1)
+		expectEqual(t, false, duplicate)
+		_, duplicate = broker.PublishKey("k", 1)
+		expectEqual(t, true, duplicate)
+
+		time.Sleep(20 * time.Millisecond)
+
+		_, duplicate = broker.PublishKey("k", 1)
+		expectEqual(t, false, duplicate)
+	})
+
+	t.Run("max keys", func(t *testing.T) {
+		broker := ps.NewBrokerConfig[int](ps.BrokerConfig{MaxDedupKeys: 2})
+
+		broker.PublishKey("a", 1)
+		broker.PublishKey("b", 2)
+		broker.PublishKey("c", 3)
+
+		_, duplicate := broker.PublishKey("c", 3)
+		expectEqual(t, true, duplicate)
+		_, duplicate = broker.PublishKey("a", 1)
+		expectEqual(t, false, duplicate) // forgotten
+	})
+}
+
+func TestResume(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ids", func(t *testing.T) {
+		broker := ps.NewBroker[int]()
+
+		var (
+			c   = make(chan int, 2)
+			ids = make(chan string, 3)
+		)
+		replay, ok, err := broker.Resume(c, ids, nil, "")
+		requireNoError(t, err)
+		expectEqual(t, true, ok)
+		expectEqual(t, 0, len(replay))
+
+		broker.PublishKey("k", 1)
+		broker.Publish(2)
+		compareStats(t, broker.Publish(3), ps.Stats{Drops: 1})
+
+		expectEqual(t, 1, <-c)
+		expectEqual(t, "k", <-ids)
+		expectEqual(t, 2, <-c)
+		if id := <-ids; id == "" || id == "k" {
+			t.Errorf("want unique ID, have %q", id)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		broker := ps.NewBrokerConfig[int](ps.BrokerConfig{Replay: 3})
+
+		for i, key := range []string{"a", "b", "c", "d"} {
+			broker.PublishKey(key, i+1)
+		}
+
+		c := make(chan int, 10)
+		replay, ok, err := broker.Resume(c, nil, func(i int) bool { return i != 3 }, "b")
+		requireNoError(t, err)
+		expectEqual(t, true, ok)
+		expectEqual(t, 1, len(replay))
+		expectEqual(t, ps.Message[int]{ID: "d", Value: 4}, replay[0])
+
+		stats, err := broker.Stats(c)
+		requireNoError(t, err)
+		compareStats(t, stats, ps.Stats{Sends: 1})
+
+		stats, _ = broker.PublishKey("e", 5)
+		compareStats(t, stats, ps.Stats{Sends: 1})
+		expectEqual(t, 5, <-c)
+	})
+
+	t.Run("message", func(t *testing.T) {
+		broker := ps.NewBrokerConfig[int](ps.BrokerConfig{Replay: 3})
+
+		broker.PublishMessage(ps.Message[int]{ID: "a", Value: 1})
+		broker.PublishMessage(ps.Message[int]{ID: "b", Value: 2})
+
+		// IDs of messages aren't dedup keys.
+		stats, duplicate := broker.PublishKey("a", 3)
+		expectEqual(t, false, duplicate)
+		compareStats(t, stats, ps.Stats{})
+
+		replay, ok, err := broker.Resume(make(chan int), nil, nil, "b")
+		requireNoError(t, err)
+		expectEqual(t, true, ok)
+		expectEqual(t, 1, len(replay))
+		expectEqual(t, ps.Message[int]{ID: "a", Value: 3}, replay[0])
+	})
+
+	t.Run("not retained", func(t *testing.T) {
+		broker := ps.NewBrokerConfig[int](ps.BrokerConfig{Replay: 1})
+
+		broker.PublishKey("a", 1)
+		broker.PublishKey("b", 2)
+
+		replay, ok, err := broker.Resume(make(chan int), nil, nil, "a")
+		requireNoError(t, err)
+		expectEqual(t, false, ok)
+		expectEqual(t, 0, len(replay))
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	t.Run("allowlist", func(t *testing.T) {
+		registry := ps.NewRegistry[int](ps.RegistryConfig{Allowlist: []string{"a", "b"}})
+
+		a1, release1, err := registry.Acquire("a")
+		requireNoError(t, err)
+		defer release1()
+
+		a2, release2, err := registry.Acquire("a")
+		requireNoError(t, err)
+		defer release2()
+
+		expectEqual(t, a1, a2)
+
+		_, _, err = registry.Acquire("c")
+		expectEqual(t, ps.ErrUnknownTopic, err)
+
+		expectEqual(t, nil, registry.Check("b"))
+		expectEqual(t, ps.ErrUnknownTopic, registry.Check("c"))
+		expectEqual(t, ps.ErrUnknownTopic, registry.Check("a/b"))
+
+		a1.SubscribeAll(make(chan int))
+		expectEqual(t, 1, len(registry.Topics()))
+		expectEqual(t, ps.TopicInfo{Name: "a", Subscribers: 1}, registry.Topics()[0])
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		registry := ps.NewRegistry[int](ps.RegistryConfig{IdleTimeout: time.Millisecond})
+
+		b, release, err := registry.Acquire("b")
+		requireNoError(t, err)
+		c := make(chan int)
+		b.SubscribeAll(c)
+		release()
+
+		_, release, err = registry.Acquire("x")
+		requireNoError(t, err)
+
+		_, _, err = registry.Acquire("y")
+		requireNoError(t, err) // never released
+
+		time.Sleep(10 * time.Millisecond)
+		expectEqual(t, 0, len(registry.Sweep())) // x is acquired, b has a subscriber
+
+		release()
+		time.Sleep(10 * time.Millisecond)
+		expectEqual(t, "x", strings.Join(registry.Sweep(), ","))
+
+		b.Unsubscribe(c)
+		time.Sleep(10 * time.Millisecond)
+		expectEqual(t, "b", strings.Join(registry.Sweep(), ","))
+		expectEqual(t, "y", registry.Topics()[0].Name)
+	})
+}
+
 func compareStats(tb testing.TB, have, want ps.Stats) {
 	tb.Helper()
 	if have.String() != want.String() {
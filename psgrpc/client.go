@@ -0,0 +1,224 @@
+package psgrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/psgrpc/pb"
+	"github.com/peterbourgon/ps/pshttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Client represents a remote pub/sub broker served by a [Server]. It provides
+// publish and subscribe functionality similar to a normal [ps.Broker], and
+// mirrors [pshttp.Client].
+type Client[T any] struct {
+	client pb.BrokerClient
+	codec  pshttp.Codec[T]
+}
+
+// NewDefaultClient calls [NewClient] with the [pshttp.JSONCodec].
+func NewDefaultClient[T any](conn grpc.ClientConnInterface) *Client[T] {
+	return NewClient(conn, pshttp.JSONCodec[T]())
+}
+
+// NewClient returns a client for the Broker service on the given connection,
+// e.g. a [grpc.ClientConn]. The media type of the codec is sent with every
+// request, so the server can select the same codec.
+func NewClient[T any](conn grpc.ClientConnInterface, codec pshttp.Codec[T]) *Client[T] {
+	return &Client[T]{
+		client: pb.NewBrokerClient(conn),
+		codec:  codec,
+	}
+}
+
+// Publish the value v to the remote pub/sub broker.
+func (c *Client[T]) Publish(ctx context.Context, v T) (ps.Stats, error) {
+	var buf bytes.Buffer
+	if err := c.codec.Encode(v, &buf); err != nil {
+		return ps.Stats{}, fmt.Errorf("encode value: %w", err)
+	}
+
+	resp, err := c.client.Publish(ctx, &pb.PublishRequest{
+		Value:     buf.Bytes(),
+		MediaType: c.codec.MediaType,
+	})
+	if err != nil {
+		return ps.Stats{}, err
+	}
+
+	return statsFromProto(resp.GetStats()), nil
+}
+
+// Subscribe calls [Client.SubscribeConfig] with a [pshttp.ConstantBackoff]
+// reconnect policy of the given retry duration.
+func (c *Client[T]) Subscribe(ctx context.Context, ch chan<- T, retry time.Duration) error {
+	return c.SubscribeConfig(ctx, ch, SubscribeConfig{
+		Reconnect: pshttp.ConstantBackoff(retry),
+	})
+}
+
+// SubscribeConfig enumerates the optional parameters for a subscription.
+type SubscribeConfig struct {
+	// Reconnect decides if and when to resubscribe after a subscription
+	// fails. If nil, a [pshttp.ConstantBackoff] of 1s is used.
+	Reconnect pshttp.ReconnectPolicy
+
+	// OnStateChange, if non-nil, is called synchronously whenever the state of
+	// the subscription changes. The error is non-nil for
+	// [pshttp.StateDisconnected] and [pshttp.StateGaveUp] if the state change
+	// was caused by an error.
+	OnStateChange func(state pshttp.ConnState, err error)
+
+	// OnHeartbeat, if non-nil, is called synchronously with the timestamp and
+	// stats of every heartbeat received from the server.
+	OnHeartbeat func(ts time.Time, stats ps.Stats)
+
+	// Filter, if non-empty, is sent to the server, which parses it into an
+	// allow func for the subscription. See [ServerConfig.Filter].
+	Filter string
+
+	// Buffer, if non-zero, is the buffer requested for the subscription.
+	Buffer int
+
+	// Heartbeat, if non-zero, is the heartbeat interval requested for the
+	// subscription.
+	Heartbeat time.Duration
+}
+
+// SubscribeConfig subscribes to published values on the remote pub/sub broker,
+// and forwards them to ch. Failed subscriptions are automatically
+// re-established according to the reconnect policy. SubscribeConfig blocks
+// until the context is canceled, the reconnect policy gives up, or a fatal
+// error occurs, whichever comes first.
+func (c *Client[T]) SubscribeConfig(ctx context.Context, ch chan<- T, config SubscribeConfig) error {
+	if config.Reconnect == nil {
+		config.Reconnect = pshttp.ConstantBackoff(1 * time.Second)
+	}
+
+	notify := func(state pshttp.ConnState, err error) {
+		if config.OnStateChange != nil {
+			config.OnStateChange(state, err)
+		}
+	}
+
+	var (
+		attempt int
+		first   time.Time
+	)
+	for {
+		notify(pshttp.StateConnecting, nil)
+
+		err := c.subscribeOnce(ctx, ch, config, func() {
+			attempt = 0
+			notify(pshttp.StateConnected, nil)
+		})
+
+		if ctx.Err() != nil {
+			notify(pshttp.StateDisconnected, ctx.Err())
+			return ctx.Err()
+		}
+
+		notify(pshttp.StateDisconnected, err)
+
+		if isFatal(err) {
+			notify(pshttp.StateGaveUp, err)
+			return err
+		}
+
+		if attempt == 0 {
+			first = time.Now()
+		}
+		attempt++
+
+		delay, ok := config.Reconnect.Next(attempt, time.Since(first), err)
+		if !ok {
+			err = fmt.Errorf("gave up after %d reconnect attempt(s): %w", attempt-1, err)
+			notify(pshttp.StateGaveUp, err)
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+			// reconnect
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// subscribeOnce makes a single subscription, and forwards values to ch until
+// the subscription fails.
+func (c *Client[T]) subscribeOnce(ctx context.Context, ch chan<- T, config SubscribeConfig, connected func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req := &pb.SubscribeRequest{
+		Filter:    config.Filter,
+		Buffer:    int32(config.Buffer),
+		MediaType: c.codec.MediaType,
+	}
+	if config.Heartbeat > 0 {
+		req.Heartbeat = durationpb.New(config.Heartbeat)
+	}
+
+	stream, err := c.client.Subscribe(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	// Server-streaming calls don't report errors until the first receive, so
+	// wait for the response headers before reporting the connection.
+	if _, err := stream.Header(); err != nil {
+		return err
+	}
+
+	connected()
+
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("subscription closed by server")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch ev := resp.GetEvent().(type) {
+		case *pb.SubscribeResponse_Value:
+			var v T
+			if err := c.codec.Decode(bytes.NewReader(ev.Value.GetData()), &v); err != nil {
+				return status.Errorf(codes.InvalidArgument, "decode value: %v", err)
+			}
+			select {
+			case ch <- v:
+				// good
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+		case *pb.SubscribeResponse_Heartbeat:
+			if config.OnHeartbeat != nil {
+				config.OnHeartbeat(ev.Heartbeat.GetTimestamp().AsTime(), statsFromProto(ev.Heartbeat.GetStats()))
+			}
+		}
+	}
+}
+
+// isFatal returns true for errors that won't be resolved by resubscribing.
+func isFatal(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unimplemented, codes.Unauthenticated, codes.PermissionDenied, codes.FailedPrecondition:
+		return true
+	default:
+		return false
+	}
+}
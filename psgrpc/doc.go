@@ -0,0 +1,15 @@
+// Package psgrpc provides a gRPC interface to a [ps.Broker].
+//
+// [Server] implements the Broker service defined in package pb, with a unary
+// Publish method, and a server-streaming Subscribe method. Subscriptions carry
+// values, interleaved with periodic heartbeats which report the [ps.Stats] of
+// the subscription. Register the server with a [grpc.Server] via
+// [Server.Register].
+//
+// [Client] wraps a connection to a server. It provides publish and subscribe
+// methods similar to a [ps.Broker], and mirrors [pshttp.Client], including
+// automatic resubscription according to a [pshttp.ReconnectPolicy].
+//
+// Values are encoded with a [pshttp.Codec], and the media type of the codec is
+// sent with each request, so servers can support many codecs at once.
+package psgrpc
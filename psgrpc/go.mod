@@ -0,0 +1,19 @@
+module github.com/peterbourgon/ps/psgrpc
+
+go 1.24.0
+
+require (
+	github.com/peterbourgon/ps v0.0.0-00010101000000-000000000000
+	google.golang.org/grpc v1.80.0
+	google.golang.org/protobuf v1.36.12
+)
+
+require (
+	github.com/peterbourgon/eventsource v0.0.0-20240918134904-0c90791d8b55 // indirect
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+	golang.org/x/text v0.33.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260120221211-b8f7ae30c516 // indirect
+)
+
+replace github.com/peterbourgon/ps => ../
@@ -0,0 +1,4 @@
+// Package pb contains the protobuf definitions of the psgrpc service.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ps.proto
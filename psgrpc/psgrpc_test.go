@@ -0,0 +1,207 @@
+package psgrpc_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/psgrpc"
+	"github.com/peterbourgon/ps/pshttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestBasics(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	conn := newTestConn(t, psgrpc.NewServer(psgrpc.ServerConfig[int64]{
+		Broker:       broker,
+		MinHeartbeat: 10 * time.Millisecond,
+		Filter: func(filter string) (func(int64) bool, error) {
+			n, err := strconv.ParseInt(filter, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return func(v int64) bool { return v%n == 0 }, nil
+		},
+	}))
+	client := psgrpc.NewDefaultClient[int64](conn)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		valc       = make(chan int64, 10)
+		connected  = make(chan struct{}, 10)
+		heartbeats = make(chan ps.Stats, 100)
+		done       = make(chan error, 1)
+	)
+	go func() {
+		done <- client.SubscribeConfig(ctx, valc, psgrpc.SubscribeConfig{
+			Filter:    "2",
+			Heartbeat: 10 * time.Millisecond,
+			OnStateChange: func(state pshttp.ConnState, err error) {
+				if state == pshttp.StateConnected {
+					connected <- struct{}{}
+				}
+			},
+			OnHeartbeat: func(ts time.Time, stats ps.Stats) {
+				select {
+				case heartbeats <- stats:
+				default:
+				}
+			},
+		})
+	}()
+	<-connected
+
+	for v := range int64(4) {
+		stats, err := client.Publish(ctx, v)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		if want, have := uint64(1), stats.Total(); want != have {
+			t.Errorf("publish %d: want total %d, have %d (%v)", v, want, have, stats)
+		}
+	}
+
+	for _, want := range []int64{0, 2} {
+		if have := <-valc; want != have {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	}
+
+	for stats := range heartbeats {
+		if stats == (ps.Stats{Skips: 2, Sends: 2}) {
+			break
+		}
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("subscribe: want %v, have %v", context.Canceled, err)
+	}
+}
+
+func TestFatalErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	conn := newTestConn(t, psgrpc.NewServer(psgrpc.ServerConfig[int64]{
+		Broker: ps.NewBroker[int64](),
+		Filter: func(filter string) (func(int64) bool, error) {
+			_, err := strconv.ParseInt(filter, 10, 64)
+			return func(int64) bool { return true }, err
+		},
+	}))
+	client := psgrpc.NewDefaultClient[int64](conn)
+
+	err := client.SubscribeConfig(ctx, make(chan int64), psgrpc.SubscribeConfig{
+		Filter:    "invalid",
+		Reconnect: pshttp.ConstantBackoff(time.Millisecond),
+	})
+	if want, have := codes.InvalidArgument, status.Code(err); want != have {
+		t.Errorf("invalid filter: want %v, have %v (%v)", want, have, err)
+	}
+
+	stringClient := psgrpc.NewDefaultClient[string](conn)
+	if _, err := stringClient.Publish(ctx, "not an int"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("invalid value: want %v, have %v", codes.InvalidArgument, err)
+	}
+
+	unfiltered := psgrpc.NewDefaultClient[int64](newTestConn(t, psgrpc.NewServer(psgrpc.ServerConfig[int64]{
+		Broker: ps.NewBroker[int64](),
+	})))
+	err = unfiltered.SubscribeConfig(ctx, make(chan int64), psgrpc.SubscribeConfig{
+		Filter:    "1",
+		Reconnect: pshttp.ConstantBackoff(time.Millisecond),
+	})
+	if want, have := codes.InvalidArgument, status.Code(err); want != have {
+		t.Errorf("unsupported filter: want %v, have %v (%v)", want, have, err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	conn := newTestConn(t, psgrpc.NewServer(psgrpc.ServerConfig[int64]{
+		Broker: broker,
+		Codecs: pshttp.Codecs[int64]{pshttp.JSONCodec[int64](), pshttp.GobCodec[int64]()},
+	}))
+
+	var (
+		jsonClient = psgrpc.NewDefaultClient[int64](conn)
+		gobClient  = psgrpc.NewClient(conn, pshttp.GobCodec[int64]())
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		connected = make(chan struct{}, 10)
+		onState   = func(state pshttp.ConnState, err error) {
+			if state == pshttp.StateConnected {
+				connected <- struct{}{}
+			}
+		}
+		jsonc = make(chan int64, 10)
+		gobc  = make(chan int64, 10)
+	)
+	for client, c := range map[*psgrpc.Client[int64]]chan int64{jsonClient: jsonc, gobClient: gobc} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.SubscribeConfig(ctx, c, psgrpc.SubscribeConfig{OnStateChange: onState})
+		}()
+	}
+	<-connected
+	<-connected
+
+	if _, err := gobClient.Publish(ctx, 42); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if want, have := int64(42), <-jsonc; want != have {
+		t.Errorf("JSON: want %v, have %v", want, have)
+	}
+	if want, have := int64(42), <-gobc; want != have {
+		t.Errorf("CBOR: want %v, have %v", want, have)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func newTestConn(t *testing.T, server interface{ Register(grpc.ServiceRegistrar) }) *grpc.ClientConn {
+	t.Helper()
+
+	var (
+		lis = bufconn.Listen(1024 * 1024)
+		srv = grpc.NewServer()
+	)
+	server.Register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
@@ -0,0 +1,242 @@
+package psgrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/psgrpc/pb"
+	"github.com/peterbourgon/ps/pshttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server implements the Broker gRPC service for a [ps.Broker].
+type Server[T any] struct {
+	pb.UnimplementedBrokerServer
+
+	broker       *ps.Broker[T]
+	codecs       pshttp.Codecs[T]
+	filter       func(string) (func(T) bool, error)
+	buffer       int
+	heartbeat    time.Duration
+	minHeartbeat time.Duration
+	maxHeartbeat time.Duration
+	logger       *slog.Logger
+}
+
+// ServerConfig enumerates the parameters for a server returned by
+// [NewServer]. Broker is required.
+type ServerConfig[T any] struct {
+	// Broker is the pub/sub broker served by the server.
+	Broker *ps.Broker[T]
+
+	// Codecs are used to decode published values, and to encode values for
+	// subscribers, selected by the media type in each request. Requests that
+	// don't specify a known media type use the first codec. If empty, the
+	// [pshttp.JSONCodec] is used.
+	Codecs pshttp.Codecs[T]
+
+	// Filter, if non-nil, parses the filter of subscribe requests into an
+	// allow func for the subscription. Subscribe requests with an invalid
+	// filter fail with InvalidArgument. If nil, filters aren't supported, and
+	// subscribe requests with a filter fail with InvalidArgument.
+	Filter func(filter string) (allow func(T) bool, err error)
+
+	// DefaultBuffer is the buffer of subscriptions which don't specify one.
+	// If zero, 100 is used.
+	DefaultBuffer int
+
+	// DefaultHeartbeat is the heartbeat interval of subscriptions which don't
+	// specify one. Requested intervals must be between MinHeartbeat and
+	// MaxHeartbeat. If zero, they are 3s, 1s, and 60s respectively.
+	DefaultHeartbeat time.Duration
+	MinHeartbeat     time.Duration
+	MaxHeartbeat     time.Duration
+
+	// Logger receives log output from the server. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+}
+
+// NewServer returns a new server for the configured broker.
+func NewServer[T any](config ServerConfig[T]) *Server[T] {
+	if len(config.Codecs) == 0 {
+		config.Codecs = pshttp.Codecs[T]{pshttp.JSONCodec[T]()}
+	}
+	if config.DefaultBuffer <= 0 {
+		config.DefaultBuffer = 100
+	}
+	if config.DefaultHeartbeat <= 0 {
+		config.DefaultHeartbeat = 3 * time.Second
+	}
+	if config.MinHeartbeat <= 0 {
+		config.MinHeartbeat = min(1*time.Second, config.DefaultHeartbeat)
+	}
+	if config.MaxHeartbeat <= 0 {
+		config.MaxHeartbeat = max(60*time.Second, config.DefaultHeartbeat)
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return &Server[T]{
+		broker:       config.Broker,
+		codecs:       config.Codecs,
+		filter:       config.Filter,
+		buffer:       config.DefaultBuffer,
+		heartbeat:    config.DefaultHeartbeat,
+		minHeartbeat: config.MinHeartbeat,
+		maxHeartbeat: config.MaxHeartbeat,
+		logger:       config.Logger.With("component", "psgrpc.Server"),
+	}
+}
+
+// Register the server with the gRPC service registrar, e.g. a [grpc.Server].
+func (s *Server[T]) Register(r grpc.ServiceRegistrar) {
+	pb.RegisterBrokerServer(r, s)
+}
+
+// Publish implements the Broker service.
+func (s *Server[T]) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
+	var v T
+	if err := s.codec(req.GetMediaType()).Decode(bytes.NewReader(req.GetValue()), &v); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "decode value: %v", err)
+	}
+
+	stats := s.broker.Publish(v)
+
+	return &pb.PublishResponse{Stats: statsToProto(stats)}, nil
+}
+
+// Subscribe implements the Broker service.
+func (s *Server[T]) Subscribe(req *pb.SubscribeRequest, stream grpc.ServerStreamingServer[pb.SubscribeResponse]) error {
+	var (
+		ctx       = stream.Context()
+		codec     = s.codec(req.GetMediaType())
+		buffer    = s.buffer
+		heartbeat = s.heartbeat
+		allow     = func(T) bool { return true }
+	)
+
+	if n := req.GetBuffer(); n < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid buffer %d", n)
+	} else if n > 0 {
+		buffer = int(n)
+	}
+
+	if req.GetHeartbeat() != nil {
+		heartbeat = req.GetHeartbeat().AsDuration()
+		if heartbeat < s.minHeartbeat || heartbeat > s.maxHeartbeat {
+			return status.Errorf(codes.InvalidArgument, "heartbeat must be between %v and %v", s.minHeartbeat, s.maxHeartbeat)
+		}
+	}
+
+	if f := req.GetFilter(); f != "" {
+		if s.filter == nil {
+			return status.Errorf(codes.InvalidArgument, "filters aren't supported")
+		}
+		a, err := s.filter(f)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+		}
+		allow = a
+	}
+
+	c := make(chan T, buffer)
+	if err := s.broker.Subscribe(c, allow); err != nil {
+		return status.Errorf(codes.Internal, "subscribe: %v", err)
+	}
+
+	var (
+		start  = time.Now()
+		logger = s.logger.With("buffer", buffer, "heartbeat", heartbeat, "codec", codec.MediaType)
+		reason error
+	)
+	logger.Info("subscribe", "filter", req.GetFilter())
+	defer func() {
+		stats, err := s.broker.Unsubscribe(c)
+		logger.Info("unsubscribe",
+			slog.Group("stats", "skips", stats.Skips, "sends", stats.Sends, "drops", stats.Drops),
+			"duration", time.Since(start),
+			"error", errors.Join(reason, err),
+		)
+	}()
+
+	// Send headers immediately, so the client sees it's subscribed.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		reason = err
+		return err
+	}
+
+	heartbeats := time.NewTicker(heartbeat)
+	defer heartbeats.Stop()
+
+	var buf bytes.Buffer
+	for {
+		select {
+		case v := <-c:
+			buf.Reset()
+			if err := codec.Encode(v, &buf); err != nil {
+				reason = err
+				return status.Errorf(codes.Internal, "encode value: %v", err)
+			}
+			if err := stream.Send(&pb.SubscribeResponse{
+				Event: &pb.SubscribeResponse_Value{Value: &pb.Value{
+					Data:      buf.Bytes(),
+					MediaType: codec.MediaType,
+				}},
+			}); err != nil {
+				reason = err
+				return err
+			}
+
+		case ts := <-heartbeats.C:
+			stats, _ := s.broker.Stats(c)
+			if err := stream.Send(&pb.SubscribeResponse{
+				Event: &pb.SubscribeResponse_Heartbeat{Heartbeat: &pb.Heartbeat{
+					Timestamp: timestamppb.New(ts),
+					Stats:     statsToProto(stats),
+				}},
+			}); err != nil {
+				reason = err
+				return err
+			}
+
+		case <-ctx.Done():
+			reason = ctx.Err()
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// codec returns the codec for the media type, or the default codec.
+func (s *Server[T]) codec(mediaType string) pshttp.Codec[T] {
+	if c, ok := s.codecs.Lookup(mediaType); ok {
+		return c
+	}
+	return s.codecs.Default()
+}
+
+func statsToProto(stats ps.Stats) *pb.Stats {
+	return &pb.Stats{
+		Skips: stats.Skips,
+		Sends: stats.Sends,
+		Drops: stats.Drops,
+	}
+}
+
+func statsFromProto(stats *pb.Stats) ps.Stats {
+	return ps.Stats{
+		Skips: stats.GetSkips(),
+		Sends: stats.GetSends(),
+		Drops: stats.GetDrops(),
+	}
+}
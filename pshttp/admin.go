@@ -0,0 +1,331 @@
+package pshttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// ErrUnknownSubscription indicates that a subscription doesn't exist.
+var ErrUnknownSubscription = errors.New("unknown subscription")
+
+var (
+	errSubscriberStopped           = errors.New("subscriber stopped")
+	errSubscriptionDisconnected    = errors.New("disconnected")
+	errTooManySubscriptions        = errors.New("too many subscriptions")
+	errTooManySubscriptionsPerAddr = errors.New("too many subscriptions from this address")
+)
+
+// SubscriptionInfo describes an active subscription served by a [Handler].
+type SubscriptionInfo struct {
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Principal   string    `json:"principal,omitempty"`
+	Filter      string    `json:"filter,omitempty"`
+	Codec       string    `json:"codec,omitempty"`
+	Buffer      int       `json:"buffer"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Stats       ps.Stats  `json:"stats"`
+}
+
+// AdminStats summarizes the state of every broker served by a [Handler].
+type AdminStats struct {
+	// Subscriptions is the number of active subscriptions served by the
+	// handler.
+	Subscriptions int `json:"subscriptions"`
+
+	// Subscribers is the number of active subscribers to every broker,
+	// including subscribers that aren't served by the handler.
+	Subscribers int `json:"subscribers"`
+
+	// Stats is the sum of the stats of every active subscriber.
+	Stats ps.Stats `json:"stats"`
+
+	// Topics breaks down subscribers and stats by broker. A handler serving a
+	// single broker reports a single topic with an empty name.
+	Topics []ps.TopicInfo `json:"topics"`
+}
+
+// Subscriptions returns information about every active subscription served by
+// the handler, ordered by connection time.
+func (h *Handler[T]) Subscriptions() []SubscriptionInfo {
+	h.subsMtx.Lock()
+	defer h.subsMtx.Unlock()
+
+	res := make([]SubscriptionInfo, 0, len(h.subs))
+	for _, s := range h.subs {
+		res = append(res, s.snapshot())
+	}
+
+	slices.SortFunc(res, func(a, b SubscriptionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	return res
+}
+
+// Disconnect forcibly terminates the subscription with the given ID. The
+// subscriber may reconnect.
+func (h *Handler[T]) Disconnect(id string) error {
+	h.subsMtx.Lock()
+	defer h.subsMtx.Unlock()
+
+	s, ok := h.subs[id]
+	if !ok {
+		return ErrUnknownSubscription
+	}
+
+	s.disconnect()
+	return nil
+}
+
+// AdminStats returns a summary of every broker served by the handler.
+func (h *Handler[T]) AdminStats() AdminStats {
+	var topics []ps.TopicInfo
+	if h.registry != nil {
+		topics = h.registry.Topics()
+	} else {
+		all := h.broker.ActiveSubscribers()
+		info := ps.TopicInfo{Subscribers: len(all)}
+		for _, stats := range all {
+			info.Stats = addStats(info.Stats, stats)
+		}
+		topics = []ps.TopicInfo{info}
+	}
+
+	res := AdminStats{
+		Topics: topics,
+	}
+	for _, t := range topics {
+		res.Subscribers += t.Subscribers
+		res.Stats = addStats(res.Stats, t.Stats)
+	}
+
+	h.subsMtx.Lock()
+	res.Subscriptions = len(h.subs)
+	h.subsMtx.Unlock()
+
+	return res
+}
+
+// AdminHandler returns an [http.Handler] with administrative endpoints for the
+// handler. It's separate from the handler itself so that it can be mounted on
+// a different path or listener, and it performs no authentication or
+// authorization of its own.
+//
+//	GET    /subscriptions       list active subscriptions
+//	GET    /subscriptions/{id}  describe a single subscription
+//	DELETE /subscriptions/{id}  forcibly disconnect a subscription
+//	GET    /stats               summarize every broker
+//
+// Responses are JSON, except GET /subscriptions renders a minimal HTML view
+// for requests that accept text/html.
+func (h *Handler[T]) AdminHandler() http.Handler {
+	return NewAdminHandler(func() []*Handler[T] { return []*Handler[T]{h} })
+}
+
+// NewAdminHandler returns an [http.Handler] with the same administrative
+// endpoints as [Handler.AdminHandler], covering every handler returned by the
+// handlers func, which is called for each request. It's useful when handlers
+// are replaced over time, for example on config reloads, and replaced handlers
+// still serve subscriptions until they drain.
+//
+// The handlers should serve the same brokers. Subscriptions are listed from
+// every handler, while broker stats are taken from the first handler.
+func NewAdminHandler[T any](handlers func() []*Handler[T]) http.Handler {
+	a := &adminHandler[T]{handlers: handlers}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /subscriptions", a.handleSubscriptions)
+	mux.HandleFunc("GET /subscriptions/{id}", a.handleSubscription)
+	mux.HandleFunc("DELETE /subscriptions/{id}", a.handleDisconnect)
+	mux.HandleFunc("GET /stats", a.handleStats)
+	return mux
+}
+
+type adminHandler[T any] struct {
+	handlers func() []*Handler[T]
+}
+
+func (a *adminHandler[T]) subscriptions(handlers []*Handler[T]) []SubscriptionInfo {
+	var res []SubscriptionInfo
+	for _, h := range handlers {
+		res = append(res, h.Subscriptions()...)
+	}
+
+	slices.SortStableFunc(res, func(a, b SubscriptionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	return res
+}
+
+func (a *adminHandler[T]) stats(handlers []*Handler[T]) AdminStats {
+	if len(handlers) == 0 {
+		return AdminStats{}
+	}
+
+	res := handlers[0].AdminStats()
+	for _, h := range handlers[1:] {
+		h.subsMtx.Lock()
+		res.Subscriptions += len(h.subs)
+		h.subsMtx.Unlock()
+	}
+
+	return res
+}
+
+func (a *adminHandler[T]) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	var (
+		handlers = a.handlers()
+		subs     = a.subscriptions(handlers)
+	)
+
+	if requestExplicitlyAccepts(r, "text/html") {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		if err := adminTemplate.Execute(w, struct {
+			Stats         AdminStats
+			Subscriptions []SubscriptionInfo
+		}{
+			Stats:         a.stats(handlers),
+			Subscriptions: subs,
+		}); err != nil && len(handlers) > 0 {
+			handlers[0].logger.Error("admin: render HTML", "error", err)
+		}
+		return
+	}
+
+	if subs == nil {
+		subs = []SubscriptionInfo{}
+	}
+	respondJSON(w, http.StatusOK, subs)
+}
+
+func (a *adminHandler[T]) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	for _, h := range a.handlers() {
+		h.subsMtx.Lock()
+		s, ok := h.subs[r.PathValue("id")]
+		h.subsMtx.Unlock()
+
+		if ok {
+			respondJSON(w, http.StatusOK, s.snapshot())
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusNotFound, ErrUnknownSubscription)
+}
+
+func (a *adminHandler[T]) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	for _, h := range a.handlers() {
+		if err := h.Disconnect(r.PathValue("id")); err == nil {
+			h.logger.Info("admin: disconnect", "remote_addr", r.RemoteAddr, "subscription_id", r.PathValue("id"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusNotFound, ErrUnknownSubscription)
+}
+
+func (a *adminHandler[T]) handleStats(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, a.stats(a.handlers()))
+}
+
+// subscription is an active subscription served by a handler.
+type subscription[T any] struct {
+	info   SubscriptionInfo
+	addr   string
+	broker *ps.Broker[T]
+	c      chan T
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (s *subscription[T]) snapshot() SubscriptionInfo {
+	info := s.info
+	if stats, err := s.broker.Stats(s.c); err == nil {
+		info.Stats = stats
+	}
+	return info
+}
+
+func (s *subscription[T]) disconnect() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// addSubscription registers a new subscription with the handler, and returns
+// a func to deregister it. It fails if the subscription would exceed the
+// configured limits.
+func (h *Handler[T]) addSubscription(s *subscription[T]) (func(), error) {
+	h.subsMtx.Lock()
+	defer h.subsMtx.Unlock()
+
+	if h.subs == nil {
+		h.subs = map[string]*subscription[T]{}
+	}
+
+	select {
+	case <-h.shutdown:
+		return nil, errShuttingDown
+	default:
+	}
+
+	if err := h.usage.add(s.addr, h.limits); err != nil {
+		return nil, err
+	}
+
+	for {
+		s.info.ID = newSubscriptionID()
+		if _, ok := h.subs[s.info.ID]; !ok {
+			break
+		}
+	}
+	h.subs[s.info.ID] = s
+	h.subsWG.Add(1)
+
+	return func() {
+		h.subsMtx.Lock()
+		defer h.subsMtx.Unlock()
+		delete(h.subs, s.info.ID)
+		h.usage.remove(s.addr)
+		h.subsWG.Done()
+	}, nil
+}
+
+func newSubscriptionID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Errorf("generate subscription ID: %w", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+var adminTemplate = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pshttp subscriptions</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<p>{{ .Stats.Subscriptions }} subscription(s), {{ .Stats.Subscribers }} subscriber(s), {{ .Stats.Stats }}</p>
+<table>
+<tr><th>ID</th><th>Topic</th><th>Remote addr</th><th>Principal</th><th>Filter</th><th>Buffer</th><th>Connected since</th><th>Stats</th></tr>
+{{ range .Subscriptions }}<tr><td>{{ .ID }}</td><td>{{ .Topic }}</td><td>{{ .RemoteAddr }}</td><td>{{ .Principal }}</td><td>{{ .Filter }}</td><td>{{ .Buffer }}</td><td>{{ .ConnectedAt.Format "2006-01-02T15:04:05Z07:00" }}</td><td>{{ .Stats }}</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,172 @@
+package pshttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnauthenticated signals that a request couldn't be authenticated. The
+	// handler responds with 401 Unauthorized.
+	ErrUnauthenticated = errors.New("unauthenticated")
+
+	// ErrForbidden signals that an authenticated principal isn't authorized to
+	// perform the requested operation. The handler responds with 403
+	// Forbidden.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Principal is the authenticated identity behind a request.
+type Principal struct {
+	// Name identifies the principal, e.g. a username, or the subject of a
+	// client certificate. The zero value represents an anonymous principal.
+	Name string `json:"name"`
+
+	// Method describes how the principal was authenticated, e.g. "bearer".
+	Method string `json:"method,omitempty"`
+}
+
+// String implements fmt.Stringer.
+func (p Principal) String() string {
+	if p.Name == "" {
+		return "anonymous"
+	}
+	return p.Name
+}
+
+type principalContextKey struct{}
+
+// PrincipalFromContext returns the principal authenticated by the handler for
+// the request with the given context, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(Principal)
+	return p, ok
+}
+
+// Authenticator extracts a principal from a request. Any error is treated as
+// an authentication failure.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to an [Authenticator].
+type AuthenticatorFunc func(r *http.Request) (Principal, error)
+
+// Authenticate implements [Authenticator].
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Principal, error) {
+	return f(r)
+}
+
+// BearerTokens returns an [Authenticator] which expects an Authorization
+// header with a bearer token. The tokens map valid tokens to principal names.
+func BearerTokens(tokens map[string]string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		scheme, token, ok := strings.Cut(r.Header.Get("authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+			return Principal{}, fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+		}
+		for valid, name := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+				return Principal{Name: name, Method: "bearer"}, nil
+			}
+		}
+		return Principal{}, fmt.Errorf("%w: invalid bearer token", ErrUnauthenticated)
+	})
+}
+
+// BasicAuth returns an [Authenticator] which expects HTTP basic auth
+// credentials, and validates them with the verify func. The principal name is
+// the username.
+func BasicAuth(verify func(username, password string) bool) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return Principal{}, fmt.Errorf("%w: missing basic auth credentials", ErrUnauthenticated)
+		}
+		if !verify(username, password) {
+			return Principal{}, fmt.Errorf("%w: invalid basic auth credentials", ErrUnauthenticated)
+		}
+		return Principal{Name: username, Method: "basic"}, nil
+	})
+}
+
+// ClientCertificate returns an [Authenticator] which expects a verified TLS
+// client certificate, i.e. mTLS. The principal name is the certificate
+// subject. The server's TLS config must verify client certificates.
+func ClientCertificate() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return Principal{}, fmt.Errorf("%w: missing verified client certificate", ErrUnauthenticated)
+		}
+		return Principal{Name: r.TLS.VerifiedChains[0][0].Subject.String(), Method: "mtls"}, nil
+	})
+}
+
+// FirstOf returns an [Authenticator] which tries each of the provided
+// authenticators in order, and returns the first successfully authenticated
+// principal.
+func FirstOf(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		errs := make([]error, 0, len(authenticators))
+		for _, a := range authenticators {
+			p, err := a.Authenticate(r)
+			if err == nil {
+				return p, nil
+			}
+			errs = append(errs, err)
+		}
+		return Principal{}, errors.Join(errs...)
+	})
+}
+
+// Authorizer decides what an authenticated principal is allowed to do.
+// Methods that return an error should generally return an error wrapping
+// [ErrForbidden].
+type Authorizer[T any] interface {
+	// AuthorizePublish is called before any value is published.
+	AuthorizePublish(p Principal, r *http.Request) error
+
+	// AuthorizeSubscribe is called before a subscription is established.
+	AuthorizeSubscribe(p Principal, r *http.Request) error
+
+	// AllowValue is called for every value published to an established
+	// subscription. Values for which it returns false aren't sent to the
+	// subscriber, and are counted as skips.
+	AllowValue(p Principal, v T) bool
+}
+
+// AuthorizerFuncs implements [Authorizer] with optional funcs. Nil funcs allow
+// everything.
+type AuthorizerFuncs[T any] struct {
+	Publish   func(p Principal, r *http.Request) error
+	Subscribe func(p Principal, r *http.Request) error
+	Value     func(p Principal, v T) bool
+}
+
+// AuthorizePublish implements [Authorizer].
+func (a AuthorizerFuncs[T]) AuthorizePublish(p Principal, r *http.Request) error {
+	if a.Publish == nil {
+		return nil
+	}
+	return a.Publish(p, r)
+}
+
+// AuthorizeSubscribe implements [Authorizer].
+func (a AuthorizerFuncs[T]) AuthorizeSubscribe(p Principal, r *http.Request) error {
+	if a.Subscribe == nil {
+		return nil
+	}
+	return a.Subscribe(p, r)
+}
+
+// AllowValue implements [Authorizer].
+func (a AuthorizerFuncs[T]) AllowValue(p Principal, v T) bool {
+	if a.Value == nil {
+		return true
+	}
+	return a.Value(p, v)
+}
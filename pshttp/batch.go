@@ -0,0 +1,221 @@
+package pshttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/peterbourgon/ps"
+)
+
+// BatchResult is the outcome of a batch publish.
+type BatchResult struct {
+	// Stats is the sum of the stats of every published value.
+	Stats ps.Stats `json:"stats"`
+
+	// Items contains the outcome of each value in the batch, in order.
+	Items []BatchItem `json:"items"`
+}
+
+// BatchItem is the outcome of a single value in a batch publish. If the value
+// couldn't be decoded, it isn't published, and Error is set.
+type BatchItem struct {
+	Stats ps.Stats `json:"stats"`
+	Error string   `json:"error,omitempty"`
+}
+
+func (h *Handler[T]) handlePublishBatch(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizePublish(w, r) {
+		return
+	}
+
+	codec, err := h.codecs.forLines(r)
+	if err != nil {
+		h.respondError(w, r, http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	items, err := readBatch(h.limitPublishBody(w, r), r.Header.Get("content-type"), codec.MediaType)
+	if err != nil {
+		h.respondReadError(w, r, err)
+		return
+	}
+
+	if !h.limitPublishRate(w, r, len(items)) {
+		return
+	}
+
+	broker, release, ok := h.acquireBroker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	result := BatchResult{Items: make([]BatchItem, len(items))}
+
+	for i, item := range items {
+		var v T
+		if err := codec.Decode(bytes.NewReader(item), &v); err != nil {
+			result.Items[i].Error = err.Error()
+			continue
+		}
+		stats := broker.Publish(v)
+		result.Items[i].Stats = stats
+		result.Stats = addStats(result.Stats, stats)
+	}
+
+	h.requestLogger(r).Debug("publish batch", "values", len(items), statsAttr(result.Stats))
+	respondJSON(w, http.StatusOK, result)
+}
+
+// readBatch splits the request body into individually encoded values. The body
+// can be either a JSON array, or newline-delimited values, e.g. NDJSON, or
+// values of the text codec with the given media type.
+func readBatch(body io.Reader, contentType, codecMediaType string) ([][]byte, error) {
+	br := bufio.NewReader(body)
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-ndjson", mediaType == "application/jsonl":
+		return readBatchLines(br)
+	case mediaType == "application/json":
+		return readBatchArray(br)
+	case mediaType != "" && strings.EqualFold(mediaType, codecMediaType):
+		return readBatchLines(br)
+	}
+
+	// No explicit content type: sniff for a JSON array.
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, nil // empty body
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '[':
+			return readBatchArray(br)
+		default:
+			return readBatchLines(br)
+		}
+	}
+}
+
+func readBatchArray(r io.Reader) ([][]byte, error) {
+	dec := json.NewDecoder(r)
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("body must be a JSON array")
+	}
+
+	var items [][]byte
+	for dec.More() {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return nil, fmt.Errorf("item %d: %w", len(items), err)
+		}
+		items = append(items, item)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("body must be a JSON array: %w", err)
+	}
+
+	return items, nil
+}
+
+func readBatchLines(r io.Reader) ([][]byte, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16*1024*1024)
+
+	var items [][]byte
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, bytes.Clone(line))
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+
+	return items, nil
+}
+
+// PublishBatch publishes every value in vs to the remote pub/sub broker with a
+// single request. Every value must encode to a single line. The returned
+// result contains the outcome of each individual value.
+func (c *Client[T]) PublishBatch(ctx context.Context, vs []T) (BatchResult, error) {
+	var buf bytes.Buffer
+	for i, v := range vs {
+		if err := c.encodeLine(v, &buf); err != nil {
+			return BatchResult{}, fmt.Errorf("value %d: %w", i, err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint("batch"), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return BatchResult{}, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("content-type", c.lineContentType())
+
+	resp, err := c.do(req)
+	if err != nil {
+		return BatchResult{}, fmt.Errorf("execute request: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return BatchResult{}, newStatusError(resp)
+	}
+
+	var result BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return BatchResult{}, fmt.Errorf("decode response: %w", err)
+	}
+
+	return result, nil
+}
+
+// encodeLine encodes v to buf, followed by a single newline. Binary codecs
+// aren't supported.
+func (c *Client[T]) encodeLine(v T, buf *bytes.Buffer) error {
+	if c.codec.Binary {
+		return fmt.Errorf("binary codec %s can't encode lines", c.codec.MediaType)
+	}
+	n := buf.Len()
+	if err := c.codec.Encode(v, buf); err != nil {
+		buf.Truncate(n)
+		return fmt.Errorf("encode value: %w", err)
+	}
+	line := bytes.TrimRight(buf.Bytes()[n:], "\r\n")
+	if bytes.IndexByte(line, '\n') >= 0 {
+		buf.Truncate(n)
+		return fmt.Errorf("encoded value contains a newline")
+	}
+	buf.Truncate(n + len(line))
+	buf.WriteByte('\n')
+	return nil
+}
+
+// lineContentType returns the content type of newline-delimited values encoded
+// by the client codec.
+func (c *Client[T]) lineContentType() string {
+	switch c.codec.MediaType {
+	case "", "application/json":
+		return "application/x-ndjson"
+	default:
+		return c.codec.MediaType
+	}
+}
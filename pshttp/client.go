@@ -3,11 +3,15 @@ package pshttp
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/peterbourgon/eventsource"
@@ -18,99 +22,505 @@ import (
 // [Handler]. It provides publish and subscribe functionality similar to a
 // normal [ps.Broker].
 type Client[T any] struct {
-	client *http.Client
-	uri    string
-	encode EncodeFunc[T]
-	decode DecodeFunc[T]
+	client    *http.Client
+	uri       string
+	codec     Codec[T]
+	header    http.Header
+	reconnect ReconnectPolicy
+	retry     ReconnectPolicy
+	buffer    int
+	heartbeat time.Duration
 }
 
-// NewDefaultClient calls [NewClient] with [http.DefaultClient] and the default
-// [EncodeJSON] and [DecodeJSON] functions.
+// NewDefaultClient calls [NewClientWithOptions] with no options, i.e. with
+// [http.DefaultClient] and the default [JSONCodec].
 func NewDefaultClient[T any](uri string) (*Client[T], error) {
-	return NewClient(http.DefaultClient, uri, EncodeJSON[T], DecodeJSON[T])
+	return NewClientWithOptions[T](uri)
 }
 
-// NewClient constructs a new client targeting the given URI.
+// NewClient calls [NewCodecClient] with a codec constructed from the encode
+// and decode functions. The codec has no media type, so the client doesn't
+// advertise it to the server.
 func NewClient[T any](client *http.Client, uri string, encode EncodeFunc[T], decode DecodeFunc[T]) (*Client[T], error) {
-	u, err := url.Parse(uri)
+	return NewCodecClient(client, uri, Codec[T]{Encode: encode, Decode: decode})
+}
+
+// NewCodecClient calls [NewClientWithOptions] with the given HTTP client and
+// codec. The media type of the codec is advertised to the server: published
+// values are sent with it as the Content-Type, and subscriptions include it in
+// the Accept header.
+func NewCodecClient[T any](client *http.Client, uri string, codec Codec[T]) (*Client[T], error) {
+	return NewClientWithOptions[T](uri, WithHTTPClient[T](client), WithClientCodec(codec))
+}
+
+// Topic returns a copy of the client which targets the named topic on a remote
+// registry of pub/sub brokers, served by a handler constructed with a
+// [ps.Registry]. The client's URI should be the root of that handler.
+func (c *Client[T]) Topic(name string) *Client[T] {
+	cp := *c
+	cp.uri = c.endpoint("topics", url.PathEscape(name))
+	return &cp
+}
+
+// Topics lists every topic on a remote registry of pub/sub brokers, served by
+// a handler constructed with a [ps.Registry]. The client's URI should be the
+// root of that handler.
+func (c *Client[T]) Topics(ctx context.Context) ([]ps.TopicInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.endpoint("topics"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("accept", "application/json")
+
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("invalid URI: %w", err)
+		return nil, fmt.Errorf("execute request: %w", err)
 	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
 
-	uri = u.String()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
 
-	return &Client[T]{
-		client: client,
-		uri:    uri,
-		encode: encode,
-		decode: decode,
-	}, nil
+	var topics []ps.TopicInfo
+	if err := json.NewDecoder(resp.Body).Decode(&topics); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	return topics, nil
 }
 
-// Publish the value v to the remote pub/sub broker.
+// Publish the value v to the remote pub/sub broker. If the client has a
+// publish retry policy, see [WithPublishRetry], the value is published with a
+// random idempotency key, so it's safe to retry.
 func (c *Client[T]) Publish(ctx context.Context, v T) (ps.Stats, error) {
+	var key string
+	if c.retry != nil {
+		key = newDeliveryID()
+	}
+	return c.PublishKey(ctx, key, v)
+}
+
+// PublishKey publishes the value v to the remote pub/sub broker with the given
+// idempotency key, see [IdempotencyKeyHeader]. If a value was already
+// published with the same key, the value isn't published again, and the stats
+// of the original publish are returned.
+//
+// If the client has a publish retry policy, see [WithPublishRetry], and the
+// key is non-empty, requests which fail with transport errors, or with status
+// 429, 502, 503, or 504, are retried according to the policy.
+func (c *Client[T]) PublishKey(ctx context.Context, key string, v T) (ps.Stats, error) {
 	var buf bytes.Buffer
-	if err := c.encode(v, &buf); err != nil {
+	if err := c.codec.Encode(v, &buf); err != nil {
 		return ps.Stats{}, fmt.Errorf("encode value: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.uri, bytes.NewReader(buf.Bytes()))
+	var (
+		attempt int
+		first   = time.Now()
+	)
+	for {
+		stats, retryable, err := c.publishOnce(ctx, key, buf.Bytes())
+		if err == nil || !retryable || c.retry == nil || key == "" || ctx.Err() != nil {
+			return stats, err
+		}
+
+		attempt++
+		delay, ok := c.retry.Next(attempt, time.Since(first), err)
+		if !ok {
+			return ps.Stats{}, fmt.Errorf("gave up after %d retry attempt(s): %w", attempt-1, err)
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			delay = max(delay, statusErr.RetryAfter)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ps.Stats{}, err
+		}
+	}
+}
+
+// publishOnce makes a single publish request, and reports whether a failed
+// request may be retried.
+func (c *Client[T]) publishOnce(ctx context.Context, key string, body []byte) (ps.Stats, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.uri, bytes.NewReader(body))
 	if err != nil {
-		return ps.Stats{}, fmt.Errorf("create request: %w", err)
+		return ps.Stats{}, false, fmt.Errorf("create request: %w", err)
+	}
+	if c.codec.MediaType != "" {
+		req.Header.Set("content-type", c.codec.MediaType)
+	}
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return ps.Stats{}, fmt.Errorf("execute request: %w", err)
+		return ps.Stats{}, true, fmt.Errorf("execute request: %w", err)
 	}
 	defer func() {
 		io.Copy(io.Discard, resp.Body)
 		resp.Body.Close()
 	}()
 
-	if resp.StatusCode != http.StatusOK {
-		return ps.Stats{}, fmt.Errorf("invalid response (%s)", resp.Status)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ps.Stats{}, true, newStatusError(resp)
+	default:
+		return ps.Stats{}, false, newStatusError(resp)
 	}
 
 	var stats ps.Stats
 	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
-		return ps.Stats{}, fmt.Errorf("decode response stats: %w", err)
+		return ps.Stats{}, true, fmt.Errorf("decode response stats: %w", err)
 	}
 
-	return stats, nil
+	return stats, false, nil
 }
 
-// Subscribe to published events on the remote pub/sub broker. Subscribe blocks
-// until the context is canceled, or a fatal error occurs, whichever comes
-// first.
+// Subscribe calls [Client.SubscribeConfig] with a [ConstantBackoff] reconnect
+// policy of the given retry duration.
 func (c *Client[T]) Subscribe(ctx context.Context, ch chan<- T, retry time.Duration) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", c.uri, nil)
+	return c.SubscribeConfig(ctx, ch, SubscribeConfig{
+		Reconnect: ConstantBackoff(retry),
+	})
+}
+
+// SubscribeConfig enumerates the optional parameters for a subscription.
+type SubscribeConfig struct {
+	// Reconnect decides if and when to reconnect after a connection attempt
+	// fails or an established connection is interrupted. If the server
+	// responds with a Retry-After header, or shuts down with a suggested
+	// reconnect delay, the reconnect is delayed for at least that long. If
+	// nil, the client default is used, see [WithReconnect], and then an
+	// [ExponentialBackoff] with default parameters.
+	Reconnect ReconnectPolicy
+
+	// OnStateChange, if non-nil, is called synchronously whenever the state of
+	// the connection changes. The error is non-nil for [StateDisconnected] and
+	// [StateGaveUp] if the state change was caused by an error.
+	OnStateChange func(state ConnState, err error)
+
+	// OnHeartbeat, if non-nil, is called synchronously with every heartbeat
+	// event received from the handler.
+	OnHeartbeat func(ev HeartbeatEvent)
+
+	// Filter, if non-empty, is sent to the handler, which parses it into an
+	// allow func for the subscription. See [HandlerConfig.Filter].
+	Filter string
+
+	// BinaryFraming negotiates binary framing for the subscription, see
+	// [FramingBase64]. It's always negotiated for binary codecs.
+	BinaryFraming bool
+
+	// CloudEventsBinary subscribes to CloudEvents in the binary content mode,
+	// see [CloudEventsBinary]. Events are decoded from their attributes and
+	// data, rather than with the client codec. The value type of the client
+	// must be a [CloudEvent].
+	CloudEventsBinary bool
+
+	// Buffer, if non-zero, is the buffer requested for the subscription on
+	// the handler. If zero, the client default is used, see
+	// [WithSubscribeBuffer], and then the handler default.
+	Buffer int
+
+	// Heartbeat, if non-zero, is the heartbeat interval requested for the
+	// subscription. If zero, the client default is used, see
+	// [WithSubscribeHeartbeat], and then the handler default.
+	Heartbeat time.Duration
+}
+
+// SubscribeConfig subscribes to published events on the remote pub/sub broker,
+// and forwards them to ch. Interrupted connections are automatically
+// re-established according to the reconnect policy, and resume after the last
+// value received, if the broker still retains it, see [ps.BrokerConfig.Replay].
+// SubscribeConfig blocks until the context is canceled, the reconnect policy
+// gives up, or a fatal error occurs, whichever comes first.
+func (c *Client[T]) SubscribeConfig(ctx context.Context, ch chan<- T, config SubscribeConfig) error {
+	if config.Reconnect == nil {
+		config.Reconnect = c.reconnect
+	}
+	if config.Reconnect == nil {
+		config.Reconnect = &ExponentialBackoff{}
+	}
+	if config.Buffer == 0 {
+		config.Buffer = c.buffer
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = c.heartbeat
+	}
+
+	notify := func(state ConnState, err error) {
+		if config.OnStateChange != nil {
+			config.OnStateChange(state, err)
+		}
+	}
+
+	var (
+		attempt int
+		first   time.Time
+		lastID  string // resumed on reconnect
+	)
+	for {
+		notify(StateConnecting, nil)
+
+		err := c.subscribeOnce(ctx, ch, config, &lastID, func() {
+			attempt = 0
+			notify(StateConnected, nil)
+		})
+
+		if ctx.Err() != nil {
+			notify(StateDisconnected, ctx.Err())
+			return ctx.Err()
+		}
+
+		notify(StateDisconnected, err)
+
+		var fatal *fatalError
+		if errors.As(err, &fatal) {
+			notify(StateGaveUp, fatal.err)
+			return fatal.err
+		}
+
+		if attempt == 0 {
+			first = time.Now()
+		}
+		attempt++
+
+		delay, ok := config.Reconnect.Next(attempt, time.Since(first), err)
+		if !ok {
+			err = fmt.Errorf("gave up after %d reconnect attempt(s): %w", attempt-1, err)
+			notify(StateGaveUp, err)
+			return err
+		}
+
+		var (
+			statusErr   *StatusError
+			shutdownErr *ShutdownError
+		)
+		switch {
+		case errors.As(err, &statusErr):
+			delay = max(delay, statusErr.RetryAfter)
+		case errors.As(err, &shutdownErr):
+			delay = max(delay, shutdownErr.RetryAfter)
+		}
+
+		select {
+		case <-time.After(delay):
+			// reconnect
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// subscribeOnce makes a single subscription connection, and forwards events to
+// ch until the connection is interrupted. If *lastID is non-empty, the
+// subscription resumes after that event, and *lastID is updated with the ID of
+// every event forwarded to ch. Errors that shouldn't be retried are returned as
+// a fatalError.
+func (c *Client[T]) subscribeOnce(ctx context.Context, ch chan<- T, config SubscribeConfig, lastID *string, connected func()) error {
+	u, err := url.Parse(c.uri)
 	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+		return &fatalError{fmt.Errorf("parse URI: %w", err)}
+	}
+	q := u.Query()
+	if config.Filter != "" {
+		q.Set("filter", config.Filter)
+	}
+	if config.BinaryFraming || c.codec.Binary {
+		q.Set("framing", FramingBase64)
+	}
+	if config.CloudEventsBinary {
+		q.Set("cloudevents", CloudEventsBinary)
+	}
+	if config.Buffer > 0 {
+		q.Set("buffer", strconv.Itoa(config.Buffer))
+	}
+	if config.Heartbeat > 0 {
+		q.Set("heartbeat", config.Heartbeat.String())
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return &fatalError{fmt.Errorf("create request: %w", err)}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.codec.MediaType != "" {
+		req.Header.Set("Accept", "text/event-stream, "+c.codec.MediaType)
+	}
+	req.Header.Set("Cache-Control", "no-cache")
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("content-type")); mediaType != "text/event-stream" {
+			return &fatalError{fmt.Errorf("invalid response content-type (%s)", resp.Header.Get("content-type"))}
+		}
+
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return newStatusError(resp)
+
+	default:
+		return &fatalError{newStatusError(resp)}
 	}
 
-	es := eventsource.New(req, retry)
-	defer es.Close()
+	connected()
 
+	var (
+		dec   = eventsource.NewDecoder(resp.Body)
+		attrs map[string]string // of the next CloudEvent, if any
+	)
 	for {
-		ev, err := es.Read()
+		var ev eventsource.Event
+		err := dec.Decode(&ev)
+		if errors.Is(err, eventsource.ErrInvalidEncoding) {
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("read event: %w", err)
 		}
-		if ev.Type != EventTypeData {
+		switch {
+		case len(ev.Data) == 0:
+			continue
+		case ev.Type == EventTypeData:
+			// use data directly
+		case ev.Type == EventTypeBinaryData:
+			data, err := base64.StdEncoding.DecodeString(string(ev.Data))
+			if err != nil {
+				return &fatalError{fmt.Errorf("decode binary event: %w", err)}
+			}
+			ev.Data = data
+		case ev.Type == EventTypeCloudEventAttributes:
+			if err := json.Unmarshal(ev.Data, &attrs); err != nil {
+				return &fatalError{fmt.Errorf("decode CloudEvent attributes: %w", err)}
+			}
+			continue
+		case ev.Type == EventTypeHeartbeat:
+			if config.OnHeartbeat != nil {
+				var heartbeat HeartbeatEvent
+				if err := json.Unmarshal(ev.Data, &heartbeat); err != nil {
+					return &fatalError{fmt.Errorf("decode heartbeat event: %w", err)}
+				}
+				config.OnHeartbeat(heartbeat)
+			}
+			continue
+		case ev.Type == EventTypeShutdown:
+			var shutdown ShutdownEvent
+			if err := json.Unmarshal(ev.Data, &shutdown); err != nil {
+				return &fatalError{fmt.Errorf("decode shutdown event: %w", err)}
+			}
+			return &ShutdownError{
+				RetryAfter: time.Duration(shutdown.RetryAfterMs) * time.Millisecond,
+				Stats:      shutdown.Stats,
+			}
+		default:
 			continue // TODO
 		}
 
 		var v T
-		if err := c.decode(bytes.NewReader(ev.Data), &v); err != nil {
-			return fmt.Errorf("decode event: %w", err)
+		if ce, ok := any(&v).(cloudEventBinary); ok && attrs != nil {
+			err = ce.decodeAttributes(attrs, ev.Data)
+			attrs = nil
+		} else {
+			err = c.codec.Decode(bytes.NewReader(ev.Data), &v)
+		}
+		if err != nil {
+			return &fatalError{fmt.Errorf("decode event: %w", err)}
 		}
 
 		select {
 		case ch <- v:
-			// good
+			if ev.ID != "" || ev.ResetID {
+				*lastID = ev.ID
+			}
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
+
+// do executes the request with the client's HTTP client, after adding the
+// client's headers.
+func (c *Client[T]) do(req *http.Request) (*http.Response, error) {
+	for key, values := range c.header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	return c.client.Do(req)
+}
+
+// endpoint returns the client URI joined with the given, already escaped, path
+// elements.
+func (c *Client[T]) endpoint(elem ...string) string {
+	u, err := url.Parse(c.uri)
+	if err != nil {
+		return c.uri // validated by NewClient
+	}
+	return u.JoinPath(elem...).String()
+}
+
+// ShutdownError is returned when the server shuts down gracefully, see
+// [Handler.Shutdown]. Subscriptions reconnect after at least RetryAfter.
+type ShutdownError struct {
+	// RetryAfter is the reconnect delay suggested by the server.
+	RetryAfter time.Duration
+
+	// Stats are the final stats of the subscription.
+	Stats ps.Stats
+}
+
+// Error implements the error interface.
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("server shutting down (retry after %v)", e.RetryAfter)
+}
+
+// StatusError is returned when the server responds with an unexpected status
+// code.
+type StatusError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Status is the HTTP status of the response, e.g. "503 Service
+	// Unavailable".
+	Status string
+
+	// RetryAfter is the delay requested by the server via the Retry-After
+	// header, if any.
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("retry-after")),
+	}
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid response (%s)", e.Status)
+}
+
+type fatalError struct{ err error }
+
+func (e *fatalError) Error() string { return e.err.Error() }
+func (e *fatalError) Unwrap() error { return e.err }
@@ -0,0 +1,412 @@
+package pshttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CloudEventsMediaType is the media type of CloudEvents in the structured
+// content mode, using the JSON event format.
+const CloudEventsMediaType = "application/cloudevents+json"
+
+// CloudEventsSpecVersion is the supported version of the CloudEvents
+// specification.
+const CloudEventsSpecVersion = "1.0"
+
+// CloudEventsBinary is the value of the cloudevents query parameter of
+// subscribe requests which receive CloudEvents in the binary content mode, see
+// [SubscribeConfig.CloudEventsBinary]. The data of each SSE data event is the
+// encoded data of the CloudEvent, and each data event is preceded by an
+// [EventTypeCloudEventAttributes] event with the context attributes of the
+// CloudEvent, including its ID. Data which isn't UTF-8, or contains carriage
+// returns, is sent base64 encoded under the [EventTypeBinaryData] type, as with
+// binary framing.
+const CloudEventsBinary = "binary"
+
+// CloudEvent is an event in the CloudEvents 1.0 format, with data of type D.
+// Handlers and brokers of CloudEvents support the structured content mode via
+// [CloudEventCodec], and the binary content mode, where attributes are carried
+// in ce-* headers for publish requests, and in separate events for
+// subscriptions, see [CloudEventsBinary].
+//
+// Events are marshaled to and from JSON in the CloudEvents JSON format, with
+// extension attributes inline. Data is a JSON value, unless D is []byte and
+// the data content type isn't JSON, in which case it's data_base64.
+type CloudEvent[D any] struct {
+	// SpecVersion must be [CloudEventsSpecVersion].
+	SpecVersion string
+
+	// ID identifies the event, together with Source.
+	ID string
+
+	// Source identifies the context in which the event happened, as a URI
+	// reference.
+	Source string
+
+	// Type of the event, e.g. com.example.order.created.
+	Type string
+
+	// Subject of the event in the context of the source, optional.
+	Subject string
+
+	// Time when the event happened, optional.
+	Time time.Time
+
+	// DataContentType is the media type of the data, optional. If empty,
+	// the data is JSON.
+	DataContentType string
+
+	// DataSchema is a URI of the schema of the data, optional.
+	DataSchema string
+
+	// Extensions are additional attributes, keyed by name. Names must consist
+	// of lowercase letters and digits.
+	Extensions map[string]string
+
+	// Data of the event.
+	Data D
+}
+
+// Attribute returns the value of the named context attribute of the event,
+// including extension attributes, as a string. Time is formatted as RFC 3339.
+// It returns false if the attribute isn't set.
+func (e CloudEvent[D]) Attribute(name string) (string, bool) {
+	var value string
+	switch name {
+	case "specversion":
+		value = e.SpecVersion
+	case "id":
+		value = e.ID
+	case "source":
+		value = e.Source
+	case "type":
+		value = e.Type
+	case "subject":
+		value = e.Subject
+	case "time":
+		if !e.Time.IsZero() {
+			value = e.Time.Format(time.RFC3339Nano)
+		}
+	case "datacontenttype":
+		value = e.DataContentType
+	case "dataschema":
+		value = e.DataSchema
+	default:
+		value = e.Extensions[name]
+	}
+	return value, value != ""
+}
+
+// MarshalJSON implements json.Marshaler, using the CloudEvents JSON format.
+func (e CloudEvent[D]) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(e.Extensions)+9)
+	for k, v := range e.Extensions {
+		m[k] = v
+	}
+	for _, name := range []string{"specversion", "id", "source", "type", "subject", "time", "datacontenttype", "dataschema"} {
+		if v, ok := e.Attribute(name); ok {
+			m[name] = v
+		}
+	}
+
+	if b, ok := any(e.Data).([]byte); ok && !isJSONMediaType(e.DataContentType) {
+		m["data_base64"] = b // encoded as base64 by encoding/json
+	} else {
+		m["data"] = e.Data
+	}
+
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, using the CloudEvents JSON
+// format. It doesn't validate the event.
+func (e *CloudEvent[D]) UnmarshalJSON(data []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	var (
+		res  CloudEvent[D]
+		errs []error
+	)
+	str := func(name string, raw json.RawMessage, dst *string) {
+		if err := json.Unmarshal(raw, dst); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	for name, raw := range m {
+		switch name {
+		case "specversion":
+			str(name, raw, &res.SpecVersion)
+		case "id":
+			str(name, raw, &res.ID)
+		case "source":
+			str(name, raw, &res.Source)
+		case "type":
+			str(name, raw, &res.Type)
+		case "subject":
+			str(name, raw, &res.Subject)
+		case "datacontenttype":
+			str(name, raw, &res.DataContentType)
+		case "dataschema":
+			str(name, raw, &res.DataSchema)
+		case "time":
+			if err := json.Unmarshal(raw, &res.Time); err != nil {
+				errs = append(errs, fmt.Errorf("time: %w", err))
+			}
+		case "data", "data_base64":
+			// decoded below, once the data content type is known
+		default:
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				s = string(raw) // booleans, numbers, etc.
+			}
+			if res.Extensions == nil {
+				res.Extensions = map[string]string{}
+			}
+			res.Extensions[name] = s
+		}
+	}
+
+	if raw, ok := m["data_base64"]; ok {
+		var b []byte
+		if err := json.Unmarshal(raw, &b); err != nil {
+			errs = append(errs, fmt.Errorf("data_base64: %w", err))
+		} else if err := decodeCloudEventData("application/octet-stream", b, &res.Data); err != nil {
+			errs = append(errs, fmt.Errorf("data_base64: %w", err))
+		}
+	} else if raw, ok := m["data"]; ok {
+		if err := json.Unmarshal(raw, &res.Data); err != nil {
+			errs = append(errs, fmt.Errorf("data: %w", err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	*e = res
+	return nil
+}
+
+// normalize validates the required attributes of a published event, and sets
+// the ID and time if they're missing.
+func (e *CloudEvent[D]) normalize() error {
+	switch {
+	case e.SpecVersion != CloudEventsSpecVersion:
+		return fmt.Errorf("unsupported CloudEvents specversion %q", e.SpecVersion)
+	case e.Source == "":
+		return fmt.Errorf("CloudEvents source is required")
+	case e.Type == "":
+		return fmt.Errorf("CloudEvents type is required")
+	}
+	if e.ID == "" {
+		e.ID = newDeliveryID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	return nil
+}
+
+// CloudEventCodec returns a codec for CloudEvents in the structured content
+// mode, with media type [CloudEventsMediaType]. Decoded events are validated,
+// and assigned an ID and time if they don't have them.
+func CloudEventCodec[D any]() Codec[CloudEvent[D]] {
+	return Codec[CloudEvent[D]]{
+		MediaType: CloudEventsMediaType,
+		Encode:    EncodeJSON[CloudEvent[D]],
+		Decode: func(r io.Reader, e *CloudEvent[D]) error {
+			if err := json.NewDecoder(r).Decode(e); err != nil {
+				return err
+			}
+			return e.normalize()
+		},
+	}
+}
+
+// ParseCloudEventFilter parses a filter of comma-separated name=value pairs
+// into an allow func, which allows CloudEvents whose attributes match every
+// pair. Values ending in * match attributes by prefix. For example,
+// "type=com.example.order.*,source=/shop" allows events of any order type from
+// the /shop source. It can be used as [HandlerConfig.Filter].
+func ParseCloudEventFilter[D any](filter string) (func(CloudEvent[D]) bool, error) {
+	type match struct {
+		name   string
+		value  string
+		prefix bool
+	}
+
+	var matches []match
+	for _, pair := range strings.Split(filter, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid attribute filter %q", pair)
+		}
+		m := match{name: strings.ToLower(name), value: value}
+		if v, ok := strings.CutSuffix(value, "*"); ok {
+			m.value, m.prefix = v, true
+		}
+		matches = append(matches, m)
+	}
+
+	return func(e CloudEvent[D]) bool {
+		for _, m := range matches {
+			v, _ := e.Attribute(m.name)
+			if m.prefix && !strings.HasPrefix(v, m.value) || !m.prefix && v != m.value {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// cloudEventBinary is implemented by *CloudEvent, so handlers and clients of
+// any T can support the binary content mode when T is a CloudEvent.
+type cloudEventBinary interface {
+	decodeBinary(header http.Header, body []byte) error
+	decodeAttributes(attrs map[string]string, data []byte) error
+	encodeBinary() (attrs map[string]string, data []byte, err error)
+}
+
+var _ cloudEventBinary = (*CloudEvent[any])(nil)
+
+// decodeBinary decodes and validates an event in the binary content mode,
+// where attributes are ce-* headers, and the body is the data.
+func (e *CloudEvent[D]) decodeBinary(header http.Header, body []byte) error {
+	attrs := map[string]string{}
+	for key, values := range header {
+		name, ok := strings.CutPrefix(strings.ToLower(key), "ce-")
+		if !ok || len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		if v, err := url.PathUnescape(value); err == nil {
+			value = v // values are percent-encoded
+		}
+		attrs[name] = value
+	}
+	if contentType := header.Get("content-type"); contentType != "" {
+		attrs["datacontenttype"] = contentType
+	}
+
+	var res CloudEvent[D]
+	if err := res.decodeAttributes(attrs, body); err != nil {
+		return err
+	}
+	if err := res.normalize(); err != nil {
+		return err
+	}
+
+	*e = res
+	return nil
+}
+
+// decodeAttributes decodes an event from its context attributes, keyed by
+// name, and its encoded data. It doesn't validate the event.
+func (e *CloudEvent[D]) decodeAttributes(attrs map[string]string, data []byte) error {
+	var res CloudEvent[D]
+	for name, value := range attrs {
+		switch name {
+		case "specversion":
+			res.SpecVersion = value
+		case "id":
+			res.ID = value
+		case "source":
+			res.Source = value
+		case "type":
+			res.Type = value
+		case "subject":
+			res.Subject = value
+		case "datacontenttype":
+			res.DataContentType = value
+		case "dataschema":
+			res.DataSchema = value
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return fmt.Errorf("time: %w", err)
+			}
+			res.Time = t
+		default:
+			if res.Extensions == nil {
+				res.Extensions = map[string]string{}
+			}
+			res.Extensions[name] = value
+		}
+	}
+
+	if err := decodeCloudEventData(res.DataContentType, data, &res.Data); err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	*e = res
+	return nil
+}
+
+// encodeBinary returns the context attributes of the event, keyed by name,
+// and its encoded data, for the binary content mode.
+func (e *CloudEvent[D]) encodeBinary() (map[string]string, []byte, error) {
+	attrs := make(map[string]string, len(e.Extensions)+8)
+	for name := range e.Extensions {
+		if v, ok := e.Attribute(name); ok {
+			attrs[name] = v
+		}
+	}
+	for _, name := range []string{"specversion", "id", "source", "type", "subject", "time", "datacontenttype", "dataschema"} {
+		if v, ok := e.Attribute(name); ok {
+			attrs[name] = v
+		}
+	}
+
+	switch d := any(e.Data).(type) {
+	case []byte:
+		return attrs, d, nil
+	case string:
+		return attrs, []byte(d), nil
+	}
+	if !isJSONMediaType(e.DataContentType) {
+		return nil, nil, fmt.Errorf("can't encode data as %q", e.DataContentType)
+	}
+	data, err := json.Marshal(e.Data)
+	return attrs, data, err
+}
+
+// decodeCloudEventData decodes data of the given content type into d. Byte
+// slices and strings accept any content type, other types only JSON.
+func decodeCloudEventData[D any](contentType string, data []byte, d *D) error {
+	switch p := any(d).(type) {
+	case *[]byte:
+		*p = bytes.Clone(data)
+		return nil
+	case *string:
+		*p = string(data)
+		return nil
+	}
+	if !isJSONMediaType(contentType) {
+		return fmt.Errorf("unsupported content type %q", contentType)
+	}
+	return json.Unmarshal(data, d)
+}
+
+// isJSONMediaType returns true for JSON media types, including structured
+// syntax suffixes like application/vnd.example+json, and the empty string.
+func isJSONMediaType(s string) bool {
+	if s == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(s)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,124 @@
+package pshttp
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Codec pairs an [EncodeFunc] and [DecodeFunc] with the media type of the
+// encoded values.
+type Codec[T any] struct {
+	// MediaType of encoded values, e.g. application/json.
+	MediaType string
+
+	// Encode encodes values.
+	Encode EncodeFunc[T]
+
+	// Decode decodes values.
+	Decode DecodeFunc[T]
+
+	// Binary indicates that encoded values may not be valid UTF-8, and so
+	// can only be sent to subscribers which negotiate binary framing, see
+	// [FramingBase64]. Clients with binary codecs negotiate binary framing
+	// automatically.
+	Binary bool
+}
+
+// JSONCodec returns a codec for application/json, using [EncodeJSON] and
+// [DecodeJSON].
+func JSONCodec[T any]() Codec[T] {
+	return Codec[T]{
+		MediaType: "application/json",
+		Encode:    EncodeJSON[T],
+		Decode:    DecodeJSON[T],
+	}
+}
+
+// GobCodec returns a codec for application/x-gob, using [encoding/gob]. Each
+// value is encoded as a self-contained gob stream, including type information.
+func GobCodec[T any]() Codec[T] {
+	return Codec[T]{
+		MediaType: "application/x-gob",
+		Encode:    func(v T, w io.Writer) error { return gob.NewEncoder(w).Encode(v) },
+		Decode:    func(r io.Reader, v *T) error { return gob.NewDecoder(r).Decode(v) },
+		Binary:    true,
+	}
+}
+
+// Codecs is a set of codecs, keyed by media type, in order of preference. The
+// first codec is the default.
+type Codecs[T any] []Codec[T]
+
+// Lookup returns the codec for the given media type, if it exists. Parameters
+// of the media type are ignored.
+func (cs Codecs[T]) Lookup(mediaType string) (Codec[T], bool) {
+	if mt, _, err := mime.ParseMediaType(mediaType); err == nil {
+		mediaType = mt
+	}
+	for _, c := range cs {
+		if strings.EqualFold(c.MediaType, mediaType) {
+			return c, true
+		}
+	}
+	return Codec[T]{}, false
+}
+
+// Default returns the first codec.
+func (cs Codecs[T]) Default() Codec[T] {
+	if len(cs) == 0 {
+		return JSONCodec[T]()
+	}
+	return cs[0]
+}
+
+// forContentType returns the codec to decode a request body, based on the
+// request Content-Type. Requests without a content type, or with an unknown
+// content type, use the default codec.
+func (cs Codecs[T]) forContentType(r *http.Request) Codec[T] {
+	if c, ok := cs.Lookup(r.Header.Get("content-type")); ok {
+		return c
+	}
+	return cs.Default()
+}
+
+// forLines returns the codec to decode the newline-delimited values of a batch
+// or streaming publish request, based on the request Content-Type. NDJSON
+// selects the JSON codec, if any. Requests without a content type, or with an
+// unknown content type, use the default codec. Binary codecs can't decode
+// newline-delimited values, so selecting one is an error.
+func (cs Codecs[T]) forLines(r *http.Request) (Codec[T], error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl":
+		mediaType = "application/json"
+	}
+	c, ok := cs.Lookup(mediaType)
+	switch {
+	case !ok:
+		return cs.Default(), nil
+	case c.Binary:
+		return Codec[T]{}, fmt.Errorf("binary codec %s can't decode newline-delimited values", c.MediaType)
+	default:
+		return c, nil
+	}
+}
+
+// forAccept returns the codec to encode values for a subscriber, based on the
+// media types in the request Accept header, in order. Codecs for which the
+// allow func returns false aren't considered. Requests that don't accept any
+// allowed codec use the default codec, if it's allowed.
+func (cs Codecs[T]) forAccept(r *http.Request, allow func(Codec[T]) bool) (Codec[T], error) {
+	for _, a := range strings.Split(r.Header.Get("accept"), ",") {
+		if c, ok := cs.Lookup(strings.TrimSpace(a)); ok && allow(c) {
+			return c, nil
+		}
+	}
+	if c := cs.Default(); allow(c) {
+		return c, nil
+	}
+	return Codec[T]{}, fmt.Errorf("no acceptable codec")
+}
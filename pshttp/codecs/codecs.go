@@ -0,0 +1,63 @@
+// Package codecs provides [pshttp.Codec] implementations for encodings outside
+// of the standard library: CBOR, MessagePack, and protobuf. It's a separate
+// module, so that package pshttp doesn't depend on them.
+package codecs
+
+import (
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/peterbourgon/ps/pshttp"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// CBORCodec returns a codec for application/cbor.
+func CBORCodec[T any]() pshttp.Codec[T] {
+	return pshttp.Codec[T]{
+		MediaType: "application/cbor",
+		Encode:    func(v T, w io.Writer) error { return cbor.NewEncoder(w).Encode(v) },
+		Decode:    func(r io.Reader, v *T) error { return cbor.NewDecoder(r).Decode(v) },
+		Binary:    true,
+	}
+}
+
+// MessagePackCodec returns a codec for application/vnd.msgpack.
+func MessagePackCodec[T any]() pshttp.Codec[T] {
+	return pshttp.Codec[T]{
+		MediaType: "application/vnd.msgpack",
+		Encode:    func(v T, w io.Writer) error { return msgpack.NewEncoder(w).Encode(v) },
+		Decode:    func(r io.Reader, v *T) error { return msgpack.NewDecoder(r).Decode(v) },
+		Binary:    true,
+	}
+}
+
+// ProtobufCodec returns a codec for application/x-protobuf, for protobuf
+// message types, e.g. *mypb.Event.
+func ProtobufCodec[T proto.Message]() pshttp.Codec[T] {
+	return pshttp.Codec[T]{
+		MediaType: "application/x-protobuf",
+		Encode: func(v T, w io.Writer) error {
+			data, err := proto.Marshal(v)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		},
+		Decode: func(r io.Reader, v *T) error {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			var zero T
+			m := zero.ProtoReflect().Type().New().Interface().(T)
+			if err := proto.Unmarshal(data, m); err != nil {
+				return err
+			}
+			*v = m
+			return nil
+		},
+		Binary: true,
+	}
+}
@@ -0,0 +1,105 @@
+package codecs_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pshttp"
+	"github.com/peterbourgon/ps/pshttp/codecs"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Broker: broker,
+		Codecs: pshttp.Codecs[int64]{
+			pshttp.JSONCodec[int64](),
+			codecs.CBORCodec[int64](),
+			codecs.MessagePackCodec[int64](),
+		},
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c := make(chan int64, 10)
+	broker.SubscribeAll(c)
+
+	for i, codec := range handler.Codecs() {
+		client, err := pshttp.NewCodecClient(http.DefaultClient, server.URL, codec)
+		if err != nil {
+			t.Fatalf("%s: create client: %v", codec.MediaType, err)
+		}
+		if _, err := client.Publish(ctx, int64(i)); err != nil {
+			t.Fatalf("%s: publish: %v", codec.MediaType, err)
+		}
+		if want, have := int64(i), <-c; want != have {
+			t.Errorf("%s: want %v, have %v", codec.MediaType, want, have)
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", server.URL, strings.NewReader(`{"invalid": true}`))
+	req.Header.Set("Content-Type", "application/cbor")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusBadRequest, resp.StatusCode; want != have {
+		t.Errorf("invalid CBOR: want %d, have %d", want, have)
+	}
+
+	client, err := pshttp.NewCodecClient(http.DefaultClient, server.URL, codecs.CBORCodec[int64]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		valc      = make(chan int64, 1)
+		connected = make(chan struct{}, 1)
+	)
+	go client.SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{
+		OnStateChange: func(state pshttp.ConnState, _ error) {
+			if state == pshttp.StateConnected {
+				connected <- struct{}{}
+			}
+		},
+	})
+	<-connected
+	for broker.Publish(42).Sends < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, have := int64(42), <-valc; want != have {
+		t.Errorf("CBOR subscription: want %v, have %v", want, have)
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	t.Parallel()
+
+	codec := codecs.ProtobufCodec[*wrapperspb.StringValue]()
+
+	var buf bytes.Buffer
+	if err := codec.Encode(wrapperspb.String("hello"), &buf); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	var v *wrapperspb.StringValue
+	if err := codec.Decode(&buf, &v); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if want, have := "hello", v.GetValue(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,18 @@
+module github.com/peterbourgon/ps/pshttp/codecs
+
+go 1.24
+
+require (
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/peterbourgon/ps v0.0.0-00010101000000-000000000000
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.36.12
+)
+
+require (
+	github.com/peterbourgon/eventsource v0.0.0-20240918134904-0c90791d8b55 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+)
+
+replace github.com/peterbourgon/ps => ../..
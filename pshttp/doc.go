@@ -1,11 +1,62 @@
 // Package pshttp provides an HTTP interface to a [ps.Broker].
 //
-// [NewHandler] wraps a [ps.Broker] and returns an [http.Handler]. The handler
+// [NewHandler] wraps a [ps.Broker] and returns a [Handler]. The handler
 // accepts POST requests for publishing events, and GET requests for subscribing
 // to events. Subscriptions are implemented via server-sent events, or SSE, so
-// GET requests must accept: text/event-stream.
+// GET requests must accept: text/event-stream. POST requests to /batch publish
+// many values at once, encoded as a JSON array or as newline-delimited values.
+// POST requests to /stream publish newline-delimited values continuously, as
+// they're read from the request body, and periodically respond with stats.
+//
+// [NewRegistryHandler] serves every broker in a [ps.Registry], each under
+// /topics/{topic}, and lists topics at GET /topics. [Client.Topic] targets a
+// single topic of such a handler.
+//
+// [NewHandlerConfig] allows further configuration of the handler, including an
+// [Authenticator] to identify the [Principal] behind each request, and an
+// [Authorizer] to decide what each principal is allowed to publish and see,
+// and [Limits] to protect the handler from misbehaving or abusive clients.
+// [NewHandlerWithOptions] and [NewClientWithOptions] configure handlers and
+// clients with functional options, like [WithPrefix] or [WithHeader], instead.
+//
+// Values are encoded with a [Codec]. A handler can support many codecs at once,
+// selected by the Content-Type of publish requests, and the Accept header of
+// subscribe requests. [NewCodecClient] constructs a client which advertises
+// its preferred codec. Server-sent events are text, so subscriptions using
+// binary codecs negotiate binary framing, see [FramingBase64].
+//
+// Handlers of [CloudEvent] values support the CloudEvents structured content
+// mode via [CloudEventCodec], and the binary content mode, where attributes
+// are ce-* headers, for publish requests. Subscribers can request the binary
+// content mode with [SubscribeConfig.CloudEventsBinary], where attributes are
+// sent as separate events, and filter on CloudEvents attributes with
+// [ParseCloudEventFilter].
+//
+// [Handler.AdminHandler] returns a separate [http.Handler] with administrative
+// endpoints, to list and disconnect active subscriptions, and to summarize the
+// state of every broker. [NewAdminHandler] does the same for several handlers,
+// like handlers replaced on reload. [Handler.Shutdown] gracefully drains
+// subscriptions, telling each subscriber when to reconnect.
 //
 // [Client] wraps a remote URI, which is assumed to be handled by a handler
 // returned by [NewHandler]. It provides publish and subscribe methods similar
-// to a [ps.Broker].
+// to a [ps.Broker]. Subscriptions are automatically re-established when the
+// connection is interrupted, according to a [ReconnectPolicy], and resume after
+// the last value received, if the broker retains recent values, see
+// [ps.BrokerConfig.Replay]. High-throughput producers can use a [Publisher] to
+// stream values over a single connection. Publish requests with an
+// [IdempotencyKeyHeader] are deduplicated by the broker, so [Client.PublishKey]
+// and clients with [WithPublishRetry] can safely retry them.
+//
+// A [Mirror] maintains a single subscription, and republishes values into a
+// local [ps.Broker], so many local subscribers share one upstream connection.
+// A [Federation] links the brokers of several nodes, so values published on
+// any node reach subscribers on every node. A [FailoverClient] publishes and
+// subscribes to any healthy endpoint of several equivalent handlers, and its
+// subscriptions resume on the next endpoint when they fail over.
+//
+// [Webhook] is a subscriber which delivers values to an HTTP endpoint via POST
+// requests, signed with [SignWebhook], and retries failed deliveries. [Hub]
+// implements a WebSub hub, which delivers values to callback URLs registered
+// by subscribers, with webhooks.
 package pshttp
@@ -6,12 +6,13 @@ import (
 )
 
 // EncodeFunc encodes a value of type T to the writer. The encoded bytes must be
-// valid UTF-8. Every EncodeFunc should have a corresponding DecodeFunc.
+// valid UTF-8, unless they're only sent to subscribers with binary framing,
+// see [FramingBase64]. Every EncodeFunc should have a corresponding DecodeFunc.
 type EncodeFunc[T any] func(T, io.Writer) error
 
 // DecodeFunc decodes a value of type T from the reader. The decoded bytes are
-// expected to be valid UTF-8. Every DecodeFunc should have a corresponding
-// EncodeFunc.
+// expected to be valid UTF-8, unless they're received with binary framing. Every
+// DecodeFunc should have a corresponding EncodeFunc.
 type DecodeFunc[T any] func(io.Reader, *T) error
 
 // EncodeJSON is a default EncodeFunc that encodes the value as JSON.
@@ -7,17 +7,53 @@ import (
 )
 
 const (
-	// EventTypeData is the EventSource type for data events.
+	// EventTypeData is the EventSource type for data events. The event ID is
+	// the ID of the value in the broker, see [ps.Message]. Subscribe requests
+	// with a Last-Event-ID header resume after that value, if the broker still
+	// retains it, see [ps.BrokerConfig.Replay].
 	EventTypeData = "data/v1"
 
+	// EventTypeBinaryData is the EventSource type for data events when binary
+	// framing is negotiated. The event data is the standard base64 encoding of
+	// the encoded value.
+	EventTypeBinaryData = "binary-data/v1"
+
+	// EventTypeCloudEventAttributes is the EventSource type for the context
+	// attributes of a CloudEvent, sent before each data event of subscriptions
+	// in the binary content mode, see [CloudEventsBinary]. The event data is a
+	// JSON object of the attributes, keyed by name, as in the CloudEvents JSON
+	// format, without data.
+	EventTypeCloudEventAttributes = "cloudevent-attributes/v1"
+
 	// EventTypeHeartbeat is the EventSource type for heartbeat events. The
 	// event data is the JSON encoding of a [HeartbeatEvent] value.
 	EventTypeHeartbeat = "heartbeat/v1"
+
+	// EventTypeShutdown is the EventSource type for the final event sent to a
+	// subscriber when the handler shuts down. The event data is the JSON
+	// encoding of a [ShutdownEvent] value.
+	EventTypeShutdown = "shutdown/v1"
 )
 
+// FramingBase64 is the value of the framing query parameter which negotiates
+// binary framing for a subscription. With binary framing, data events are sent
+// under the [EventTypeBinaryData] type, so encoded values don't need to be
+// valid UTF-8, and binary codecs can be used.
+const FramingBase64 = "base64"
+
 // HeartbeatEvent is sent under the [EventTypeHeartbeat] type.
 type HeartbeatEvent struct {
 	Timestamp time.Time `json:"ts"`
 	Stats     ps.Stats  `json:"stats,omitempty"`
 	Error     string    `json:"error,omitempty"`
 }
+
+// ShutdownEvent is sent under the [EventTypeShutdown] type. Subscribers should
+// wait at least RetryAfterMs milliseconds before reconnecting, to give the
+// server time to go away, and load balancers time to notice. Stats are the
+// final stats of the subscription.
+type ShutdownEvent struct {
+	Timestamp    time.Time `json:"ts"`
+	RetryAfterMs int64     `json:"retry_after_ms"`
+	Stats        ps.Stats  `json:"stats,omitempty"`
+}
@@ -0,0 +1,455 @@
+package pshttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// EndpointSelection decides the order in which a [FailoverClient] uses its
+// healthy endpoints.
+type EndpointSelection int
+
+const (
+	// SelectPriority uses the first healthy endpoint, in the configured
+	// order. Later endpoints are only used when earlier endpoints are down.
+	SelectPriority EndpointSelection = iota
+
+	// SelectRoundRobin rotates through the healthy endpoints, spreading
+	// requests across them.
+	SelectRoundRobin
+)
+
+// EndpointStatus describes the health of an endpoint of a [FailoverClient].
+type EndpointStatus struct {
+	// URI of the endpoint.
+	URI string `json:"uri"`
+
+	// Healthy is false if the endpoint is marked down.
+	Healthy bool `json:"healthy"`
+
+	// Since is when the endpoint was last marked up or down.
+	Since time.Time `json:"since"`
+
+	// Error is the error that caused the endpoint to be marked down, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// FailoverConfig enumerates the parameters for a client returned by
+// [NewFailoverClient]. At least one endpoint is required.
+type FailoverConfig[T any] struct {
+	// Endpoints are the URIs of equivalent handlers, e.g. replicas of a
+	// service, or nodes of a [Federation]. For registry handlers, each URI
+	// should include the topic, e.g. https://host/topics/orders.
+	Endpoints []string
+
+	// Selection decides which healthy endpoint is used. The default is
+	// [SelectPriority].
+	Selection EndpointSelection
+
+	// Options configure the client of every endpoint, e.g. [WithHeader] or
+	// [WithClientCodec]. The reconnect policy of the options applies to
+	// subscriptions, but the publish retry policy is ignored: failed publishes
+	// are retried on the next endpoint instead.
+	Options []ClientOption[T]
+
+	// FailureThreshold is the number of consecutive failed requests after
+	// which an endpoint is marked down. If zero, 1 is used.
+	FailureThreshold int
+
+	// ProbeInterval is how often endpoints which are marked down are probed,
+	// with a subscribe request, to see if they've recovered. If zero, 5s is
+	// used.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout of each probe. If zero, 2s is used.
+	ProbeTimeout time.Duration
+
+	// Logger receives log output from the client. If nil, logs are discarded.
+	Logger *slog.Logger
+}
+
+// FailoverClient is a client of several equivalent endpoints, which fails
+// over between them. Publishes go to a healthy endpoint, and are retried on
+// the next endpoint if they fail with a transport error, or with status 429,
+// 502, 503, or 504. Endpoints which fail are marked down, and probed in the
+// background until they recover.
+//
+// Subscriptions fail over to the next endpoint when they're disconnected, after
+// the suggested reconnect delay if the endpoint shut down gracefully, and resume
+// after the last value they received, so values published while failing over
+// aren't missed. That requires brokers which retain recent values, see
+// [ps.BrokerConfig.Replay], and endpoints which agree on the IDs of values:
+// endpoints which serve the same broker, or nodes of a [Federation], where
+// values keep the ID they were published with. Nodes of a federation receive
+// values from different origins in different orders, so a subscription which
+// fails over between them may miss or repeat values that were published
+// concurrently on different nodes.
+type FailoverClient[T any] struct {
+	endpoints []*Client[T]
+	selection EndpointSelection
+	threshold int
+	interval  time.Duration
+	timeout   time.Duration
+	logger    *slog.Logger
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	mtx      sync.Mutex
+	status   []EndpointStatus
+	failures []int // consecutive
+	next     int   // round robin
+}
+
+// NewFailoverClient returns a new client of the configured endpoints, and
+// starts probing endpoints which are marked down. Callers must Close the
+// client when they're done with it.
+func NewFailoverClient[T any](config FailoverConfig[T]) (*FailoverClient[T], error) {
+	if len(config.Endpoints) == 0 {
+		return nil, errors.New("at least one endpoint is required")
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 1
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = 5 * time.Second
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = 2 * time.Second
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	c := &FailoverClient[T]{
+		selection: config.Selection,
+		threshold: config.FailureThreshold,
+		interval:  config.ProbeInterval,
+		timeout:   config.ProbeTimeout,
+		logger:    config.Logger.With("component", "pshttp.FailoverClient"),
+		status:    make([]EndpointStatus, len(config.Endpoints)),
+		failures:  make([]int, len(config.Endpoints)),
+	}
+
+	now := time.Now()
+	for i, uri := range config.Endpoints {
+		client, err := NewClientWithOptions[T](uri, config.Options...)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %d: %w", i+1, err)
+		}
+		c.endpoints = append(c.endpoints, client)
+		c.status[i] = EndpointStatus{URI: redactURI(uri), Healthy: true, Since: now}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.probeLoop(ctx)
+	}()
+
+	return c, nil
+}
+
+// Endpoints returns the status of every endpoint, in the configured order.
+func (c *FailoverClient[T]) Endpoints() []EndpointStatus {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	res := make([]EndpointStatus, len(c.status))
+	copy(res, c.status)
+	return res
+}
+
+// Close stops probing endpoints. It doesn't affect active subscriptions.
+func (c *FailoverClient[T]) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return nil
+}
+
+// Publish calls [FailoverClient.PublishKey] with a random idempotency key.
+func (c *FailoverClient[T]) Publish(ctx context.Context, v T) (ps.Stats, error) {
+	return c.PublishKey(ctx, newDeliveryID(), v)
+}
+
+// PublishKey publishes the value v to a healthy endpoint, with the given
+// idempotency key, see [Client.PublishKey]. If the request fails with a
+// transport error, or with status 429, 502, 503, or 504, it's retried on the
+// next endpoint, until every endpoint has been tried once. The key only
+// prevents duplicates on endpoints which share a broker.
+func (c *FailoverClient[T]) PublishKey(ctx context.Context, key string, v T) (ps.Stats, error) {
+	var buf bytes.Buffer
+	if err := c.endpoints[0].codec.Encode(v, &buf); err != nil {
+		return ps.Stats{}, fmt.Errorf("encode value: %w", err)
+	}
+
+	var errs []error
+	for _, i := range c.order(-1) {
+		stats, retryable, err := c.endpoints[i].publishOnce(ctx, key, buf.Bytes())
+		if err == nil {
+			c.succeed(i)
+			return stats, nil
+		}
+		if !retryable || ctx.Err() != nil {
+			return ps.Stats{}, err
+		}
+		c.fail(i, err)
+		errs = append(errs, fmt.Errorf("%s: %w", redactURI(c.endpoints[i].uri), err))
+	}
+	return ps.Stats{}, fmt.Errorf("every endpoint failed: %w", errors.Join(errs...))
+}
+
+// Subscribe subscribes to a healthy endpoint, and forwards values to ch. When
+// the subscription is disconnected, it fails over to the next endpoint, and
+// resumes after the last value received. Failover is immediate, unless the
+// endpoint shut down gracefully, in which case the suggested reconnect delay
+// is honored first. The reconnect policy of the config applies once every
+// endpoint has failed in turn, without a stable connection, and its attempts
+// count such rounds. A connection is stable once it has received a value, or
+// stayed up for 10s. Subscribe blocks until the context is canceled, the
+// reconnect policy gives up, or a fatal error occurs, whichever comes first.
+//
+// OnStateChange is called as for [Client.SubscribeConfig], for every endpoint
+// in turn.
+func (c *FailoverClient[T]) Subscribe(ctx context.Context, ch chan<- T, config SubscribeConfig) error {
+	if config.Reconnect == nil {
+		config.Reconnect = c.endpoints[0].reconnect
+	}
+	if config.Reconnect == nil {
+		config.Reconnect = &ExponentialBackoff{}
+	}
+
+	notify := func(state ConnState, err error) {
+		if config.OnStateChange != nil {
+			config.OnStateChange(state, err)
+		}
+	}
+
+	var (
+		failed  = -1 // most recently failed endpoint
+		tries   int  // since the last successful connection
+		rounds  int
+		first   time.Time
+		waitFor time.Duration
+		lastID  string // resumed on every endpoint
+	)
+	for {
+		i := c.order(failed)[0]
+		client := c.endpoints[i]
+		sc := config
+		if sc.Buffer == 0 {
+			sc.Buffer = client.buffer
+		}
+		if sc.Heartbeat == 0 {
+			sc.Heartbeat = client.heartbeat
+		}
+
+		notify(StateConnecting, nil)
+
+		var (
+			prevID      = lastID
+			connectedAt time.Time
+		)
+		err := client.subscribeOnce(ctx, ch, sc, &lastID, func() {
+			connectedAt = time.Now()
+			c.succeed(i)
+			c.logger.Info("subscribed", "endpoint", redactURI(client.uri))
+			notify(StateConnected, nil)
+		})
+
+		if ctx.Err() != nil {
+			notify(StateDisconnected, ctx.Err())
+			return ctx.Err()
+		}
+
+		notify(StateDisconnected, err)
+
+		var fatal *fatalError
+		if errors.As(err, &fatal) {
+			notify(StateGaveUp, fatal.err)
+			return fatal.err
+		}
+
+		c.fail(i, err)
+		failed = i
+
+		var (
+			statusErr   *StatusError
+			shutdownErr *ShutdownError
+		)
+		switch {
+		case errors.As(err, &statusErr):
+			waitFor = max(waitFor, statusErr.RetryAfter)
+		case errors.As(err, &shutdownErr):
+			waitFor = max(waitFor, shutdownErr.RetryAfter)
+		}
+
+		// Connections which are dropped before they're stable, e.g. by
+		// endpoints in a restart loop, count as failed tries, so that the
+		// reconnect policy still applies.
+		if !connectedAt.IsZero() && (lastID != prevID || time.Since(connectedAt) >= failoverStableAfter) {
+			tries, rounds = 0, 0
+		}
+
+		if tries == 0 && rounds == 0 {
+			first = time.Now()
+		}
+		if tries++; tries < len(c.endpoints) {
+			if shutdownErr == nil {
+				continue // fail over immediately
+			}
+			select {
+			case <-time.After(shutdownErr.RetryAfter):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		tries = 0
+		rounds++
+		delay, ok := config.Reconnect.Next(rounds, time.Since(first), err)
+		if !ok {
+			err = fmt.Errorf("gave up after %d round(s) of every endpoint: %w", rounds, err)
+			notify(StateGaveUp, err)
+			return err
+		}
+		delay, waitFor = max(delay, waitFor), 0
+
+		select {
+		case <-time.After(delay):
+			// reconnect
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// failoverStableAfter is how long a subscription connection must stay up to be
+// considered stable, if it doesn't receive any values.
+const failoverStableAfter = 10 * time.Second
+
+// order returns the indexes of the endpoints, in the order they should be
+// tried: healthy endpoints first, according to the selection, and then the
+// endpoints which are marked down. The endpoint at index skip, if any, is
+// moved to the end.
+func (c *FailoverClient[T]) order(skip int) []int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	n := len(c.endpoints)
+	start := 0
+	if c.selection == SelectRoundRobin {
+		start = c.next % n
+		c.next++
+	}
+
+	var healthy, down []int
+	for k := range n {
+		i := (start + k) % n
+		switch {
+		case i == skip:
+		case c.status[i].Healthy:
+			healthy = append(healthy, i)
+		default:
+			down = append(down, i)
+		}
+	}
+
+	res := append(healthy, down...)
+	if skip >= 0 && skip < n {
+		res = append(res, skip)
+	}
+	return res
+}
+
+func (c *FailoverClient[T]) succeed(i int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.failures[i] = 0
+	if !c.status[i].Healthy {
+		c.status[i] = EndpointStatus{URI: c.status[i].URI, Healthy: true, Since: time.Now()}
+		c.logger.Info("endpoint up", "endpoint", c.status[i].URI)
+	}
+}
+
+func (c *FailoverClient[T]) fail(i int, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.failures[i]++
+	var shutdownErr *ShutdownError
+	if c.status[i].Healthy && (c.failures[i] >= c.threshold || errors.As(err, &shutdownErr)) {
+		c.status[i] = EndpointStatus{URI: c.status[i].URI, Healthy: false, Since: time.Now(), Error: err.Error()}
+		c.logger.Warn("endpoint down", "endpoint", c.status[i].URI, "error", err)
+	}
+}
+
+// probeLoop probes endpoints which are marked down, until the context is
+// canceled.
+func (c *FailoverClient[T]) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for i, status := range c.Endpoints() {
+			if status.Healthy {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			err := c.endpoints[i].probe(ctx)
+			cancel()
+			if err == nil {
+				c.succeed(i)
+			} else {
+				c.logger.Debug("probe failed", "endpoint", status.URI, "error", err)
+			}
+		}
+	}
+}
+
+// probe makes a subscribe request, and closes it as soon as the response
+// headers are received. The endpoint is healthy if the subscription is
+// accepted.
+func (c *Client[T]) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.codec.MediaType != "" {
+		req.Header.Set("Accept", "text/event-stream, "+c.codec.MediaType)
+	}
+	if c.codec.Binary {
+		q := req.URL.Query()
+		q.Set("framing", FramingBase64)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+package pshttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// FederatedValue is a value published on a node of a [Federation], as it's
+// forwarded between nodes.
+type FederatedValue[T any] struct {
+	// ID uniquely identifies the published value. Every node publishes the
+	// value to its broker with the same ID, see [ps.Broker.PublishMessage], so
+	// subscriptions can resume on any node.
+	ID string `json:"id"`
+
+	// Origin is the name of the node where the value was published.
+	Origin string `json:"origin"`
+
+	// Time when the value was published, according to the origin node.
+	Time time.Time `json:"ts"`
+
+	// Path is the names of the nodes which forwarded the value, starting with
+	// the origin.
+	Path []string `json:"path"`
+
+	// Value is the published value.
+	Value T `json:"value"`
+}
+
+// PeerStats describes the link from a [Federation] to one of its peers.
+type PeerStats struct {
+	// URI of the peer.
+	URI string `json:"uri"`
+
+	// State of the connection to the peer.
+	State ConnState `json:"state"`
+
+	// Since is when the connection entered its current state.
+	Since time.Time `json:"since"`
+
+	// Error is the error that caused the most recent disconnect, if any.
+	Error string `json:"error,omitempty"`
+
+	// Connects is the number of times the connection has been established.
+	Connects uint64 `json:"connects"`
+
+	// Received are values received from the peer, and published to the local
+	// broker.
+	Received uint64 `json:"received"`
+
+	// Suppressed are values received from the peer which weren't published,
+	// because they had already been received, or published locally.
+	Suppressed uint64 `json:"suppressed"`
+
+	// LastReceived is when the most recent value was received from the peer.
+	LastReceived time.Time `json:"last_received"`
+
+	// Lag is the time between the most recent value being published on its
+	// origin node and being received from the peer. It's subject to clock
+	// skew between the nodes.
+	Lag time.Duration `json:"lag"`
+
+	// Heartbeat is the most recent heartbeat from the peer. Its stats describe
+	// the link on the peer, so e.g. drops are values the peer couldn't forward
+	// to this node.
+	Heartbeat HeartbeatEvent `json:"heartbeat"`
+}
+
+// FederationConfig enumerates the parameters for a federation returned by
+// [NewFederation]. Broker and Node are required.
+type FederationConfig[T any] struct {
+	// Broker is the local broker. Values published via [Federation.Publish]
+	// and values received from peers are published to it.
+	Broker *ps.Broker[T]
+
+	// Node is the name of the local node, which must be unique within the
+	// federation.
+	Node string
+
+	// Peers are the URIs of the other nodes of the federation, where each
+	// serves its [Federation] as an HTTP handler. Links are pulled: the node
+	// subscribes to every peer, and receives the values forwarded by the
+	// peer. For values to flow both ways, nodes must list each other as
+	// peers. Values are forwarded across nodes, so every node must be
+	// reachable from every other node, but not necessarily directly.
+	Peers []string
+
+	// HTTPClient is used to subscribe to peers. If nil, [http.DefaultClient]
+	// is used.
+	HTTPClient *http.Client
+
+	// Header, if non-nil, is added to every request to peers, e.g. for
+	// authentication.
+	Header http.Header
+
+	// Handler configures the handler serving the node to peers. The broker,
+	// codecs, and filter are set by the federation.
+	Handler HandlerConfig[FederatedValue[T]]
+
+	// Reconnect decides when to reconnect to peers. If nil, an
+	// [ExponentialBackoff] is used, which never gives up.
+	Reconnect ReconnectPolicy
+
+	// Heartbeat interval requested from peers. If zero, the handler default
+	// of the peer is used.
+	Heartbeat time.Duration
+
+	// Buffer of the links to peers. If zero, 100 is used.
+	Buffer int
+
+	// DedupSize is the number of recent value IDs remembered to suppress
+	// duplicates. It should be larger than the number of values published
+	// across the federation in the time it takes a value to reach every node.
+	// If zero, 10000 is used.
+	DedupSize int
+
+	// Logger receives log output from the federation. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+}
+
+// Federation links a local broker with the brokers of other nodes, so values
+// published on any node reach subscribers on every node. Values must be
+// published via [Federation.Publish]: values published directly to the local
+// broker aren't forwarded to peers.
+//
+// Every value is tagged with a unique ID and the name of its origin node, and
+// is forwarded between nodes as a [FederatedValue], encoded as JSON. Nodes
+// don't forward values back to nodes which have already seen them, and
+// suppress values they've already received, so any topology of peers is safe,
+// including full meshes and cycles.
+type Federation[T any] struct {
+	broker    *ps.Broker[T]
+	node      string
+	peers     []string
+	client    *http.Client
+	header    http.Header
+	reconnect ReconnectPolicy
+	heartbeat time.Duration
+	buffer    int
+	logger    *slog.Logger
+	out       *ps.Broker[FederatedValue[T]]
+	handler   *Handler[FederatedValue[T]]
+
+	mtx   sync.Mutex
+	stats []PeerStats
+	seen  map[string]bool
+	ring  []string // IDs in seen, oldest first from next
+	next  int
+}
+
+// NewFederation returns a new federation node, which doesn't link to its
+// peers until Run is called.
+func NewFederation[T any](config FederationConfig[T]) (*Federation[T], error) {
+	if config.Broker == nil {
+		return nil, errors.New("broker is required")
+	}
+	if config.Node == "" {
+		return nil, errors.New("node name is required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.Reconnect == nil {
+		config.Reconnect = &ExponentialBackoff{Initial: time.Second, Max: 30 * time.Second, Jitter: 0.5}
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 100
+	}
+	if config.DedupSize <= 0 {
+		config.DedupSize = 10000
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	f := &Federation[T]{
+		broker:    config.Broker,
+		node:      config.Node,
+		peers:     slices.Clone(config.Peers),
+		client:    config.HTTPClient,
+		header:    config.Header,
+		reconnect: config.Reconnect,
+		heartbeat: config.Heartbeat,
+		buffer:    config.Buffer,
+		logger:    config.Logger.With("component", "pshttp.Federation", "node", config.Node),
+		out:       ps.NewBroker[FederatedValue[T]](),
+		stats:     make([]PeerStats, len(config.Peers)),
+		seen:      make(map[string]bool, config.DedupSize),
+		ring:      make([]string, config.DedupSize),
+	}
+
+	for i, uri := range config.Peers {
+		f.stats[i] = PeerStats{URI: redactURI(uri), State: StateDisconnected, Since: time.Now()}
+	}
+
+	hc := config.Handler
+	hc.Broker, hc.Registry = f.out, nil
+	hc.Codecs, hc.Encode, hc.Decode = Codecs[FederatedValue[T]]{JSONCodec[FederatedValue[T]]()}, nil, nil
+	hc.Filter = parseFederationFilter[T]
+	if hc.Logger == nil && hc.Logs == nil {
+		hc.Logger = config.Logger
+	}
+	f.handler = NewHandlerConfig(hc)
+
+	return f, nil
+}
+
+// parseFederationFilter is the filter of the handler serving the node to
+// peers. Peers subscribe with their node name as the filter, and don't
+// receive values which they've already forwarded.
+func parseFederationFilter[T any](filter string) (func(FederatedValue[T]) bool, error) {
+	return func(fv FederatedValue[T]) bool {
+		return !slices.Contains(fv.Path, filter)
+	}, nil
+}
+
+// Broker returns the local broker.
+func (f *Federation[T]) Broker() *ps.Broker[T] {
+	return f.broker
+}
+
+// Publish the value to the local broker, and forward it to every peer. The
+// returned stats are for the local broker only.
+func (f *Federation[T]) Publish(v T) ps.Stats {
+	fv := FederatedValue[T]{
+		ID:     newDeliveryID(),
+		Origin: f.node,
+		Time:   time.Now().UTC(),
+		Path:   []string{f.node},
+		Value:  v,
+	}
+
+	f.mtx.Lock()
+	f.remember(fv.ID)
+	f.mtx.Unlock()
+
+	stats := f.broker.PublishMessage(ps.Message[T]{ID: fv.ID, Value: v})
+	f.out.Publish(fv)
+	return stats
+}
+
+// ServeHTTP implements http.Handler, serving the node to its peers. Only
+// subscribe requests are allowed; values can't be published to the node over
+// HTTP.
+func (f *Federation[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("allow", http.MethodGet)
+		f.handler.respondError(w, r, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
+// Shutdown gracefully drains the links of peers to this node, see
+// [Handler.Shutdown].
+func (f *Federation[T]) Shutdown(ctx context.Context) error {
+	return f.handler.Shutdown(ctx)
+}
+
+// Run links the node to every peer, and publishes values received from peers
+// to the local broker. It blocks until the context is canceled, or every link
+// fails permanently, and returns the corresponding error.
+func (f *Federation[T]) Run(ctx context.Context) error {
+	if len(f.peers) == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(f.peers))
+	)
+	for i, uri := range f.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f.link(ctx, i, uri)
+			if ctx.Err() == nil {
+				f.logger.Error("link failed", "peer", redactURI(uri), "error", errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+// Peers returns the stats of the link to every peer, in the order of the
+// configured peers.
+func (f *Federation[T]) Peers() []PeerStats {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return slices.Clone(f.stats)
+}
+
+func (f *Federation[T]) link(ctx context.Context, i int, uri string) error {
+	options := []ClientOption[FederatedValue[T]]{WithHTTPClient[FederatedValue[T]](f.client)}
+	for key, values := range f.header {
+		for _, value := range values {
+			options = append(options, WithHeader[FederatedValue[T]](key, value))
+		}
+	}
+	client, err := NewClientWithOptions[FederatedValue[T]](uri, options...)
+	if err != nil {
+		return err
+	}
+
+	config := SubscribeConfig{
+		Reconnect: f.reconnect,
+		Filter:    f.node,
+		Heartbeat: f.heartbeat,
+		OnStateChange: func(state ConnState, err error) {
+			f.peerStats(i, func(s *PeerStats) {
+				s.State, s.Since = state, time.Now()
+				switch {
+				case state == StateConnected:
+					s.Connects++
+				case err != nil:
+					s.Error = err.Error()
+				}
+			})
+			switch {
+			case state == StateConnected:
+				f.logger.Info("linked", "peer", redactURI(uri))
+			case err != nil && ctx.Err() == nil:
+				f.logger.Warn("link "+state.String(), "peer", redactURI(uri), "error", err)
+			}
+		},
+		OnHeartbeat: func(ev HeartbeatEvent) {
+			f.peerStats(i, func(s *PeerStats) { s.Heartbeat = ev })
+		},
+	}
+
+	var (
+		c    = make(chan FederatedValue[T], f.buffer)
+		errc = make(chan error, 1)
+	)
+	go func() {
+		errc <- client.SubscribeConfig(ctx, c, config)
+	}()
+
+	for {
+		select {
+		case fv := <-c:
+			f.receive(i, fv)
+
+		case err := <-errc:
+			for len(c) > 0 {
+				f.receive(i, <-c)
+			}
+			return err
+		}
+	}
+}
+
+// receive publishes a value from a peer to the local broker, and forwards it
+// to the other peers, unless it's a duplicate.
+func (f *Federation[T]) receive(i int, fv FederatedValue[T]) {
+	now := time.Now()
+
+	f.mtx.Lock()
+	fresh := !f.seen[fv.ID] && !slices.Contains(fv.Path, f.node)
+	if fresh {
+		f.remember(fv.ID)
+	}
+	s := &f.stats[i]
+	s.LastReceived, s.Lag = now, now.Sub(fv.Time)
+	if fresh {
+		s.Received++
+	} else {
+		s.Suppressed++
+	}
+	f.mtx.Unlock()
+
+	if !fresh {
+		return
+	}
+
+	f.broker.PublishMessage(ps.Message[T]{ID: fv.ID, Value: fv.Value})
+	fv.Path = append(slices.Clip(fv.Path), f.node)
+	f.out.Publish(fv)
+}
+
+// remember adds the ID to the set of seen IDs, evicting the oldest ID if the
+// set is full. The caller must hold the mutex.
+func (f *Federation[T]) remember(id string) {
+	if old := f.ring[f.next]; old != "" {
+		delete(f.seen, old)
+	}
+	f.ring[f.next] = id
+	f.next = (f.next + 1) % len(f.ring)
+	f.seen[id] = true
+}
+
+func (f *Federation[T]) peerStats(i int, update func(*PeerStats)) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	update(&f.stats[i])
+}
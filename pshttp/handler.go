@@ -2,116 +2,538 @@ package pshttp
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/peterbourgon/eventsource"
 	"github.com/peterbourgon/ps"
 )
 
-type handler[T any] struct {
-	http.Handler
-	broker *ps.Broker[T]
-	encode EncodeFunc[T]
-	decode DecodeFunc[T]
-	logger *log.Logger
+// IdempotencyKeyHeader is the header of publish requests which carries a
+// deduplication key, see [ps.Broker.PublishKey]. Keys are scoped to the
+// authenticated principal. A request with a key that was already published
+// isn't published again, and receives the stats of the original publish, with
+// the [IdempotentReplayedHeader] set to true.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set to true on responses to publish requests
+// which weren't published, because their [IdempotencyKeyHeader] was a
+// duplicate.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// Handler is an [http.Handler] which serves a [ps.Broker], or every broker in a
+// [ps.Registry], to remote publishers and subscribers.
+type Handler[T any] struct {
+	mux           http.Handler
+	broker        *ps.Broker[T]
+	registry      *ps.Registry[T]
+	codecs        Codecs[T]
+	logger        *slog.Logger
+	authenticator Authenticator
+	authorizer    Authorizer[T]
+	filter        func(string) (func(T) bool, error)
+	limits        Limits
+	limiter       *rateLimiter
+	buffer        int
+	heartbeat     time.Duration
+	minHeartbeat  time.Duration
+	maxHeartbeat  time.Duration
+	renderError   func(w http.ResponseWriter, r *http.Request, code int, err error)
+
+	subsMtx sync.Mutex
+	subs    map[string]*subscription[T]
+	subsWG  sync.WaitGroup
+	usage   *usage
+
+	shutdown      chan struct{}
+	shutdownOnce  sync.Once
+	shutdownDelay time.Duration
 }
 
 // NewDefaultHandler calls NewHandler with the default [EncodeJSON] and [DecodeJSON]
 // functions, and logging to [io.Discard].
-func NewDefaultHandler[T any](broker *ps.Broker[T]) http.Handler {
+func NewDefaultHandler[T any](broker *ps.Broker[T]) *Handler[T] {
 	return NewHandler(broker, EncodeJSON[T], DecodeJSON[T], io.Discard)
 }
 
-// NewHandler constructs a new [http.Handler] wrapping the provided [ps.Broker].
-func NewHandler[T any](broker *ps.Broker[T], encode EncodeFunc[T], decode DecodeFunc[T], logs io.Writer) http.Handler {
-	h := &handler[T]{
-		broker: broker,
-		encode: encode,
-		decode: decode,
-		logger: log.New(logs, "pshttp.Handler: ", log.Lmsgprefix),
+// NewHandler calls [NewHandlerWithOptions] with the provided broker, encode
+// and decode functions, and log writer.
+func NewHandler[T any](broker *ps.Broker[T], encode EncodeFunc[T], decode DecodeFunc[T], logs io.Writer) *Handler[T] {
+	return NewHandlerWithOptions(broker, WithEncoding(encode, decode), WithLogs[T](logs))
+}
+
+// NewRegistryHandler calls [NewHandlerWithOptions] with the provided registry,
+// encode and decode functions, and log writer.
+func NewRegistryHandler[T any](registry *ps.Registry[T], encode EncodeFunc[T], decode DecodeFunc[T], logs io.Writer) *Handler[T] {
+	return NewHandlerWithOptions[T](nil, WithRegistry(registry), WithEncoding(encode, decode), WithLogs[T](logs))
+}
+
+// HandlerConfig enumerates the parameters for a handler returned by
+// [NewHandlerConfig]. Exactly one of Broker or Registry must be provided.
+type HandlerConfig[T any] struct {
+	// Broker is the pub/sub broker served by the handler.
+	Broker *ps.Broker[T]
+
+	// Registry serves many pub/sub brokers, one per topic. Topics are served
+	// under /topics/{topic}, and GET /topics lists every topic.
+	Registry *ps.Registry[T]
+
+	// Codecs are used to decode published values, and to encode values for
+	// subscribers. The codec for a published value is selected by the request
+	// Content-Type, and the codec for a subscription is selected by the media
+	// types in the request Accept header. Requests that don't specify a known
+	// media type use the first codec. Batch and streaming publish requests
+	// select a text codec by Content-Type in the same way, and NDJSON selects
+	// the JSON codec. Binary codecs can't be used for batch and streaming
+	// publish requests, which are rejected with 415 Unsupported Media Type.
+	//
+	// If empty, a single codec is constructed from Encode and Decode.
+	Codecs Codecs[T]
+
+	// Encode is used to encode values for subscribers when Codecs is empty. If
+	// nil, [EncodeJSON] is used.
+	Encode EncodeFunc[T]
+
+	// Decode is used to decode published values when Codecs is empty. If nil,
+	// [DecodeJSON] is used.
+	Decode DecodeFunc[T]
+
+	// Logs receives log output from the handler, as text-formatted records
+	// at info level and above. If nil, logs are discarded.
+	Logs io.Writer
+
+	// Logger, if non-nil, receives log output from the handler instead of
+	// Logs. Records have a component attribute, and per-request records also
+	// have remote_addr and, if authenticated, principal attributes.
+	// Subscriptions log a record when they start, and a record with their
+	// final stats, duration, and error when they end, both with a
+	// subscription_id attribute.
+	Logger *slog.Logger
+
+	// Authenticator, if non-nil, is used to authenticate every request.
+	// Requests that fail authentication receive 401 Unauthorized. If nil, all
+	// requests are served with an anonymous principal.
+	Authenticator Authenticator
+
+	// Authorizer, if non-nil, is consulted before publishing and subscribing,
+	// and for every value sent to a subscriber. Requests that fail
+	// authorization receive 403 Forbidden. If nil, everything is allowed.
+	Authorizer Authorizer[T]
+
+	// Filter, if non-nil, parses the filter query parameter of subscribe
+	// requests into an allow func for the subscription. Subscribe requests
+	// with an invalid filter receive 400 Bad Request. If nil, the filter query
+	// parameter is ignored.
+	Filter func(filter string) (allow func(T) bool, err error)
+
+	// Limits are enforced by the handler to protect it from misbehaving or
+	// abusive clients. By default, there are no limits.
+	Limits Limits
+
+	// Replaces, if non-nil, is a handler which is replaced by the new handler,
+	// e.g. on a config reload, but which may still serve subscriptions. The
+	// handlers share publish rate limits, which take the rate and burst of the
+	// new handler, and subscriptions served by either count toward the
+	// subscription limits of both.
+	Replaces *Handler[T]
+
+	// ShutdownDelay is the reconnect delay suggested to subscribers when the
+	// handler is shut down, see [Handler.Shutdown]. If zero, 5s is used.
+	ShutdownDelay time.Duration
+
+	// DefaultBuffer is the buffer of subscriptions which don't specify one via
+	// the buffer query parameter. It's clamped to the buffer bounds in Limits.
+	// If zero, 100 is used.
+	DefaultBuffer int
+
+	// DefaultHeartbeat is the heartbeat interval of subscriptions which don't
+	// specify a valid one via the heartbeat query parameter. Requested
+	// intervals must be between MinHeartbeat and MaxHeartbeat. If zero, they
+	// are 3s, 1s, and 60s respectively.
+	DefaultHeartbeat time.Duration
+	MinHeartbeat     time.Duration
+	MaxHeartbeat     time.Duration
+
+	// Prefix, if non-empty, is the path prefix of every route served by the
+	// handler, e.g. /pubsub serves POST /pubsub/ and GET /pubsub/.
+	Prefix string
+
+	// ErrorRenderer, if non-nil, writes error responses. If nil, errors are
+	// rendered as a JSON object with a single "error" field.
+	ErrorRenderer func(w http.ResponseWriter, r *http.Request, code int, err error)
+
+	// Middleware wraps the handler, outermost first. Middleware sees every
+	// request before authentication.
+	Middleware []func(http.Handler) http.Handler
+}
+
+// NewHandlerConfig constructs a new handler wrapping the configured
+// [ps.Broker] or [ps.Registry].
+func NewHandlerConfig[T any](config HandlerConfig[T]) *Handler[T] {
+	if len(config.Codecs) == 0 {
+		if config.Encode == nil && config.Decode == nil {
+			config.Codecs = Codecs[T]{JSONCodec[T]()}
+		} else {
+			if config.Encode == nil {
+				config.Encode = EncodeJSON[T]
+			}
+			if config.Decode == nil {
+				config.Decode = DecodeJSON[T]
+			}
+			config.Codecs = Codecs[T]{{Encode: config.Encode, Decode: config.Decode}}
+		}
+	}
+	if config.Logs == nil {
+		config.Logs = io.Discard
+	}
+	if config.Authorizer == nil {
+		config.Authorizer = AuthorizerFuncs[T]{}
+	}
+	if config.ShutdownDelay <= 0 {
+		config.ShutdownDelay = 5 * time.Second
+	}
+	if config.DefaultBuffer <= 0 {
+		config.DefaultBuffer = 100
 	}
+	if config.DefaultHeartbeat <= 0 {
+		config.DefaultHeartbeat = 3 * time.Second
+	}
+	if config.MinHeartbeat <= 0 {
+		config.MinHeartbeat = min(1*time.Second, config.DefaultHeartbeat)
+	}
+	if config.MaxHeartbeat <= 0 {
+		config.MaxHeartbeat = max(60*time.Second, config.DefaultHeartbeat)
+	}
+	if config.ErrorRenderer == nil {
+		config.ErrorRenderer = func(w http.ResponseWriter, _ *http.Request, code int, err error) { respondJSON(w, code, err) }
+	}
+	config.Prefix = strings.TrimRight(config.Prefix, "/")
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("POST /", h.handlePublish)
-	mux.HandleFunc("GET /", h.handleSubscribe)
-	h.Handler = mux
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(config.Logs, nil))
+	}
+
+	h := &Handler[T]{
+		broker:        config.Broker,
+		registry:      config.Registry,
+		codecs:        config.Codecs,
+		logger:        config.Logger.With("component", "pshttp.Handler"),
+		authenticator: config.Authenticator,
+		authorizer:    config.Authorizer,
+		filter:        config.Filter,
+		limits:        config.Limits,
+		limiter:       newRateLimiter(config.Limits.PublishRate, config.Limits.PublishBurst),
+		usage:         &usage{},
+		shutdown:      make(chan struct{}),
+		shutdownDelay: config.ShutdownDelay,
+		buffer:        config.DefaultBuffer,
+		heartbeat:     config.DefaultHeartbeat,
+		minHeartbeat:  config.MinHeartbeat,
+		maxHeartbeat:  config.MaxHeartbeat,
+		renderError:   config.ErrorRenderer,
+	}
+
+	if prev := config.Replaces; prev != nil {
+		h.limiter = prev.limiter.reconfigure(config.Limits.PublishRate, config.Limits.PublishBurst)
+		h.usage = prev.usage
+	}
+
+	var (
+		mux    = http.NewServeMux()
+		prefix = config.Prefix
+	)
+	if h.registry != nil {
+		mux.HandleFunc("GET "+prefix+"/topics", h.handleTopics)
+		mux.HandleFunc("POST "+prefix+"/topics/{topic}", h.handlePublish)
+		mux.HandleFunc("POST "+prefix+"/topics/{topic}/batch", h.handlePublishBatch)
+		mux.HandleFunc("POST "+prefix+"/topics/{topic}/stream", h.handlePublishStream)
+		mux.HandleFunc("GET "+prefix+"/topics/{topic}", h.handleSubscribe)
+	} else {
+		mux.HandleFunc("POST "+prefix+"/", h.handlePublish)
+		mux.HandleFunc("POST "+prefix+"/batch", h.handlePublishBatch)
+		mux.HandleFunc("POST "+prefix+"/stream", h.handlePublishStream)
+		mux.HandleFunc("GET "+prefix+"/", h.handleSubscribe)
+	}
+	h.mux = h.authenticate(mux)
+	for _, m := range slices.Backward(config.Middleware) {
+		h.mux = m(h.mux)
+	}
 
 	return h
 }
 
-func (h *handler[T]) handlePublish(w http.ResponseWriter, r *http.Request) {
+// Codecs returns the codecs used by the handler, in order of preference.
+func (h *Handler[T]) Codecs() Codecs[T] {
+	return slices.Clone(h.codecs)
+}
+
+// ServeHTTP implements [http.Handler].
+func (h *Handler[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler[T]) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizePublish(w, r) {
+		return
+	}
+
+	// Rate limits apply before the topic is acquired, so that rate limited
+	// clients can't create topics.
+	if !h.limitPublishRate(w, r, 1) {
+		return
+	}
+
+	broker, release, ok := h.acquireBroker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	body, err := io.ReadAll(h.limitPublishBody(w, r))
+	if err != nil {
+		h.respondReadError(w, r, err)
+		return
+	}
+
+	// CloudEvents in the binary content mode carry attributes in headers, so
+	// they're decoded separately from the codec.
 	var v T
-	if err := h.decode(r.Body, &v); err != nil {
-		respondJSON(w, http.StatusBadRequest, err)
+	if ce, ok := any(&v).(cloudEventBinary); ok && r.Header.Get("ce-specversion") != "" {
+		err = ce.decodeBinary(r.Header, body)
+	} else {
+		err = h.codecs.forContentType(r).Decode(bytes.NewReader(body), &v)
+	}
+	if err != nil {
+		h.respondError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	stats := h.broker.Publish(v)
+	var key string
+	if k := r.Header.Get(IdempotencyKeyHeader); k != "" {
+		// Keys are scoped to the principal, and hashed, because they're
+		// also the IDs of published values, which subscribers see.
+		principal, _ := PrincipalFromContext(r.Context())
+		sum := sha256.Sum256([]byte(principal.Name + "\x00" + k))
+		key = hex.EncodeToString(sum[:16])
+	}
+	stats, duplicate := broker.PublishKey(key, v)
+	h.requestLogger(r).Debug("publish", statsAttr(stats), "duplicate", duplicate)
+	if duplicate {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
 	respondJSON(w, http.StatusOK, stats)
 }
 
-func (h *handler[T]) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+func (h *Handler[T]) handleSubscribe(w http.ResponseWriter, r *http.Request) {
 	if !requestExplicitlyAccepts(r, "text/event-stream") {
-		respondJSON(w, http.StatusBadRequest, fmt.Errorf("request must accept: text/event-stream"))
+		h.respondError(w, r, http.StatusBadRequest, fmt.Errorf("request must accept: text/event-stream"))
 		return
 	}
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		respondJSON(w, http.StatusInternalServerError, fmt.Errorf("response writer must support flushing"))
+		h.respondError(w, r, http.StatusInternalServerError, fmt.Errorf("response writer must support flushing"))
+		return
+	}
+
+	principal, ok := h.authorizeSubscribe(w, r)
+	if !ok {
+		return
+	}
+
+	binary := r.URL.Query().Get("framing") == FramingBase64
+
+	ceBinary := r.URL.Query().Get("cloudevents") == CloudEventsBinary
+	if _, ok := any(new(T)).(cloudEventBinary); ceBinary && !ok {
+		h.respondError(w, r, http.StatusBadRequest, fmt.Errorf("values aren't CloudEvents"))
+		return
+	}
+
+	codec, err := h.codecs.forAccept(r, func(c Codec[T]) bool { return binary || !c.Binary })
+	if err != nil {
+		h.respondError(w, r, http.StatusNotAcceptable, err)
+		return
+	}
+
+	buffer, err := h.parseBuffer(r.URL.Query().Get("buffer"))
+	if err != nil {
+		h.respondError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	broker, release, ok := h.acquireBroker(w, r)
+	if !ok {
 		return
 	}
+	defer release()
 
 	var (
 		ctx       = r.Context()
-		logger    = log.New(h.logger.Writer(), h.logger.Prefix()+fmt.Sprintf("%s: ", r.RemoteAddr), h.logger.Flags())
-		buffer    = parseDefault(r.URL.Query().Get("buffer"), strconv.Atoi, 100)
-		heartbeat = parseDefault(r.URL.Query().Get("heartbeat"), parseDurationMinMax(1*time.Second, 60*time.Second), 3*time.Second)
+		logger    = h.requestLogger(r)
+		filter    = r.URL.Query().Get("filter")
+		heartbeat = parseDefault(r.URL.Query().Get("heartbeat"), parseDurationMinMax(h.minHeartbeat, h.maxHeartbeat), h.heartbeat)
 		c         = make(chan T, buffer)
+		ids       = make(chan string, buffer+1)
+		allow     = func(v T) bool { return h.authorizer.AllowValue(principal, v) }
 	)
 
-	if err := h.broker.SubscribeAll(c); err != nil {
-		respondJSON(w, http.StatusInternalServerError, fmt.Errorf("subscribe: %w", err))
+	if h.filter != nil && filter != "" {
+		filterAllow, err := h.filter(filter)
+		if err != nil {
+			h.respondError(w, r, http.StatusBadRequest, fmt.Errorf("invalid filter: %w", err))
+			return
+		}
+		allow = func(v T) bool { return h.authorizer.AllowValue(principal, v) && filterAllow(v) }
+	}
+
+	sub := &subscription[T]{
+		info: SubscriptionInfo{
+			Topic:       r.PathValue("topic"),
+			RemoteAddr:  r.RemoteAddr,
+			Principal:   principal.Name,
+			Filter:      filter,
+			Codec:       codec.MediaType,
+			Buffer:      buffer,
+			ConnectedAt: time.Now().UTC(),
+		},
+		addr:   remoteHost(r),
+		broker: broker,
+		c:      c,
+		done:   make(chan struct{}),
+	}
+
+	remove, err := h.addSubscription(sub)
+	if err != nil {
+		logger.Warn("subscribe rejected", "error", err)
+	}
+	switch {
+	case errors.Is(err, errShuttingDown):
+		w.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(h.shutdownDelay.Seconds()))))
+		h.respondError(w, r, http.StatusServiceUnavailable, err)
+		return
+	case errors.Is(err, errTooManySubscriptions):
+		w.Header().Set("retry-after", "5")
+		h.respondError(w, r, http.StatusServiceUnavailable, err)
+		return
+	case errors.Is(err, errTooManySubscriptionsPerAddr):
+		h.respondError(w, r, http.StatusTooManyRequests, err)
 		return
 	}
+	defer remove()
+
+	lastID := r.Header.Get("Last-Event-ID")
+	replay, resumed, err := broker.Resume(c, ids, allow, lastID)
+	if err != nil {
+		h.respondError(w, r, http.StatusInternalServerError, fmt.Errorf("subscribe: %w", err))
+		return
+	}
+	var (
+		start       = time.Now()
+		unsubscribe = sync.OnceValues(func() (ps.Stats, error) { return broker.Unsubscribe(c) })
+		reason      error // why the subscription ended
+	)
+	logger = logger.With("subscription_id", sub.info.ID)
 	defer func() {
-		stats, err := h.broker.Unsubscribe(c)
-		logger.Printf("unsubscribe: %v (err: %v)", stats, err)
+		stats, err := unsubscribe()
+		level := slog.LevelInfo
+		if err != nil || !isExpectedSubscriptionEnd(reason) {
+			level = slog.LevelWarn
+		}
+		logger.Log(ctx, level, "unsubscribe",
+			statsAttr(stats),
+			"duration", time.Since(start),
+			"error", errors.Join(reason, err),
+		)
 	}()
 
-	logger.Printf("subscribe: buffer=%d heartbeat=%v", buffer, heartbeat)
+	logger.Info("subscribe",
+		"topic", sub.info.Topic,
+		"filter", filter,
+		"codec", codec.MediaType,
+		"binary", binary,
+		"cloudevents_binary", ceBinary,
+		"buffer", buffer,
+		"heartbeat", heartbeat,
+		"last_event_id", lastID,
+		"resumed", resumed,
+		"replay", len(replay),
+	)
 
 	heartbeats := time.NewTicker(heartbeat)
 	defer heartbeats.Stop()
 
 	eventsource.Handler(func(_ string, enc *eventsource.Encoder, stop <-chan bool) {
-		err := func() error {
-			var buf bytes.Buffer
+		flusher.Flush() // send headers immediately, so the client sees it's connected
+
+		var buf bytes.Buffer
+		send := func(id string, v T) error {
+			ev := eventsource.Event{Type: EventTypeData}
+			if validEventID(id) {
+				ev.ID = id
+			}
+			if ceBinary {
+				attrs, data, err := any(&v).(cloudEventBinary).encodeBinary()
+				if err != nil {
+					return fmt.Errorf("encode CloudEvent data: %w", err)
+				}
+				attrsData, err := json.Marshal(attrs)
+				if err != nil {
+					return fmt.Errorf("marshal CloudEvent attributes: %w", err)
+				}
+				if err := enc.Encode(eventsource.Event{Type: EventTypeCloudEventAttributes, Data: attrsData}); err != nil {
+					return fmt.Errorf("encode attributes event: %w", err)
+				}
+				ev.Data = data
+			} else {
+				buf.Reset()
+				if err := codec.Encode(v, &buf); err != nil {
+					return fmt.Errorf("encode value: %w", err)
+				}
+				ev.Data = buf.Bytes()
+			}
+			if binary || ceBinary && !validEventData(ev.Data) {
+				ev.Type = EventTypeBinaryData
+				ev.Data = base64.StdEncoding.AppendEncode(nil, ev.Data)
+			}
+			if err := enc.Encode(ev); err != nil {
+				return fmt.Errorf("encode data event: %w", err)
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		reason = func() error {
+			for _, m := range replay {
+				if err := send(m.ID, m.Value); err != nil {
+					return err
+				}
+			}
+
 			for {
 				select {
 				case v := <-c:
-					buf.Reset()
-					if err := h.encode(v, &buf); err != nil {
-						return fmt.Errorf("encode value: %w", err)
-					}
-					if err := enc.Encode(eventsource.Event{
-						Type: EventTypeData,
-						Data: buf.Bytes(),
-					}); err != nil {
-						return fmt.Errorf("encode data event: %w", err)
+					if err := send(<-ids, v); err != nil {
+						return err
 					}
-					flusher.Flush()
 
 				case ts := <-heartbeats.C:
 					ev := HeartbeatEvent{
 						Timestamp: ts,
 					}
-					if stats, err := h.broker.Stats(c); err == nil {
+					if stats, err := broker.Stats(c); err == nil {
 						ev.Stats = stats
 					} else {
 						ev.Error = err.Error()
@@ -129,13 +551,211 @@ func (h *handler[T]) handleSubscribe(w http.ResponseWriter, r *http.Request) {
 					flusher.Flush()
 
 				case <-stop:
-					return fmt.Errorf("stop signaled")
+					return errSubscriberStopped
+
+				case <-sub.done:
+					return errSubscriptionDisconnected
+
+				case <-h.shutdown:
+					// Stop receiving new values, send the values that are
+					// already buffered, and then tell the subscriber when
+					// to reconnect.
+					stats, _ := unsubscribe()
+					for len(c) > 0 {
+						v := <-c
+						if err := send(<-ids, v); err != nil {
+							return err
+						}
+					}
+					data, err := json.Marshal(ShutdownEvent{
+						Timestamp:    time.Now().UTC(),
+						RetryAfterMs: h.shutdownDelay.Milliseconds(),
+						Stats:        stats,
+					})
+					if err != nil {
+						return fmt.Errorf("marshal shutdown event: %w", err)
+					}
+					if err := enc.Encode(eventsource.Event{
+						Type:  EventTypeShutdown,
+						Retry: strconv.FormatInt(h.shutdownDelay.Milliseconds(), 10),
+						Data:  data,
+					}); err != nil {
+						return fmt.Errorf("encode shutdown event: %w", err)
+					}
+					flusher.Flush()
+					return errShuttingDown
 
 				case <-ctx.Done():
 					return ctx.Err()
 				}
 			}
 		}()
-		logger.Printf("handler exiting (err: %v)", err)
 	}).ServeHTTP(w, r)
 }
+
+// authenticate wraps next, and authenticates every request with the
+// configured authenticator, if any. The principal is stored in the request
+// context.
+func (h *Handler[T]) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var principal Principal
+		if h.authenticator != nil {
+			p, err := h.authenticator.Authenticate(r)
+			if err != nil {
+				h.requestLogger(r).Warn("authenticate", "error", err)
+				h.respondError(w, r, http.StatusUnauthorized, ErrUnauthenticated)
+				return
+			}
+			principal = p
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
+	})
+}
+
+func (h *Handler[T]) authorizePublish(w http.ResponseWriter, r *http.Request) bool {
+	principal, _ := PrincipalFromContext(r.Context())
+	if err := h.authorizer.AuthorizePublish(principal, r); err != nil {
+		h.requestLogger(r).Warn("authorize publish", "error", err)
+		h.respondError(w, r, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+func (h *Handler[T]) authorizeSubscribe(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	principal, _ := PrincipalFromContext(r.Context())
+	if err := h.authorizer.AuthorizeSubscribe(principal, r); err != nil {
+		h.requestLogger(r).Warn("authorize subscribe", "error", err)
+		h.respondError(w, r, http.StatusForbidden, err)
+		return Principal{}, false
+	}
+	return principal, true
+}
+
+func (h *Handler[T]) handleTopics(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.authorizeSubscribe(w, r); !ok {
+		return
+	}
+	respondJSON(w, http.StatusOK, h.registry.Topics())
+}
+
+// acquireBroker returns the broker targeted by the request, and a func that
+// must be called when the broker is no longer used. If the broker can't be
+// acquired, it writes an error response and returns false.
+func (h *Handler[T]) acquireBroker(w http.ResponseWriter, r *http.Request) (*ps.Broker[T], func(), bool) {
+	if h.registry == nil {
+		return h.broker, func() {}, true
+	}
+
+	broker, release, err := h.registry.Acquire(r.PathValue("topic"))
+	if err != nil {
+		h.respondError(w, r, http.StatusNotFound, err)
+		return nil, nil, false
+	}
+
+	return broker, release, true
+}
+
+// parseBuffer parses the buffer query parameter of a subscribe request. Invalid
+// or missing values use the default, and valid values must be within the
+// configured limits.
+func (h *Handler[T]) parseBuffer(s string) (int, error) {
+	var (
+		lo  = max(h.limits.MinBuffer, 0)
+		hi  = h.limits.MaxBuffer
+		def = max(h.buffer, lo)
+	)
+	if hi > 0 {
+		def = min(def, hi)
+	}
+
+	buffer := parseDefault(s, strconv.Atoi, def)
+	if buffer < lo || (hi > 0 && buffer > hi) {
+		return 0, fmt.Errorf("buffer must be between %d and %d", lo, hi)
+	}
+
+	return buffer, nil
+}
+
+// limitPublishBody limits the size of the publish request body, if configured.
+func (h *Handler[T]) limitPublishBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	if h.limits.MaxPublishBytes <= 0 {
+		return r.Body
+	}
+	return http.MaxBytesReader(w, r.Body, h.limits.MaxPublishBytes)
+}
+
+// limitPublishRate takes n values from the client's publish rate limit, if
+// configured. If the client is over the limit, it writes an error response and
+// returns false.
+func (h *Handler[T]) limitPublishRate(w http.ResponseWriter, r *http.Request, n int) bool {
+	return h.respondRateLimited(w, r, n, h.limiter.take(clientKey(r), n))
+}
+
+// checkPublishRate is like limitPublishRate, but doesn't take from the
+// client's publish rate limit.
+func (h *Handler[T]) checkPublishRate(w http.ResponseWriter, r *http.Request, n int) bool {
+	return h.respondRateLimited(w, r, n, h.limiter.peek(clientKey(r), n))
+}
+
+// respondRateLimited responds with 429 Too Many Requests and returns false if
+// the delay is positive.
+func (h *Handler[T]) respondRateLimited(w http.ResponseWriter, r *http.Request, n int, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	h.requestLogger(r).Debug("publish rate limited", "values", n, "delay", delay)
+	w.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	h.respondError(w, r, http.StatusTooManyRequests, fmt.Errorf("publish rate limit exceeded"))
+	return false
+}
+
+// waitPublishRate waits until n values can be taken from the client's publish
+// rate limit, if configured, or the request is canceled.
+func (h *Handler[T]) waitPublishRate(r *http.Request, n int) error {
+	for {
+		delay := h.limiter.take(clientKey(r), n)
+		if delay <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// respondError writes an error response with the configured error renderer.
+func (h *Handler[T]) respondError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	h.renderError(w, r, code, err)
+}
+
+// respondReadError writes an error response for a failure to read a publish
+// request body.
+func (h *Handler[T]) respondReadError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		h.respondError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBytesErr.Limit))
+		return
+	}
+	h.respondError(w, r, http.StatusBadRequest, fmt.Errorf("read body: %w", err))
+}
+
+func (h *Handler[T]) requestLogger(r *http.Request) *slog.Logger {
+	logger := h.logger.With("remote_addr", r.RemoteAddr)
+	if principal, ok := PrincipalFromContext(r.Context()); ok && principal.Name != "" {
+		logger = logger.With("principal", principal.Name)
+	}
+	return logger
+}
+
+// isExpectedSubscriptionEnd returns true if a subscription ended for a normal
+// reason, like the subscriber going away, rather than due to an error.
+func isExpectedSubscriptionEnd(reason error) bool {
+	return reason == nil ||
+		errors.Is(reason, context.Canceled) ||
+		errors.Is(reason, errSubscriberStopped) ||
+		errors.Is(reason, errSubscriptionDisconnected) ||
+		errors.Is(reason, errShuttingDown)
+}
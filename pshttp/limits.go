@@ -0,0 +1,205 @@
+package pshttp
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits enumerates resource limits enforced by a handler, to protect it from
+// misbehaving or abusive clients. Zero values mean no limit.
+type Limits struct {
+	// MinBuffer and MaxBuffer bound the buffer query parameter of subscribe
+	// requests. Requests with a buffer outside of the bounds receive 400 Bad
+	// Request. The default buffer is clamped to the bounds.
+	MinBuffer int
+	MaxBuffer int
+
+	// MaxSubscriptions is the maximum number of concurrent subscriptions.
+	// Subscribe requests beyond the limit receive 503 Service Unavailable.
+	MaxSubscriptions int
+
+	// MaxSubscriptionsPerAddr is the maximum number of concurrent
+	// subscriptions from a single remote address. Subscribe requests beyond
+	// the limit receive 429 Too Many Requests.
+	MaxSubscriptionsPerAddr int
+
+	// MaxPublishBytes is the maximum size of the body of publish and batch
+	// publish requests, and of each value in a streaming publish. Requests
+	// beyond the limit receive 413 Request Entity Too Large.
+	MaxPublishBytes int64
+
+	// PublishRate is the maximum number of values per second that can be
+	// published by a single client, identified by principal name if the
+	// request is authenticated, or by remote address otherwise. Publish
+	// requests beyond the limit receive 429 Too Many Requests, and streaming
+	// publishes are slowed down.
+	PublishRate float64
+
+	// PublishBurst is the number of values a client can publish at once,
+	// beyond the publish rate. If zero, it's the publish rate, rounded up.
+	PublishBurst int
+}
+
+// clientKey identifies the client making the request, for rate limiting.
+func clientKey(r *http.Request) string {
+	if principal, ok := PrincipalFromContext(r.Context()); ok && principal.Name != "" {
+		return "principal:" + principal.Name
+	}
+	return "addr:" + remoteHost(r)
+}
+
+// remoteHost returns the host part of the request remote address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// usage counts the subscriptions of one or more handlers, which share their
+// subscription limits, see [HandlerConfig.Replaces].
+type usage struct {
+	mtx    sync.Mutex
+	subs   int
+	byAddr map[string]int
+}
+
+// add counts a new subscription from the given address, unless it would
+// exceed the limits.
+func (u *usage) add(addr string, limits Limits) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	if n := limits.MaxSubscriptions; n > 0 && u.subs >= n {
+		return errTooManySubscriptions
+	}
+
+	if n := limits.MaxSubscriptionsPerAddr; n > 0 && u.byAddr[addr] >= n {
+		return errTooManySubscriptionsPerAddr
+	}
+
+	if u.byAddr == nil {
+		u.byAddr = map[string]int{}
+	}
+	u.subs++
+	u.byAddr[addr]++
+	return nil
+}
+
+// remove stops counting a subscription from the given address.
+func (u *usage) remove(addr string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	u.subs--
+	if u.byAddr[addr]--; u.byAddr[addr] <= 0 {
+		delete(u.byAddr, addr)
+	}
+}
+
+// rateLimiter is a set of token buckets, keyed by client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mtx     sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		swept:   time.Now(),
+	}
+}
+
+// reconfigure returns a rate limiter with the given rate and burst, which
+// keeps the buckets of l, if any, so clients don't get a fresh budget. The
+// new rate and burst also apply to l.
+func (l *rateLimiter) reconfigure(rate float64, burst int) *rateLimiter {
+	next := newRateLimiter(rate, burst)
+	if l == nil || next == nil {
+		return next
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.rate, l.burst = next.rate, next.burst
+	return l
+}
+
+// take n tokens from the bucket for the given key. If there aren't enough
+// tokens, nothing is taken, and take returns how long until there will be.
+// Requests for more tokens than the burst are allowed when the bucket is full,
+// and leave the bucket in debt.
+func (l *rateLimiter) take(key string, n int) time.Duration {
+	return l.reserve(key, n, true)
+}
+
+// peek returns how long until n tokens can be taken from the bucket for the
+// given key, without taking them.
+func (l *rateLimiter) peek(key string, n int) time.Duration {
+	return l.reserve(key, n, false)
+}
+
+func (l *rateLimiter) reserve(key string, n int, take bool) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.rate, l.burst)
+	b.last = now
+
+	need := min(float64(n), l.burst)
+	if b.tokens < need {
+		return time.Duration((need - b.tokens) / l.rate * float64(time.Second))
+	}
+
+	if take {
+		b.tokens -= float64(n)
+	}
+	return 0
+}
+
+// sweep removes buckets that would be full, so they don't accumulate.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,199 @@
+package pshttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// MirrorStats describes the upstream subscription of a [Mirror].
+type MirrorStats struct {
+	// State of the upstream connection.
+	State ConnState `json:"state"`
+
+	// Since is when the upstream connection entered its current state.
+	Since time.Time `json:"since"`
+
+	// Error is the error that caused the most recent disconnect, if any.
+	Error string `json:"error,omitempty"`
+
+	// Connects is the number of times the upstream connection has been
+	// established.
+	Connects uint64 `json:"connects"`
+
+	// Received are values received from the remote broker.
+	Received uint64 `json:"received"`
+
+	// Published is the sum of the stats of publishing received values to the
+	// local broker.
+	Published ps.Stats `json:"published"`
+
+	// Heartbeat is the most recent heartbeat from the remote handler. Its
+	// stats describe the upstream subscription on the remote broker, so e.g.
+	// drops are values the remote broker couldn't send to the mirror.
+	Heartbeat HeartbeatEvent `json:"heartbeat"`
+}
+
+// MirrorConfig enumerates the parameters for a mirror returned by
+// [NewMirror]. Client is required.
+type MirrorConfig[T any] struct {
+	// Client of the remote broker, or topic of a remote registry.
+	Client *Client[T]
+
+	// Broker receives every value from the remote broker. If nil, a new
+	// broker is constructed.
+	Broker *ps.Broker[T]
+
+	// Subscribe configures the upstream subscription. OnStateChange and
+	// OnHeartbeat, if non-nil, are called after the mirror records the state
+	// change or heartbeat.
+	Subscribe SubscribeConfig
+
+	// Buffer between the upstream subscription and the local broker. If
+	// zero, 100 is used.
+	Buffer int
+
+	// Logger receives log output from the mirror. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+}
+
+// Mirror maintains a single subscription to a remote broker, and republishes
+// every received value into a local [ps.Broker]. Local subscribers share the
+// upstream connection, instead of each opening their own.
+type Mirror[T any] struct {
+	client    *Client[T]
+	broker    *ps.Broker[T]
+	subscribe SubscribeConfig
+	buffer    int
+	logger    *slog.Logger
+
+	mtx   sync.Mutex
+	stats MirrorStats
+}
+
+// NewMirror returns a new mirror of the remote broker. The mirror doesn't
+// subscribe until Run is called.
+func NewMirror[T any](config MirrorConfig[T]) (*Mirror[T], error) {
+	if config.Client == nil {
+		return nil, errors.New("client is required")
+	}
+	if config.Broker == nil {
+		config.Broker = ps.NewBroker[T]()
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 100
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return &Mirror[T]{
+		client:    config.Client,
+		broker:    config.Broker,
+		subscribe: config.Subscribe,
+		buffer:    config.Buffer,
+		logger:    config.Logger.With("component", "pshttp.Mirror", "uri", redactURI(config.Client.uri)),
+		stats:     MirrorStats{State: StateDisconnected, Since: time.Now()},
+	}, nil
+}
+
+// Broker returns the local broker. Subscribe to it to receive values from the
+// remote broker.
+func (m *Mirror[T]) Broker() *ps.Broker[T] {
+	return m.broker
+}
+
+// Run subscribes to the remote broker, and publishes every received value to
+// the local broker. Interrupted connections are re-established according to
+// the reconnect policy of the subscription. Run blocks until the context is
+// canceled, the reconnect policy gives up, or a fatal error occurs, and
+// returns the corresponding error.
+func (m *Mirror[T]) Run(ctx context.Context) error {
+	config := m.subscribe
+	config.OnStateChange = func(state ConnState, err error) {
+		m.mtx.Lock()
+		m.stats.State, m.stats.Since = state, time.Now()
+		switch {
+		case state == StateConnected:
+			m.stats.Connects++
+		case err != nil:
+			m.stats.Error = err.Error()
+		}
+		m.mtx.Unlock()
+
+		switch {
+		case state == StateConnected:
+			m.logger.Info("connected")
+		case err != nil && ctx.Err() == nil:
+			m.logger.Warn(state.String(), "error", err)
+		}
+
+		if m.subscribe.OnStateChange != nil {
+			m.subscribe.OnStateChange(state, err)
+		}
+	}
+	config.OnHeartbeat = func(ev HeartbeatEvent) {
+		m.mtx.Lock()
+		m.stats.Heartbeat = ev
+		m.mtx.Unlock()
+
+		if m.subscribe.OnHeartbeat != nil {
+			m.subscribe.OnHeartbeat(ev)
+		}
+	}
+
+	var (
+		c    = make(chan T, m.buffer)
+		errc = make(chan error, 1)
+	)
+	go func() {
+		errc <- m.client.SubscribeConfig(ctx, c, config)
+	}()
+
+	for {
+		select {
+		case v := <-c:
+			m.publish(v)
+
+		case err := <-errc:
+			for len(c) > 0 {
+				m.publish(<-c)
+			}
+			return err
+		}
+	}
+}
+
+func (m *Mirror[T]) publish(v T) {
+	stats := m.broker.Publish(v)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.stats.Received++
+	m.stats.Published.Skips += stats.Skips
+	m.stats.Published.Sends += stats.Sends
+	m.stats.Published.Drops += stats.Drops
+}
+
+// Stats returns the current state and stats of the mirror.
+func (m *Mirror[T]) Stats() MirrorStats {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.stats
+}
+
+// redactURI replaces any password in the URI with "xxxxx".
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,223 @@
+package pshttp
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// HandlerOption configures a handler constructed by [NewHandlerWithOptions].
+// Options are typed by the value type T of the handler, so mismatched options
+// don't compile.
+type HandlerOption[T any] func(*handlerOptions[T])
+
+type handlerOptions[T any] struct {
+	config HandlerConfig[T]
+	buffer *[2]int // min, max, see WithBuffer
+}
+
+// NewHandlerWithOptions constructs a new handler wrapping the given broker,
+// configured by the options. It's equivalent to [NewHandlerConfig] with the
+// corresponding fields of [HandlerConfig] set. If [WithRegistry] is provided,
+// broker should be nil. The order of options doesn't matter, except that
+// later options replace earlier options of the same kind.
+func NewHandlerWithOptions[T any](broker *ps.Broker[T], options ...HandlerOption[T]) *Handler[T] {
+	o := handlerOptions[T]{config: HandlerConfig[T]{Broker: broker}}
+	for _, option := range options {
+		option(&o)
+	}
+
+	if o.buffer != nil {
+		o.config.Limits.MinBuffer, o.config.Limits.MaxBuffer = o.buffer[0], o.buffer[1]
+	}
+
+	return NewHandlerConfig(o.config)
+}
+
+// WithLogs sets the writer which receives log output from the handler.
+func WithLogs[T any](logs io.Writer) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Logs = logs }
+}
+
+// WithLogger sets the structured logger which receives log output from the
+// handler. It takes precedence over [WithLogs].
+func WithLogger[T any](logger *slog.Logger) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Logger = logger }
+}
+
+// WithAuthenticator sets the authenticator used for every request.
+func WithAuthenticator[T any](authenticator Authenticator) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Authenticator = authenticator }
+}
+
+// WithLimits sets the resource limits enforced by the handler. Buffer bounds
+// set by [WithBuffer] take precedence over the buffer bounds of the limits,
+// regardless of the order of the options.
+func WithLimits[T any](limits Limits) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Limits = limits }
+}
+
+// WithShutdownDelay sets the reconnect delay suggested to subscribers when the
+// handler is shut down.
+func WithShutdownDelay[T any](delay time.Duration) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.ShutdownDelay = delay }
+}
+
+// WithBuffer sets the default buffer of subscriptions, and the bounds of
+// buffers requested by subscribers. A zero bound means no bound.
+func WithBuffer[T any](def, min, max int) HandlerOption[T] {
+	return func(o *handlerOptions[T]) {
+		o.config.DefaultBuffer = def
+		o.buffer = &[2]int{min, max}
+	}
+}
+
+// WithHeartbeat sets the default heartbeat interval of subscriptions, and the
+// bounds of intervals requested by subscribers.
+func WithHeartbeat[T any](def, min, max time.Duration) HandlerOption[T] {
+	return func(o *handlerOptions[T]) {
+		o.config.DefaultHeartbeat, o.config.MinHeartbeat, o.config.MaxHeartbeat = def, min, max
+	}
+}
+
+// WithPrefix sets the path prefix of every route served by the handler.
+func WithPrefix[T any](prefix string) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Prefix = prefix }
+}
+
+// WithErrorRenderer sets the func which writes error responses.
+func WithErrorRenderer[T any](render func(w http.ResponseWriter, r *http.Request, code int, err error)) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.ErrorRenderer = render }
+}
+
+// WithMiddleware wraps the handler with the given middleware, outermost
+// first. It may be provided more than once.
+func WithMiddleware[T any](middleware ...func(http.Handler) http.Handler) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Middleware = append(o.config.Middleware, middleware...) }
+}
+
+// WithRegistry serves every broker in the registry, rather than a single
+// broker.
+func WithRegistry[T any](registry *ps.Registry[T]) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Registry = registry }
+}
+
+// WithCodecs sets the codecs used by the handler, in order of preference.
+func WithCodecs[T any](codecs ...Codec[T]) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Codecs = codecs }
+}
+
+// WithEncoding sets the encode and decode functions used by the handler, as a
+// single codec with no media type.
+func WithEncoding[T any](encode EncodeFunc[T], decode DecodeFunc[T]) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Encode, o.config.Decode = encode, decode }
+}
+
+// WithAuthorizer sets the authorizer consulted for every publish, subscribe,
+// and value sent to a subscriber.
+func WithAuthorizer[T any](authorizer Authorizer[T]) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Authorizer = authorizer }
+}
+
+// WithFilter sets the func which parses the filter query parameter of
+// subscribe requests.
+func WithFilter[T any](filter func(filter string) (allow func(T) bool, err error)) HandlerOption[T] {
+	return func(o *handlerOptions[T]) { o.config.Filter = filter }
+}
+
+// ClientOption configures a client constructed by [NewClientWithOptions].
+// Options are typed by the value type T of the client, so mismatched options
+// don't compile.
+type ClientOption[T any] func(*clientOptions[T])
+
+type clientOptions[T any] struct {
+	client    *http.Client
+	codec     Codec[T]
+	header    http.Header
+	reconnect ReconnectPolicy
+	retry     ReconnectPolicy
+	buffer    int
+	heartbeat time.Duration
+}
+
+// NewClientWithOptions constructs a new client targeting the given URI,
+// configured by the options. By default, the client uses [http.DefaultClient]
+// and the [JSONCodec].
+func NewClientWithOptions[T any](uri string, options ...ClientOption[T]) (*Client[T], error) {
+	o := clientOptions[T]{
+		client: http.DefaultClient,
+		codec:  JSONCodec[T](),
+	}
+	for _, option := range options {
+		option(&o)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URI: %w", err)
+	}
+
+	return &Client[T]{
+		client:    o.client,
+		uri:       u.String(),
+		codec:     o.codec,
+		header:    o.header,
+		reconnect: o.reconnect,
+		retry:     o.retry,
+		buffer:    o.buffer,
+		heartbeat: o.heartbeat,
+	}, nil
+}
+
+// WithHTTPClient sets the HTTP client used to make requests.
+func WithHTTPClient[T any](client *http.Client) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.client = client }
+}
+
+// WithClientCodec sets the codec used by the client. Its media type is
+// advertised to the server, see [NewCodecClient].
+func WithClientCodec[T any](codec Codec[T]) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.codec = codec }
+}
+
+// WithHeader adds a header to every request made by the client, e.g. an
+// Authorization header. It may be provided more than once.
+func WithHeader[T any](key, value string) ClientOption[T] {
+	return func(o *clientOptions[T]) {
+		if o.header == nil {
+			o.header = http.Header{}
+		}
+		o.header.Add(key, value)
+	}
+}
+
+// WithReconnect sets the default reconnect policy of subscriptions, see
+// [SubscribeConfig.Reconnect].
+func WithReconnect[T any](policy ReconnectPolicy) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.reconnect = policy }
+}
+
+// WithPublishRetry sets the policy which decides if and when to retry failed
+// publish requests, see [Client.PublishKey]. With a retry policy, every value
+// is published with an idempotency key, so retries don't publish values twice.
+// By default, publish requests aren't retried.
+func WithPublishRetry[T any](policy ReconnectPolicy) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.retry = policy }
+}
+
+// WithSubscribeBuffer sets the default buffer requested by subscriptions, see
+// [SubscribeConfig.Buffer].
+func WithSubscribeBuffer[T any](buffer int) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.buffer = buffer }
+}
+
+// WithSubscribeHeartbeat sets the default heartbeat interval requested by
+// subscriptions, see [SubscribeConfig.Heartbeat].
+func WithSubscribeHeartbeat[T any](heartbeat time.Duration) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.heartbeat = heartbeat }
+}
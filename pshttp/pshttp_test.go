@@ -1,9 +1,23 @@
 package pshttp_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -91,17 +105,2306 @@ func TestBasics(t *testing.T) {
 	recvAndCheck(v2, 0)
 }
 
+func TestReconnect(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandler(broker, pshttp.EncodeJSON, pshttp.DecodeJSON, newTestWriter(t))
+
+	var failures atomic.Int64
+	failures.Store(3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := failures.Add(-1); {
+		case n == 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case n >= 0:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var (
+		mtx    sync.Mutex
+		states []pshttp.ConnState
+	)
+	config := pshttp.SubscribeConfig{
+		Reconnect: &pshttp.ExponentialBackoff{Initial: 10 * time.Millisecond, Jitter: 0.5},
+		OnStateChange: func(state pshttp.ConnState, err error) {
+			t.Logf("state: %v (err: %v)", state, err)
+			mtx.Lock()
+			defer mtx.Unlock()
+			states = append(states, state)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		begin = time.Now()
+		valc  = make(chan int64, 1)
+		errc  = make(chan error, 1)
+	)
+	go func() { errc <- client.SubscribeConfig(ctx, valc, config) }()
+
+	for broker.Publish(123).Sends == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if want, have := time.Second, time.Since(begin); have < want {
+		t.Errorf("Retry-After not honored: connected after %v", have)
+	}
+
+	select {
+	case v := <-valc:
+		if want, have := int64(123), v; want != have {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for value")
+	}
+
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("want %v, have %v", context.Canceled, err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	want := []pshttp.ConnState{
+		pshttp.StateConnecting, pshttp.StateDisconnected,
+		pshttp.StateConnecting, pshttp.StateDisconnected,
+		pshttp.StateConnecting, pshttp.StateDisconnected,
+		pshttp.StateConnecting, pshttp.StateConnected,
+		pshttp.StateDisconnected,
+	}
+	if !slices.Equal(want, states) {
+		t.Errorf("states: want %v, have %v", want, states)
+	}
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var gaveUp atomic.Bool
+	err = client.SubscribeConfig(context.Background(), make(chan int64), pshttp.SubscribeConfig{
+		Reconnect: &pshttp.ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 3},
+		OnStateChange: func(state pshttp.ConnState, err error) {
+			if state == pshttp.StateGaveUp {
+				gaveUp.Store(true)
+			}
+		},
+	})
+
+	var statusErr *pshttp.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("want status error, have %v", err)
+	}
+	if want, have := int64(4), requests.Load(); want != have {
+		t.Errorf("requests: want %d, have %d", want, have)
+	}
+	if !gaveUp.Load() {
+		t.Errorf("expected %v state", pshttp.StateGaveUp)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	policy := &pshttp.ExponentialBackoff{
+		Initial:    100 * time.Millisecond,
+		Max:        time.Second,
+		Jitter:     0.5,
+		MaxElapsed: time.Minute,
+	}
+
+	for attempt, nominal := range []time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		6: time.Second,
+	} {
+		if attempt == 0 {
+			continue
+		}
+		delay, ok := policy.Next(attempt, 0, nil)
+		if !ok {
+			t.Fatalf("attempt %d: unexpected give up", attempt)
+		}
+		if delay < nominal/2 || delay > nominal {
+			t.Errorf("attempt %d: delay %v outside of [%v, %v]", attempt, delay, nominal/2, nominal)
+		}
+	}
+
+	if _, ok := policy.Next(1, time.Minute, nil); ok {
+		t.Errorf("expected give up after max elapsed")
+	}
+
+	delays := map[time.Duration]bool{}
+	for range 10 {
+		delay, _ := (&pshttp.ExponentialBackoff{}).Next(1, 0, nil)
+		if delay < 800*time.Millisecond || delay > time.Second {
+			t.Errorf("default jitter: delay %v outside of [800ms, 1s]", delay)
+		}
+		delays[delay] = true
+	}
+	if len(delays) < 2 {
+		t.Errorf("default jitter: want varying delays, have %v", delays)
+	}
+
+	for range 10 {
+		if delay, _ := (&pshttp.ExponentialBackoff{Jitter: -1}).Next(1, 0, nil); delay != time.Second {
+			t.Errorf("no jitter: want %v, have %v", time.Second, delay)
+		}
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandler(broker, pshttp.EncodeJSON, pshttp.DecodeJSON, newTestWriter(t))
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	c := make(chan int64, 10)
+	broker.Subscribe(c, func(v int64) bool { return v%2 == 0 })
+
+	result, err := client.PublishBatch(ctx, []int64{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("publish batch: %v", err)
+	}
+	if want, have := (ps.Stats{Skips: 2, Sends: 2}), result.Stats; want != have {
+		t.Errorf("stats: want %v, have %v", want, have)
+	}
+	if want, have := 4, len(result.Items); want != have {
+		t.Fatalf("items: want %d, have %d", want, have)
+	}
+	if want, have := (ps.Stats{Sends: 1}), result.Items[1].Stats; want != have {
+		t.Errorf("item 1 stats: want %v, have %v", want, have)
+	}
+	if want, have := int64(2), <-c; want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := int64(4), <-c; want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	resp, err := http.Post(server.URL+"/batch", "application/json", strings.NewReader(`[6, "x", 8]`))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var array pshttp.BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&array); err != nil {
+		t.Fatalf("decode result: %v", err)
+	}
+	if want, have := (ps.Stats{Sends: 2}), array.Stats; want != have {
+		t.Errorf("stats: want %v, have %v", want, have)
+	}
+	if len(array.Items) != 3 || array.Items[1].Error == "" {
+		t.Errorf("expected decode error for item 1, have %+v", array.Items)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandler(broker, pshttp.EncodeJSON, pshttp.DecodeJSON, newTestWriter(t))
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	c := make(chan int64, 1000)
+	broker.SubscribeAll(c)
+
+	publisher, err := client.NewPublisher(ctx, pshttp.PublisherConfig{Interval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("create publisher: %v", err)
+	}
+
+	for i := range int64(10) {
+		if err := publisher.Publish(ctx, i); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	if err := publisher.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	for i := range int64(10) {
+		select {
+		case v := <-c:
+			if want, have := i, v; want != have {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for value %d", i)
+		}
+	}
+
+	for i := range int64(90) {
+		if err := publisher.Publish(ctx, 10+i); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	stats, err := publisher.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if want, have := (pshttp.StreamStats{Values: 100, Stats: ps.Stats{Sends: 100}}), stats; want != have {
+		t.Errorf("stats: want %+v, have %+v", want, have)
+	}
+
+	if want, have := pshttp.ErrPublisherClosed, publisher.Publish(ctx, 123); !errors.Is(have, want) {
+		t.Errorf("publish after close: want %v, have %v", want, have)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Broker:        broker,
+		Logs:          newTestWriter(t),
+		Authenticator: pshttp.BearerTokens(map[string]string{"token-a": "alice", "token-b": "bob"}),
+		Authorizer: pshttp.AuthorizerFuncs[int64]{
+			Publish: func(p pshttp.Principal, r *http.Request) error {
+				if p.Name != "alice" {
+					return pshttp.ErrForbidden
+				}
+				return nil
+			},
+			Value: func(p pshttp.Principal, v int64) bool {
+				return p.Name == "alice" || v%2 == 0
+			},
+		},
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	newClient := func(token string) *pshttp.Client[int64] {
+		t.Helper()
+		httpClient := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+		client, err := pshttp.NewClient(httpClient, server.URL, pshttp.EncodeJSON[int64], pshttp.DecodeJSON[int64])
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+		return client
+	}
+
+	var (
+		anonymous = newClient("")
+		invalid   = newClient("invalid")
+		alice     = newClient("token-a")
+		bob       = newClient("token-b")
+	)
+
+	for _, tc := range []struct {
+		name   string
+		client *pshttp.Client[int64]
+		want   int
+	}{
+		{"anonymous", anonymous, http.StatusUnauthorized},
+		{"invalid", invalid, http.StatusUnauthorized},
+		{"bob", bob, http.StatusForbidden},
+	} {
+		var statusErr *pshttp.StatusError
+		if _, err := tc.client.Publish(ctx, 1); !errors.As(err, &statusErr) || statusErr.StatusCode != tc.want {
+			t.Errorf("%s: publish: want %d, have %v", tc.name, tc.want, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	valc := make(chan int64, 10)
+	go bob.Subscribe(ctx, valc, time.Second)
+	for len(broker.ActiveSubscribers()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, v := range []int64{1, 2, 3, 4} {
+		if _, err := alice.Publish(ctx, v); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	for _, want := range []int64{2, 4} {
+		select {
+		case have := <-valc:
+			if want != have {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for value")
+		}
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	registry := ps.NewRegistry[int64](ps.RegistryConfig{Allowlist: []string{"odd", "even"}})
+	handler := pshttp.NewRegistryHandler(registry, pshttp.EncodeJSON, pshttp.DecodeJSON, newTestWriter(t))
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var (
+		odd     = client.Topic("odd")
+		even    = client.Topic("even")
+		unknown = client.Topic("unknown")
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	valc := make(chan int64, 10)
+	go even.Subscribe(ctx, valc, time.Second)
+
+	for {
+		topics, err := client.Topics(ctx)
+		if err != nil {
+			t.Fatalf("list topics: %v", err)
+		}
+		if len(topics) == 1 && topics[0] == (ps.TopicInfo{Name: "even", Subscribers: 1}) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := odd.Publish(ctx, 1); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if _, err := even.Publish(ctx, 2); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	var statusErr *pshttp.StatusError
+	if _, err := unknown.Publish(ctx, 3); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("publish to unknown topic: want 404, have %v", err)
+	}
+
+	select {
+	case v := <-valc:
+		if want, have := int64(2), v; want != have {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for value")
+	}
+
+	topics, err := client.Topics(ctx)
+	if err != nil {
+		t.Fatalf("list topics: %v", err)
+	}
+	if want, have := 2, len(topics); want != have {
+		t.Errorf("topics: want %d, have %d (%v)", want, have, topics)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Broker: broker,
+		Logs:   newTestWriter(t),
+		Filter: func(filter string) (func(int64) bool, error) {
+			n, err := strconv.ParseInt(filter, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return func(v int64) bool { return v%n == 0 }, nil
+		},
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	admin := httptest.NewServer(handler.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		valc      = make(chan int64, 10)
+		connected = make(chan struct{}, 10)
+	)
+	go client.SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{
+		Reconnect: pshttp.ConstantBackoff(10 * time.Millisecond),
+		Filter:    "3",
+		OnStateChange: func(state pshttp.ConnState, err error) {
+			if state == pshttp.StateConnected {
+				connected <- struct{}{}
+			}
+		},
+	})
+	<-connected
+
+	var subs []pshttp.SubscriptionInfo
+	for len(subs) == 0 {
+		getJSON(t, admin.URL+"/subscriptions", &subs)
+	}
+	if want, have := "3", subs[0].Filter; want != have {
+		t.Errorf("filter: want %q, have %q", want, have)
+	}
+
+	for v := range int64(10) {
+		broker.Publish(v)
+	}
+	for _, want := range []int64{0, 3, 6, 9} {
+		if have := <-valc; want != have {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	}
+
+	var stats pshttp.AdminStats
+	getJSON(t, admin.URL+"/stats", &stats)
+	if want, have := (ps.Stats{Skips: 6, Sends: 4}), stats.Stats; want != have {
+		t.Errorf("stats: want %v, have %v", want, have)
+	}
+
+	req, _ := http.NewRequest("DELETE", admin.URL+"/subscriptions/"+subs[0].ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("disconnect: %v", err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusNoContent, resp.StatusCode; want != have {
+		t.Fatalf("disconnect: want %d, have %d", want, have)
+	}
+
+	select {
+	case <-connected:
+		// client reconnected
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for reconnect")
+	}
+
+	req, _ = http.NewRequest("GET", admin.URL+"/subscriptions", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get HTML: %v", err)
+	}
+	defer resp.Body.Close()
+	if want, have := "text/html; charset=utf-8", resp.Header.Get("content-type"); want != have {
+		t.Errorf("content-type: want %q, have %q", want, have)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Broker: broker,
+		Logs:   newTestWriter(t),
+		Codecs: pshttp.Codecs[int64]{
+			pshttp.JSONCodec[int64](),
+			pshttp.GobCodec[int64](),
+		},
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c := make(chan int64, 10)
+	broker.SubscribeAll(c)
+
+	for i, codec := range handler.Codecs() {
+		client, err := pshttp.NewCodecClient(http.DefaultClient, server.URL, codec)
+		if err != nil {
+			t.Fatalf("%s: create client: %v", codec.MediaType, err)
+		}
+		if _, err := client.Publish(ctx, int64(i)); err != nil {
+			t.Fatalf("%s: publish: %v", codec.MediaType, err)
+		}
+		if want, have := int64(i), <-c; want != have {
+			t.Errorf("%s: want %v, have %v", codec.MediaType, want, have)
+		}
+	}
+
+	for _, tc := range []struct {
+		path        string
+		contentType string
+		want        int
+	}{
+		{"", "application/x-gob", http.StatusBadRequest},
+		{"/batch", "application/x-gob", http.StatusUnsupportedMediaType},
+		{"/stream", "application/x-gob", http.StatusUnsupportedMediaType},
+	} {
+		req, _ := http.NewRequest("POST", server.URL+tc.path, strings.NewReader(`{"invalid": true}`))
+		req.Header.Set("Content-Type", tc.contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		if want, have := tc.want, resp.StatusCode; want != have {
+			t.Errorf("POST %s %s: want %d, have %d", tc.path, tc.contentType, want, have)
+		}
+	}
+
+	// Batch and streaming publish requests select text codecs by content type.
+	hex := pshttp.Codec[int64]{
+		MediaType: "text/x-hex",
+		Encode:    func(v int64, w io.Writer) error { _, err := fmt.Fprintf(w, "%x", v); return err },
+		Decode:    func(r io.Reader, v *int64) error { _, err := fmt.Fscanf(r, "%x", v); return err },
+	}
+	hexHandler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Broker: broker,
+		Logs:   newTestWriter(t),
+		Codecs: pshttp.Codecs[int64]{pshttp.JSONCodec[int64](), hex},
+	})
+	hexServer := httptest.NewServer(hexHandler)
+	t.Cleanup(hexServer.Close)
+
+	hexClient, err := pshttp.NewCodecClient(http.DefaultClient, hexServer.URL, hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := hexClient.PublishBatch(ctx, []int64{10, 255})
+	if err != nil {
+		t.Fatalf("hex batch: %v", err)
+	}
+	if want, have := (ps.Stats{Sends: 2}), result.Stats; want != have {
+		t.Errorf("hex batch: want %v, have %v (%+v)", want, have, result.Items)
+	}
+	for _, want := range []int64{10, 255} {
+		if have := <-c; want != have {
+			t.Errorf("hex batch: want %v, have %v", want, have)
+		}
+	}
+}
+
+func TestBinaryFraming(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[[]byte]()
+
+	raw := pshttp.Codec[[]byte]{
+		Encode: func(v []byte, w io.Writer) error { _, err := w.Write(v); return err },
+		Decode: func(r io.Reader, v *[]byte) error { b, err := io.ReadAll(r); *v = b; return err },
+	}
+
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[[]byte]{
+		Broker: broker,
+		Logs:   newTestWriter(t),
+		Codecs: pshttp.Codecs[[]byte]{raw, pshttp.GobCodec[[]byte]()},
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	for _, tc := range []struct {
+		name   string
+		codec  pshttp.Codec[[]byte]
+		config pshttp.SubscribeConfig
+	}{
+		{"raw", raw, pshttp.SubscribeConfig{BinaryFraming: true}},
+		{"gob", pshttp.GobCodec[[]byte](), pshttp.SubscribeConfig{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := pshttp.NewCodecClient(http.DefaultClient, server.URL, tc.codec)
+			if err != nil {
+				t.Fatalf("create client: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			var (
+				valc      = make(chan []byte, 1)
+				connected = make(chan struct{})
+				once      sync.Once
+			)
+			tc.config.OnStateChange = func(state pshttp.ConnState, err error) {
+				if state == pshttp.StateConnected {
+					once.Do(func() { close(connected) })
+				}
+			}
+			go client.SubscribeConfig(ctx, valc, tc.config)
+			<-connected
+
+			want := []byte{0xff, 0xfe, '\r', '\n', 0x00, 'x'}
+			for broker.Publish(want).Sends == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			select {
+			case have := <-valc:
+				if !bytes.Equal(want, have) {
+					t.Errorf("want %x, have %x", want, have)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for value")
+			}
+		})
+	}
+}
+
+func getJSON(tb testing.TB, uri string, v any) {
+	tb.Helper()
+	resp, err := http.Get(uri)
+	if err != nil {
+		tb.Fatalf("GET %s: %v", uri, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		tb.Fatalf("GET %s: decode response: %v", uri, err)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
 type testWriter struct {
 	tb testing.TB
 }
 
-func newTestWriter(tb testing.TB) *testWriter {
-	return &testWriter{
-		tb: tb,
+func newTestWriter(tb testing.TB) *testWriter {
+	return &testWriter{
+		tb: tb,
+	}
+}
+
+func (tw *testWriter) Write(p []byte) (int, error) {
+	tw.tb.Logf("%s", string(p))
+	return len(p), nil
+}
+
+func TestLimits(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Broker: broker,
+		Logs:   newTestWriter(t),
+		Limits: pshttp.Limits{
+			MaxBuffer:        10,
+			MaxSubscriptions: 1,
+			MaxPublishBytes:  16,
+			PublishRate:      0.1,
+			PublishBurst:     2,
+		},
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	post := func(body string) int {
+		t.Helper()
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if want, have := http.StatusRequestEntityTooLarge, post(strings.Repeat("1", 32)); want != have {
+		t.Errorf("large publish: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusOK, post("1"); want != have {
+		t.Errorf("publish: want %d, have %d", want, have)
+	}
+	var statusErr *pshttp.StatusError
+	if _, err := client.Publish(ctx, 2); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("rate limited publish: want %d, have %v", http.StatusTooManyRequests, err)
+	} else if statusErr.RetryAfter <= 0 {
+		t.Errorf("rate limited publish: want Retry-After, have %v", statusErr.RetryAfter)
+	}
+
+	get := func(query string) int {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"?"+query, nil)
+		req.Header.Set("accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if want, have := http.StatusBadRequest, get("buffer=100"); want != have {
+		t.Errorf("large buffer: want %d, have %d", want, have)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	connected := make(chan struct{}, 10)
+	go client.SubscribeConfig(ctx, make(chan int64), pshttp.SubscribeConfig{
+		Reconnect: pshttp.ConstantBackoff(10 * time.Millisecond),
+		OnStateChange: func(state pshttp.ConnState, err error) {
+			if state == pshttp.StateConnected {
+				connected <- struct{}{}
+			}
+		},
+	})
+	<-connected
+
+	if want, have := http.StatusServiceUnavailable, get(""); want != have {
+		t.Errorf("too many subscriptions: want %d, have %d", want, have)
+	}
+
+	// Rate limited clients can't create topics.
+	registry := ps.NewRegistry[int64](ps.RegistryConfig{})
+	registryServer := httptest.NewServer(pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Registry: registry,
+		Logs:     newTestWriter(t),
+		Limits:   pshttp.Limits{PublishRate: 0.1, PublishBurst: 1},
+	}))
+	t.Cleanup(registryServer.Close)
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/topics/a", http.StatusOK},
+		{"/topics/b", http.StatusTooManyRequests},
+		{"/topics/c/batch", http.StatusTooManyRequests},
+		{"/topics/d/stream", http.StatusTooManyRequests},
+	} {
+		resp, err := http.Post(registryServer.URL+tc.path, "application/x-ndjson", strings.NewReader("1\n"))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		if want, have := tc.want, resp.StatusCode; want != have {
+			t.Errorf("POST %s: want %d, have %d", tc.path, want, have)
+		}
+	}
+	if want, have := 1, len(registry.Topics()); want != have {
+		t.Errorf("topics: want %d, have %d (%v)", want, have, registry.Topics())
+	}
+}
+
+func TestHandlerOptionOrder(t *testing.T) {
+	t.Parallel()
+
+	var (
+		buffer = pshttp.WithBuffer[int64](5, 1, 20)
+		limits = pshttp.WithLimits[int64](pshttp.Limits{MaxSubscriptions: 10})
+	)
+	for name, options := range map[string][]pshttp.HandlerOption[int64]{
+		"buffer first": {buffer, limits},
+		"limits first": {limits, buffer},
+	} {
+		server := httptest.NewServer(pshttp.NewHandlerWithOptions(ps.NewBroker[int64](), options...))
+		defer server.Close()
+
+		req, _ := http.NewRequest("GET", server.URL+"?buffer=30", nil)
+		req.Header.Set("accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: get: %v", name, err)
+		}
+		resp.Body.Close()
+		if want, have := http.StatusBadRequest, resp.StatusCode; want != have {
+			t.Errorf("%s: buffer beyond bounds: want %d, have %d", name, want, have)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[int64]{
+		Broker:        broker,
+		Logs:          newTestWriter(t),
+		ShutdownDelay: 2500 * time.Millisecond,
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		valc      = make(chan int64, 10)
+		connected = make(chan struct{}, 10)
+		shutdown  = make(chan *pshttp.ShutdownError, 10)
+	)
+	go client.SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{
+		Reconnect: pshttp.ConstantBackoff(10 * time.Millisecond),
+		OnStateChange: func(state pshttp.ConnState, err error) {
+			var shutdownErr *pshttp.ShutdownError
+			switch {
+			case state == pshttp.StateConnected:
+				connected <- struct{}{}
+			case errors.As(err, &shutdownErr):
+				shutdown <- shutdownErr
+			}
+		},
+	})
+	<-connected
+
+	for v := range int64(5) {
+		broker.Publish(v)
+	}
+
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	for want := range int64(5) {
+		if have := <-valc; want != have {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	}
+
+	shutdownErr := <-shutdown
+	if want, have := 2500*time.Millisecond, shutdownErr.RetryAfter; want != have {
+		t.Errorf("retry after: want %v, have %v", want, have)
+	}
+	if want, have := (ps.Stats{Sends: 5}), shutdownErr.Stats; want != have {
+		t.Errorf("stats: want %v, have %v", want, have)
+	}
+
+	select {
+	case <-connected:
+		t.Errorf("client reconnected before the suggested delay")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	req.Header.Set("accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusServiceUnavailable, resp.StatusCode; want != have {
+		t.Errorf("subscribe after shutdown: want %d, have %d", want, have)
+	}
+	if want, have := "3", resp.Header.Get("retry-after"); want != have {
+		t.Errorf("retry-after: want %q, have %q", want, have)
+	}
+}
+
+func TestSubscribeHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := ps.NewBroker[int]()
+	server := httptest.NewServer(pshttp.NewHandlerConfig(pshttp.HandlerConfig[int]{
+		Broker:       broker,
+		Logs:         newTestWriter(t),
+		MinHeartbeat: 10 * time.Millisecond,
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewClient(http.DefaultClient, server.URL, pshttp.EncodeJSON[int], pshttp.DecodeJSON[int])
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var (
+		valc       = make(chan int, 10)
+		connected  = make(chan struct{}, 10)
+		heartbeats = make(chan pshttp.HeartbeatEvent, 100)
+	)
+	go client.SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{
+		OnStateChange: func(state pshttp.ConnState, err error) {
+			if state == pshttp.StateConnected {
+				connected <- struct{}{}
+			}
+		},
+		OnHeartbeat: func(ev pshttp.HeartbeatEvent) {
+			select {
+			case heartbeats <- ev:
+			default:
+			}
+		},
+		Heartbeat: 50 * time.Millisecond,
+	})
+	<-connected
+
+	if _, err := client.Publish(ctx, 42); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if want, have := 42, <-valc; want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// Heartbeats report the stats of the subscription.
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-heartbeats:
+			if ev.Stats.Sends == 0 {
+				continue
+			}
+			if want, have := uint64(1), ev.Stats.Sends; want != have {
+				t.Errorf("sends: want %d, have %d", want, have)
+			}
+			return
+		case <-deadline:
+			t.Fatal("timeout waiting for heartbeat with stats")
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+
+	var tokens sync.Map
+	handler := pshttp.NewHandlerWithOptions(broker,
+		pshttp.WithLogger[int64](slog.New(slog.NewTextHandler(newTestWriter(t), nil))),
+		pshttp.WithPrefix[int64]("/ps"),
+		pshttp.WithBuffer[int64](10, 1, 20),
+		pshttp.WithHeartbeat[int64](time.Second, 100*time.Millisecond, 5*time.Second),
+		pshttp.WithErrorRenderer[int64](func(w http.ResponseWriter, r *http.Request, code int, err error) {
+			http.Error(w, "custom: "+err.Error(), code)
+		}),
+		pshttp.WithMiddleware[int64](func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokens.Store(r.Header.Get("x-token"), true)
+				next.ServeHTTP(w, r)
+			})
+		}),
+		pshttp.WithCodecs(pshttp.JSONCodec[int64]()),
+	)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewClientWithOptions[int64](server.URL+"/ps/",
+		pshttp.WithHeader[int64]("x-token", "abc"),
+		pshttp.WithReconnect[int64](pshttp.ConstantBackoff(10*time.Millisecond)),
+		pshttp.WithSubscribeBuffer[int64](5),
+		pshttp.WithSubscribeHeartbeat[int64](200*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		valc      = make(chan int64, 10)
+		connected = make(chan struct{}, 10)
+	)
+	go client.SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{
+		OnStateChange: func(state pshttp.ConnState, err error) {
+			if state == pshttp.StateConnected {
+				connected <- struct{}{}
+			}
+		},
+	})
+	<-connected
+
+	if want, have := 5, handler.Subscriptions()[0].Buffer; want != have {
+		t.Errorf("buffer: want %d, have %d", want, have)
+	}
+
+	if _, err := client.Publish(ctx, 42); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if want, have := int64(42), <-valc; want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	if _, ok := tokens.Load("abc"); !ok {
+		t.Errorf("middleware didn't see client header")
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/ps/?buffer=100", nil)
+	req.Header.Set("accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want, have := http.StatusBadRequest, resp.StatusCode; want != have {
+		t.Errorf("large buffer: want %d, have %d", want, have)
+	}
+	if want, have := "custom: ", string(body); !strings.HasPrefix(have, want) {
+		t.Errorf("error body: want prefix %q, have %q", want, have)
+	}
+
+	resp, err = http.Post(server.URL+"/", "application/json", strings.NewReader("1"))
+	if err != nil {
+		t.Fatalf("publish outside prefix: %v", err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusNotFound, resp.StatusCode; want != have {
+		t.Errorf("publish outside prefix: want %d, have %d", want, have)
+	}
+}
+
+func TestStructuredLogs(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mtx  sync.Mutex
+		logs []map[string]any
+	)
+	logger := slog.New(slog.NewJSONHandler(writerFunc(func(p []byte) (int, error) {
+		var record map[string]any
+		if err := json.Unmarshal(p, &record); err != nil {
+			return 0, err
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		logs = append(logs, record)
+		return len(p), nil
+	}), nil))
+	find := func(msg string) map[string]any {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, record := range logs {
+			if record["msg"] == msg {
+				return record
+			}
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int64]()
+	handler := pshttp.NewHandlerWithOptions(broker, pshttp.WithLogger[int64](logger))
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewDefaultClient[int64](server.URL)
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		valc      = make(chan int64, 10)
+		connected = make(chan struct{}, 10)
+		done      = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		client.SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{
+			OnStateChange: func(state pshttp.ConnState, err error) {
+				if state == pshttp.StateConnected {
+					connected <- struct{}{}
+				}
+			},
+		})
+	}()
+	<-connected
+
+	broker.Publish(1)
+	<-valc
+	cancel()
+	<-done
+
+	var unsubscribe map[string]any
+	for unsubscribe == nil {
+		time.Sleep(10 * time.Millisecond)
+		unsubscribe = find("unsubscribe")
+	}
+
+	subscribe := find("subscribe")
+	if subscribe == nil {
+		t.Fatalf("no subscribe record")
+	}
+	for _, key := range []string{"component", "remote_addr", "subscription_id", "buffer", "heartbeat"} {
+		if _, ok := subscribe[key]; !ok {
+			t.Errorf("subscribe record: missing %q: %v", key, subscribe)
+		}
+	}
+	if want, have := subscribe["subscription_id"], unsubscribe["subscription_id"]; want != have {
+		t.Errorf("subscription_id: want %v, have %v", want, have)
+	}
+	if want, have := float64(1), unsubscribe["stats"].(map[string]any)["sends"]; want != have {
+		t.Errorf("stats.sends: want %v, have %v", want, have)
+	}
+	if _, ok := unsubscribe["duration"]; !ok {
+		t.Errorf("unsubscribe record: missing duration: %v", unsubscribe)
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("s3cr3t")
+
+	var (
+		mtx      sync.Mutex
+		attempts = map[string]int{} // by delivery ID
+		bodies   []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := pshttp.VerifyWebhook(secret, r.Header, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		id := r.Header.Get(pshttp.WebhookDeliveryHeader)
+		attempts[id]++
+		if want, have := strconv.Itoa(attempts[id]), r.Header.Get(pshttp.WebhookAttemptHeader); want != have {
+			t.Errorf("attempt header: want %s, have %s", want, have)
+		}
+
+		switch {
+		case string(body) == "400\n":
+			w.WriteHeader(http.StatusBadRequest)
+		case attempts[id] == 1:
+			w.WriteHeader(http.StatusServiceUnavailable) // every delivery fails once
+		default:
+			bodies = append(bodies, string(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	webhook, err := pshttp.NewWebhook(pshttp.WebhookConfig[int]{
+		URL:              server.URL,
+		Secret:           secret,
+		Retry:            &pshttp.ExponentialBackoff{Initial: time.Millisecond, Max: 10 * time.Millisecond},
+		BreakerThreshold: 100,
+	})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := ps.NewBroker[int]()
+	done := make(chan error, 1)
+	go func() { done <- webhook.Run(ctx, broker, func(v int) bool { return v%2 == 0 }) }()
+	for len(broker.ActiveSubscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, v := range []int{1, 2, 3, 4, 400} {
+		broker.Publish(v)
+	}
+
+	var stats pshttp.WebhookStats
+	for stats.Delivered+stats.Failed < 3 {
+		time.Sleep(5 * time.Millisecond)
+		stats = webhook.Stats()
+	}
+	if want, have := (pshttp.WebhookStats{
+		Subscription: ps.Stats{Skips: 2, Sends: 3},
+		Delivered:    2,
+		Retries:      2,
+		Failed:       1,
+		Circuit:      pshttp.CircuitClosed,
+	}), stats; want != have {
+		t.Errorf("stats: want %+v, have %+v", want, have)
+	}
+
+	mtx.Lock()
+	slices.Sort(bodies)
+	if want, have := []string{"2\n", "4\n"}, bodies; !slices.Equal(want, have) {
+		t.Errorf("bodies: want %q, have %q", want, have)
+	}
+	mtx.Unlock()
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("run: want %v, have %v", context.Canceled, err)
+	}
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+
+	webhook, err := pshttp.NewWebhook(pshttp.WebhookConfig[int]{
+		URL:              server.URL,
+		Retry:            pshttp.ConstantBackoff(time.Millisecond),
+		QueueSize:        2,
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := ps.NewBroker[int]()
+	go webhook.Run(ctx, broker, func(int) bool { return true })
+	for len(broker.ActiveSubscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for v := range 5 {
+		broker.Publish(v)
+	}
+
+	var stats pshttp.WebhookStats
+	for stats.Dropped < 3 {
+		time.Sleep(5 * time.Millisecond)
+		stats = webhook.Stats()
+	}
+	if want, have := pshttp.CircuitOpen, stats.Circuit; want != have {
+		t.Errorf("circuit: want %v, have %v", want, have)
+	}
+	if want, have := 2, stats.Queued; want != have {
+		t.Errorf("queued: want %d, have %d", want, have)
+	}
+	if want, have := int64(3), requests.Load(); want != have {
+		t.Errorf("requests: want %d, have %d", want, have)
+	}
+}
+
+func TestHub(t *testing.T) {
+	t.Parallel()
+
+	type delivery struct {
+		body      string
+		signature string
+		link      []string
+	}
+
+	var (
+		secret     = "hunter2"
+		challenges = make(chan url.Values, 10)
+		deliveries = make(chan delivery, 10)
+		refuse     atomic.Bool
+	)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			challenges <- r.URL.Query()
+			if refuse.Load() {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, r.URL.Query().Get("hub.challenge"))
+		case "POST":
+			body, _ := io.ReadAll(r.Body)
+			if want, have := pshttp.SignHub([]byte(secret), body), r.Header.Get(pshttp.HubSignatureHeader); want != have {
+				t.Errorf("signature: want %q, have %q", want, have)
+			}
+			deliveries <- delivery{string(body), r.Header.Get(pshttp.HubSignatureHeader), r.Header.Values("link")}
+		}
+	}))
+	t.Cleanup(callback.Close)
+
+	registry := ps.NewRegistry[int](ps.RegistryConfig{})
+	hub, err := pshttp.NewHub(pshttp.HubConfig[int]{
+		Registry: registry,
+		URL:      "https://hub.example.com/",
+		MinLease: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create hub: %v", err)
+	}
+	t.Cleanup(func() { hub.Close() })
+	server := httptest.NewServer(hub)
+	t.Cleanup(server.Close)
+
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := http.PostForm(server.URL, form)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, form := range []url.Values{
+		{"hub.mode": {"subscribe"}, "hub.topic": {"news"}},
+		{"hub.mode": {"subscribe"}, "hub.topic": {"news"}, "hub.callback": {"ftp://example.com"}},
+		{"hub.mode": {"publish"}, "hub.topic": {"news"}, "hub.callback": {callback.URL}},
+		{"hub.mode": {"subscribe"}, "hub.topic": {"a/b"}, "hub.callback": {callback.URL}},
+		{"hub.mode": {"subscribe"}, "hub.topic": {"news"}, "hub.callback": {callback.URL}, "hub.lease_seconds": {"-1"}},
+	} {
+		if want, have := http.StatusBadRequest, post(form); want != have {
+			t.Errorf("%v: want %d, have %d", form, want, have)
+		}
+	}
+
+	// Subscribers which don't echo the challenge aren't subscribed.
+	refuse.Store(true)
+	if want, have := http.StatusAccepted, post(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"news"}, "hub.callback": {callback.URL}}); want != have {
+		t.Fatalf("subscribe: want %d, have %d", want, have)
+	}
+	<-challenges
+	time.Sleep(10 * time.Millisecond)
+	if subs := hub.Subscriptions(); len(subs) != 0 {
+		t.Errorf("subscriptions: want none, have %+v", subs)
+	}
+	if topics := registry.Topics(); len(topics) != 0 {
+		t.Errorf("topics after failed verification: want none, have %+v", topics)
+	}
+	refuse.Store(false)
+
+	if want, have := http.StatusAccepted, post(url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {"news"},
+		"hub.callback":      {callback.URL + "/cb?id=1"},
+		"hub.lease_seconds": {"3600"},
+		"hub.secret":        {secret},
+	}); want != have {
+		t.Fatalf("subscribe: want %d, have %d", want, have)
+	}
+	query := <-challenges
+	if want, have := "subscribe", query.Get("hub.mode"); want != have {
+		t.Errorf("hub.mode: want %q, have %q", want, have)
+	}
+	if want, have := "3600", query.Get("hub.lease_seconds"); want != have {
+		t.Errorf("hub.lease_seconds: want %q, have %q", want, have)
+	}
+	if want, have := "1", query.Get("id"); want != have {
+		t.Errorf("callback query: want %q, have %q", want, have)
+	}
+
+	broker, release, err := registry.Acquire("news")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer release()
+	for len(broker.ActiveSubscribers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	broker.Publish(42)
+	d := <-deliveries
+	if want, have := "42\n", d.body; want != have {
+		t.Errorf("body: want %q, have %q", want, have)
+	}
+	if want, have := []string{`<https://hub.example.com/>; rel="hub"`, `<news>; rel="self"`}, d.link; !slices.Equal(want, have) {
+		t.Errorf("link: want %q, have %q", want, have)
+	}
+
+	subs := hub.Subscriptions()
+	for len(subs) == 1 && subs[0].Stats.Delivered == 0 {
+		time.Sleep(time.Millisecond) // the response may not be processed yet
+		subs = hub.Subscriptions()
+	}
+	if len(subs) != 1 || subs[0].Topic != "news" || subs[0].Stats.Delivered != 1 || time.Until(subs[0].Expires) < 59*time.Minute {
+		t.Errorf("subscriptions: unexpected %+v", subs)
+	}
+
+	if want, have := http.StatusAccepted, post(url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {"news"}, "hub.callback": {callback.URL + "/cb?id=1"}}); want != have {
+		t.Fatalf("unsubscribe: want %d, have %d", want, have)
+	}
+	if want, have := "unsubscribe", (<-challenges).Get("hub.mode"); want != have {
+		t.Errorf("hub.mode: want %q, have %q", want, have)
+	}
+	for len(broker.ActiveSubscribers()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if subs := hub.Subscriptions(); len(subs) != 0 {
+		t.Errorf("after unsubscribe: want no subscriptions, have %+v", subs)
+	}
+
+	// Leases expire.
+	if want, have := http.StatusAccepted, post(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"news"}, "hub.callback": {callback.URL}, "hub.lease_seconds": {"1"}}); want != have {
+		t.Fatalf("subscribe: want %d, have %d", want, have)
+	}
+	<-challenges
+	for len(hub.Subscriptions()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	for len(hub.Subscriptions()) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("lease expired after %s", took)
+	}
+}
+
+func TestCloudEvents(t *testing.T) {
+	t.Parallel()
+
+	type order struct {
+		ID    string `json:"id"`
+		Total int    `json:"total"`
+	}
+	type event = pshttp.CloudEvent[order]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := ps.NewBroker[event]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[event]{
+		Broker: broker,
+		Logs:   newTestWriter(t),
+		Codecs: pshttp.Codecs[event]{pshttp.CloudEventCodec[order](), pshttp.JSONCodec[event]()},
+		Filter: pshttp.ParseCloudEventFilter[order],
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewCodecClient(http.DefaultClient, server.URL, pshttp.CloudEventCodec[order]())
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	var (
+		valc = make(chan event, 10)
+		binc = make(chan event, 10)
+	)
+	go client.SubscribeConfig(ctx, valc, pshttp.SubscribeConfig{Filter: "type=com.example.order.*,region=eu"})
+	go client.SubscribeConfig(ctx, binc, pshttp.SubscribeConfig{Filter: "type=com.example.order.*,region=eu", CloudEventsBinary: true})
+
+	// The binary content mode stream sends the attributes, and then the data
+	// with the event ID.
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"?cloudevents=binary", nil)
+	req.Header.Set("accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+
+	for len(broker.ActiveSubscribers()) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	publish := func(header http.Header, body string) int {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, "POST", server.URL, strings.NewReader(body))
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		body   string
+		want   int
+	}{
+		{
+			name:   "structured",
+			header: http.Header{"Content-Type": {pshttp.CloudEventsMediaType}},
+			body:   `{"specversion":"1.0","id":"1","source":"/shop","type":"com.example.order.created","region":"eu","time":"2024-01-02T03:04:05Z","data":{"id":"a","total":10}}`,
+			want:   http.StatusOK,
+		},
+		{
+			name: "binary",
+			header: http.Header{
+				"Content-Type":   {"application/json"},
+				"Ce-Specversion": {"1.0"},
+				"Ce-Source":      {"/shop"},
+				"Ce-Type":        {"com.example.order.paid"},
+				"Ce-Region":      {"eu"},
+			},
+			body: `{"id":"b","total":20}`,
+			want: http.StatusOK,
+		},
+		{
+			name:   "filtered",
+			header: http.Header{"Content-Type": {pshttp.CloudEventsMediaType}},
+			body:   `{"specversion":"1.0","id":"3","source":"/shop","type":"com.example.order.created","region":"us","data":{"id":"c","total":30}}`,
+			want:   http.StatusOK,
+		},
+		{
+			name:   "missing type",
+			header: http.Header{"Content-Type": {pshttp.CloudEventsMediaType}},
+			body:   `{"specversion":"1.0","id":"4","source":"/shop","data":{}}`,
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "bad specversion",
+			header: http.Header{"Content-Type": {"application/json"}, "Ce-Specversion": {"0.3"}, "Ce-Source": {"/shop"}, "Ce-Type": {"x"}},
+			body:   `{}`,
+			want:   http.StatusBadRequest,
+		},
+	} {
+		if have := publish(tc.header, tc.body); tc.want != have {
+			t.Errorf("%s: want %d, have %d", tc.name, tc.want, have)
+		}
+	}
+
+	first := <-valc
+	if want, have := (event{
+		SpecVersion: "1.0",
+		ID:          "1",
+		Source:      "/shop",
+		Type:        "com.example.order.created",
+		Time:        time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Extensions:  map[string]string{"region": "eu"},
+		Data:        order{ID: "a", Total: 10},
+	}), first; !reflect.DeepEqual(want, have) {
+		t.Errorf("structured: want %+v, have %+v", want, have)
+	}
+
+	second := <-valc
+	if second.ID == "" || second.Time.IsZero() {
+		t.Errorf("binary: ID and time should be assigned, have %+v", second)
+	}
+	if want, have := "application/json", second.DataContentType; want != have {
+		t.Errorf("binary: datacontenttype: want %q, have %q", want, have)
+	}
+	if want, have := (order{ID: "b", Total: 20}), second.Data; want != have {
+		t.Errorf("binary: data: want %+v, have %+v", want, have)
+	}
+
+	select {
+	case v := <-valc:
+		t.Errorf("unexpected event %+v", v)
+	case <-time.After(50 * time.Millisecond):
+		// filtered
+	}
+
+	for _, want := range []event{first, second} {
+		if have := <-binc; !reflect.DeepEqual(want, have) {
+			t.Errorf("binary subscription: want %+v, have %+v", want, have)
+		}
+	}
+
+	var events []string
+	for len(events) < 4 && lines.Scan() {
+		if line := lines.Text(); strings.HasPrefix(line, "event:") || strings.HasPrefix(line, "data:") {
+			events = append(events, strings.TrimSpace(line))
+		}
+	}
+	if want, have := []string{
+		"event: " + pshttp.EventTypeCloudEventAttributes,
+		`data: {"id":"1","region":"eu","source":"/shop","specversion":"1.0","time":"2024-01-02T03:04:05Z","type":"com.example.order.created"}`,
+		"event: " + pshttp.EventTypeData,
+		`data: {"id":"a","total":10}`,
+	}, events; !slices.Equal(want, have) {
+		t.Errorf("binary stream: want %q, have %q", want, have)
+	}
+
+	badReq := httptest.NewRequest("GET", "/?cloudevents=binary", nil)
+	badReq.Header.Set("accept", "text/event-stream")
+	intHandler := pshttp.NewDefaultHandler(ps.NewBroker[int]())
+	rec := httptest.NewRecorder()
+	intHandler.ServeHTTP(rec, badReq)
+	if want, have := http.StatusBadRequest, rec.Code; want != have {
+		t.Errorf("binary mode for non-CloudEvents: want %d, have %d", want, have)
 	}
 }
 
-func (tw *testWriter) Write(p []byte) (int, error) {
-	tw.tb.Logf("%s", string(p))
-	return len(p), nil
+func TestCloudEventsBinaryData(t *testing.T) {
+	t.Parallel()
+
+	type event = pshttp.CloudEvent[[]byte]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	broker := ps.NewBroker[event]()
+	handler := pshttp.NewHandlerConfig(pshttp.HandlerConfig[event]{
+		Broker: broker,
+		Logs:   newTestWriter(t),
+		Codecs: pshttp.Codecs[event]{pshttp.CloudEventCodec[[]byte]()},
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := pshttp.NewCodecClient(http.DefaultClient, server.URL, pshttp.CloudEventCodec[[]byte]())
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	c := make(chan event, 10)
+	go client.SubscribeConfig(ctx, c, pshttp.SubscribeConfig{CloudEventsBinary: true})
+	for len(broker.ActiveSubscribers()) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Data which isn't UTF-8, or contains carriage returns, can't be sent in
+	// an SSE data field as is, and must survive the round trip anyway.
+	for _, data := range [][]byte{
+		[]byte("text\nlines"),
+		[]byte("carriage\r\nreturn\r"),
+		{0xff, 0xfe, 'a', '\r', 0x00, '\n', 0xc3},
+	} {
+		want := event{SpecVersion: "1.0", ID: "1", Source: "/test", Type: "com.example.bytes", DataContentType: "application/octet-stream", Data: data}
+		broker.Publish(want)
+		select {
+		case have := <-c:
+			if !bytes.Equal(want.Data, have.Data) {
+				t.Errorf("data: want %q, have %q", want.Data, have.Data)
+			}
+			if want, have := want.Type, have.Type; want != have {
+				t.Errorf("type: want %q, have %q", want, have)
+			}
+		case <-ctx.Done():
+			t.Fatalf("data %q: %v", data, ctx.Err())
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	remote := ps.NewBroker[int]()
+	handler := pshttp.NewHandlerWithOptions(remote, pshttp.WithLogs[int](newTestWriter(t)))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client, err := pshttp.NewDefaultClient[int](server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := pshttp.NewMirror(pshttp.MirrorConfig[int]{
+		Client: client,
+		Subscribe: pshttp.SubscribeConfig{
+			Reconnect: pshttp.ConstantBackoff(10 * time.Millisecond),
+			Heartbeat: time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local1, local2 := make(chan int, 10), make(chan int, 10)
+	mirror.Broker().SubscribeAll(local1)
+	mirror.Broker().SubscribeAll(local2)
+
+	runc := make(chan error, 1)
+	go func() { runc <- mirror.Run(ctx) }()
+
+	waitFor := func(what string, f func(pshttp.MirrorStats) bool) {
+		t.Helper()
+		for !f(mirror.Stats()) {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: %+v", what, mirror.Stats())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("connect", func(s pshttp.MirrorStats) bool { return s.State == pshttp.StateConnected })
+
+	for i := 1; i <= 3; i++ {
+		if want, have := uint64(1), remote.Publish(i).Sends; want != have {
+			t.Errorf("remote publish: want %d send(s), have %d", want, have)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		if want, have := i, <-local1; want != have {
+			t.Errorf("local1: want %d, have %d", want, have)
+		}
+		if want, have := i, <-local2; want != have {
+			t.Errorf("local2: want %d, have %d", want, have)
+		}
+	}
+
+	stats := mirror.Stats()
+	if want, have := uint64(3), stats.Received; want != have {
+		t.Errorf("received: want %d, have %d", want, have)
+	}
+	if want, have := (ps.Stats{Sends: 6}), stats.Published; want != have {
+		t.Errorf("published: want %v, have %v", want, have)
+	}
+	waitFor("heartbeat", func(s pshttp.MirrorStats) bool { return s.Heartbeat.Stats.Sends == 3 })
+
+	server.CloseClientConnections()
+	waitFor("reconnect", func(s pshttp.MirrorStats) bool { return s.Connects == 2 && s.State == pshttp.StateConnected })
+	if have := mirror.Stats().Error; have == "" {
+		t.Errorf("error: want the cause of the disconnect, have none")
+	}
+
+	remote.Publish(4)
+	if want, have := 4, <-local1; want != have {
+		t.Errorf("after reconnect: want %d, have %d", want, have)
+	}
+
+	cancel()
+	if want, have := context.Canceled, <-runc; !errors.Is(have, want) {
+		t.Errorf("run: want %v, have %v", want, have)
+	}
+}
+
+func TestFederation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A full mesh of three nodes, so every value reaches every node twice.
+	var (
+		names   = []string{"a", "b", "c"}
+		nodes   = make([]*pshttp.Federation[string], len(names))
+		servers = make([]*httptest.Server, len(names))
+		locals  = make([]chan string, len(names))
+	)
+	for i := range names {
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodes[i].ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+	}
+	for i, name := range names {
+		var peers []string
+		for j := range names {
+			if j != i {
+				peers = append(peers, servers[j].URL)
+			}
+		}
+		node, err := pshttp.NewFederation(pshttp.FederationConfig[string]{
+			Broker:    ps.NewBroker[string](),
+			Node:      name,
+			Peers:     peers,
+			Reconnect: pshttp.ConstantBackoff(10 * time.Millisecond),
+			Logger:    slog.New(slog.NewTextHandler(newTestWriter(t), nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+		locals[i] = make(chan string, 10)
+		node.Broker().SubscribeAll(locals[i])
+	}
+
+	runc := make(chan error, len(nodes))
+	for _, node := range nodes {
+		go func() { runc <- node.Run(ctx) }()
+	}
+	for _, node := range nodes {
+		for slices.ContainsFunc(node.Peers(), func(s pshttp.PeerStats) bool { return s.State != pshttp.StateConnected }) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	resp, err := http.Post(servers[0].URL, "application/json", strings.NewReader(`{"id":"x","value":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusMethodNotAllowed, resp.StatusCode; want != have {
+		t.Errorf("publish over HTTP: want %d, have %d", want, have)
+	}
+
+	if want, have := uint64(1), nodes[0].Publish("hello").Sends; want != have {
+		t.Errorf("publish: want %d local send(s), have %d", want, have)
+	}
+	nodes[2].Publish("world")
+
+	for i := range nodes {
+		var have []string
+		for range 2 {
+			select {
+			case v := <-locals[i]:
+				have = append(have, v)
+			case <-ctx.Done():
+				t.Fatalf("node %s: %v", names[i], ctx.Err())
+			}
+		}
+		slices.Sort(have)
+		if want := []string{"hello", "world"}; !slices.Equal(want, have) {
+			t.Errorf("node %s: want %v, have %v", names[i], want, have)
+		}
+	}
+
+	// Every value reaches both other nodes, at least one of which receives it
+	// twice, and suppresses the duplicate. Whether the other node suppresses
+	// a duplicate depends on the order in which the value arrives.
+	for {
+		var received, suppressed uint64
+		for _, node := range nodes {
+			for _, s := range node.Peers() {
+				received += s.Received
+				suppressed += s.Suppressed
+			}
+		}
+		if received == 4 && suppressed >= 2 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("received %d, suppressed %d", received, suppressed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := range nodes {
+		select {
+		case v := <-locals[i]:
+			t.Errorf("node %s: unexpected duplicate %q", names[i], v)
+		default:
+		}
+	}
+
+	cancel()
+	for range nodes {
+		if err := <-runc; !errors.Is(err, context.Canceled) {
+			t.Errorf("run: %v", err)
+		}
+	}
+}
+
+func TestIdempotentPublish(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	broker := ps.NewBroker[int]()
+	handler := pshttp.NewHandlerWithOptions(broker, pshttp.WithLogs[int](newTestWriter(t)))
+
+	// The response to the first publish request is lost: the value is
+	// published, but the connection is closed before the response is sent.
+	var lost atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && lost.CompareAndSwap(false, true) {
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := make(chan int, 10)
+	broker.SubscribeAll(c)
+
+	client, err := pshttp.NewClientWithOptions[int](server.URL, pshttp.WithPublishRetry[int](pshttp.ConstantBackoff(time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := client.Publish(ctx, 1)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if want, have := (ps.Stats{Sends: 1}), stats; want != have {
+		t.Errorf("stats: want %v, have %v", want, have)
+	}
+	if want, have := 1, <-c; want != have {
+		t.Errorf("value: want %d, have %d", want, have)
+	}
+	if want, have := 0, len(c); want != have {
+		t.Errorf("published %d extra value(s)", have)
+	}
+
+	if _, err := client.PublishKey(ctx, "k", 2); err != nil {
+		t.Fatalf("publish key: %v", err)
+	}
+	broker.Unsubscribe(c)
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", server.URL, strings.NewReader("2"))
+	req.Header.Set(pshttp.IdempotencyKeyHeader, "k")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if want, have := "true", resp.Header.Get(pshttp.IdempotentReplayedHeader); want != have {
+		t.Errorf("%s: want %q, have %q", pshttp.IdempotentReplayedHeader, want, have)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := (ps.Stats{Sends: 1}), stats; want != have {
+		t.Errorf("replayed stats: want %v, have %v", want, have)
+	}
+
+	noRetry, err := pshttp.NewClientWithOptions[int]("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := noRetry.Publish(ctx, 3); err == nil {
+		t.Errorf("publish to unreachable server without retries: want error, have none")
+	}
+}
+
+func TestFailoverClient(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		brokers  [2]*ps.Broker[int]
+		locals   [2]chan int
+		down     [2]atomic.Bool
+		servers  [2]*httptest.Server
+		failover = func(selection pshttp.EndpointSelection) *pshttp.FailoverClient[int] {
+			client, err := pshttp.NewFailoverClient(pshttp.FailoverConfig[int]{
+				Endpoints:     []string{servers[0].URL, servers[1].URL},
+				Selection:     selection,
+				ProbeInterval: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { client.Close() })
+			return client
+		}
+	)
+	for i := range brokers {
+		brokers[i] = ps.NewBroker[int]()
+		locals[i] = make(chan int, 10)
+		brokers[i].SubscribeAll(locals[i])
+		handler := pshttp.NewHandlerWithOptions(brokers[i], pshttp.WithLogs[int](newTestWriter(t)))
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down[i].Load() {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+	}
+
+	if _, err := pshttp.NewFailoverClient(pshttp.FailoverConfig[int]{}); err == nil {
+		t.Errorf("no endpoints: want error, have none")
+	}
+
+	client := failover(pshttp.SelectPriority)
+
+	var (
+		valc   = make(chan int, 10)
+		states = make(chan pshttp.ConnState, 10)
+		subc   = make(chan error, 1)
+	)
+	go func() {
+		subc <- client.Subscribe(ctx, valc, pshttp.SubscribeConfig{
+			Reconnect:     pshttp.ConstantBackoff(10 * time.Millisecond),
+			OnStateChange: func(state pshttp.ConnState, _ error) { states <- state },
+		})
+	}()
+	waitConnected := func() {
+		t.Helper()
+		for state := range states {
+			if state == pshttp.StateConnected {
+				return
+			}
+		}
+	}
+	waitConnected()
+
+	if _, err := client.Publish(ctx, 1); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if want, have := 1, <-locals[0]; want != have {
+		t.Errorf("priority endpoint: want %d, have %d", want, have)
+	}
+	if want, have := 1, <-valc; want != have {
+		t.Errorf("subscription: want %d, have %d", want, have)
+	}
+
+	down[0].Store(true)
+	servers[0].CloseClientConnections()
+	waitConnected()
+	if client.Endpoints()[0].Healthy {
+		t.Errorf("first endpoint: want down, have healthy")
+	}
+
+	if _, err := client.Publish(ctx, 2); err != nil {
+		t.Fatalf("publish during failover: %v", err)
+	}
+	if want, have := 2, <-locals[1]; want != have {
+		t.Errorf("second endpoint: want %d, have %d", want, have)
+	}
+	if want, have := 2, <-valc; want != have {
+		t.Errorf("subscription after failover: want %d, have %d", want, have)
+	}
+
+	down[0].Store(false)
+	for !client.Endpoints()[0].Healthy {
+		if ctx.Err() != nil {
+			t.Fatalf("probe: %+v", client.Endpoints())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	roundRobin := failover(pshttp.SelectRoundRobin)
+	for i := 3; i <= 6; i++ {
+		if _, err := roundRobin.Publish(ctx, i); err != nil {
+			t.Fatalf("round robin publish: %v", err)
+		}
+	}
+	if want, have := [2]int{2, 2}, [2]int{len(locals[0]), len(locals[1])}; want != have {
+		t.Errorf("round robin: want %v, have %v", want, have)
+	}
+
+	down[0].Store(true)
+	down[1].Store(true)
+	var statusErr *pshttp.StatusError
+	if _, err := roundRobin.Publish(ctx, 7); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("publish with every endpoint down: want 503, have %v", err)
+	}
+
+	cancel()
+	if err := <-subc; !errors.Is(err, context.Canceled) {
+		t.Errorf("subscribe: want %v, have %v", context.Canceled, err)
+	}
+}
+
+func TestFailoverReconnectDelay(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		body  string
+		delay time.Duration // between dials of the same endpoint
+	}{
+		{"dropped", "", 50 * time.Millisecond},
+		{"shutdown", "event: " + pshttp.EventTypeShutdown + "\ndata: {\"retry_after_ms\":100}\n\n", 100 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Endpoints accept every subscription, and then immediately end
+			// it, without sending any values.
+			var dials atomic.Int64
+			endpoints := make([]string, 2)
+			for i := range endpoints {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					dials.Add(1)
+					w.Header().Set("content-type", "text/event-stream")
+					w.WriteHeader(http.StatusOK)
+					io.WriteString(w, tc.body)
+				}))
+				defer server.Close()
+				endpoints[i] = server.URL
+			}
+
+			client, err := pshttp.NewFailoverClient(pshttp.FailoverConfig[int]{Endpoints: endpoints})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			client.Subscribe(ctx, make(chan int), pshttp.SubscribeConfig{
+				Reconnect: pshttp.ConstantBackoff(50 * time.Millisecond),
+			})
+
+			limit := int64(len(endpoints)) * int64(time.Since(start)/tc.delay+1)
+			if have := dials.Load(); have > limit || have < 2 {
+				t.Errorf("dials: want between 2 and %d, have %d", limit, have)
+			}
+		})
+	}
+}
+
+func TestFailoverResume(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Two federated nodes, which retain recent values, each with a handler
+	// for subscribers. Values are published on the second node.
+	var (
+		names   = []string{"a", "b"}
+		nodes   = make([]*pshttp.Federation[int], len(names))
+		peers   = make([]*httptest.Server, len(names))
+		servers = make([]*httptest.Server, len(names))
+		down    [2]atomic.Bool
+	)
+	for i := range names {
+		peers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodes[i].ServeHTTP(w, r)
+		}))
+		defer peers[i].Close()
+	}
+	for i, name := range names {
+		node, err := pshttp.NewFederation(pshttp.FederationConfig[int]{
+			Broker:    ps.NewBrokerConfig[int](ps.BrokerConfig{Replay: 100}),
+			Node:      name,
+			Peers:     []string{peers[1-i].URL},
+			Reconnect: pshttp.ConstantBackoff(10 * time.Millisecond),
+			Logger:    slog.New(slog.NewTextHandler(newTestWriter(t), nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+		handler := pshttp.NewHandlerWithOptions(node.Broker(), pshttp.WithLogs[int](newTestWriter(t)))
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down[i].Load() {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+	}
+	for _, node := range nodes {
+		go node.Run(ctx)
+	}
+	for _, node := range nodes {
+		for node.Peers()[0].State != pshttp.StateConnected {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	client, err := pshttp.NewFailoverClient(pshttp.FailoverConfig[int]{
+		Endpoints: []string{servers[0].URL, servers[1].URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var (
+		valc   = make(chan int, 100)
+		states = make(chan pshttp.ConnState, 100)
+	)
+	go client.Subscribe(ctx, valc, pshttp.SubscribeConfig{
+		Reconnect:     pshttp.ConstantBackoff(10 * time.Millisecond),
+		OnStateChange: func(state pshttp.ConnState, _ error) { states <- state },
+	})
+	waitState := func(want pshttp.ConnState) {
+		t.Helper()
+		for {
+			select {
+			case state := <-states:
+				if state == want {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("waiting for %s: %v", want, ctx.Err())
+			}
+		}
+	}
+	receive := func(n int) (have []int) {
+		t.Helper()
+		for range n {
+			select {
+			case v := <-valc:
+				have = append(have, v)
+			case <-ctx.Done():
+				t.Fatalf("received %v: %v", have, ctx.Err())
+			}
+		}
+		return have
+	}
+	waitState(pshttp.StateConnected)
+
+	// Values published before, during, and after the switch from the first
+	// node to the second node, which is also down for a while, all arrive.
+	for i := 1; i <= 10; i++ {
+		nodes[1].Publish(i)
+	}
+	have := receive(10)
+
+	down[0].Store(true)
+	down[1].Store(true)
+	servers[0].CloseClientConnections()
+	waitState(pshttp.StateDisconnected)
+	for i := 11; i <= 20; i++ {
+		nodes[1].Publish(i)
+	}
+	down[1].Store(false)
+	waitState(pshttp.StateConnected)
+	for i := 21; i <= 30; i++ {
+		nodes[1].Publish(i)
+	}
+	have = append(have, receive(20)...)
+
+	for i, v := range have {
+		if want := i + 1; want != v {
+			t.Fatalf("value %d: want %d, have %d (%v)", i, want, v, have)
+		}
+	}
+	if client.Endpoints()[0].Healthy {
+		t.Errorf("first endpoint: want down, have healthy")
+	}
+
+	cancel() // close subscriptions before servers
 }
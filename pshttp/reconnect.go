@@ -0,0 +1,135 @@
+package pshttp
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// ReconnectPolicy decides if, and when, a subscribing [Client] should try to
+// reconnect after a connection attempt fails or an established connection is
+// interrupted.
+type ReconnectPolicy interface {
+	// Next is called after a failed attempt with the number of consecutive
+	// failures so far (starting at 1), the time elapsed since the first of
+	// those failures, and the error that caused the failure. It returns the
+	// delay before the next attempt, or false to give up.
+	Next(attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+}
+
+// ConstantBackoff is a [ReconnectPolicy] that always reconnects, after waiting
+// the same fixed delay.
+type ConstantBackoff time.Duration
+
+// Next implements [ReconnectPolicy].
+func (b ConstantBackoff) Next(int, time.Duration, error) (time.Duration, bool) {
+	return time.Duration(b), true
+}
+
+// ExponentialBackoff is a [ReconnectPolicy] that grows the delay between
+// attempts exponentially, with random jitter, so that many clients
+// disconnected at the same moment don't reconnect in lockstep.
+type ExponentialBackoff struct {
+	// Initial is the delay before the first reconnect attempt. If zero, a
+	// default of 1s is used.
+	Initial time.Duration
+
+	// Max caps the delay between attempts. If zero, a default of 30s is used.
+	Max time.Duration
+
+	// Multiplier is applied to the delay after every failed attempt. If less
+	// than 1, a default of 2 is used.
+	Multiplier float64
+
+	// Jitter is the fraction of each delay, between 0 and 1, that is
+	// randomized. A jitter of 0.5 means a nominal delay of 10s becomes a random
+	// delay between 5s and 10s. If zero, a default of 0.2 is used. If
+	// negative, no jitter is applied.
+	Jitter float64
+
+	// MaxAttempts is the maximum number of consecutive reconnect attempts
+	// before giving up. If zero, there is no limit.
+	MaxAttempts int
+
+	// MaxElapsed is the maximum amount of time to keep trying, measured from
+	// the first of the consecutive failed attempts. If zero, there is no limit.
+	MaxElapsed time.Duration
+}
+
+// Next implements [ReconnectPolicy].
+func (b *ExponentialBackoff) Next(attempt int, elapsed time.Duration, _ error) (time.Duration, bool) {
+	var (
+		initial    = b.Initial
+		limit      = b.Max
+		multiplier = b.Multiplier
+		jitter     = min(b.Jitter, 1)
+	)
+	if initial <= 0 {
+		initial = 1 * time.Second
+	}
+	if limit <= 0 {
+		limit = 30 * time.Second
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	if jitter == 0 {
+		jitter = 0.2
+	}
+
+	if b.MaxAttempts > 0 && attempt > b.MaxAttempts {
+		return 0, false
+	}
+
+	if b.MaxElapsed > 0 && elapsed >= b.MaxElapsed {
+		return 0, false
+	}
+
+	delay := float64(initial)
+	for i := 1; i < attempt && delay < float64(limit); i++ {
+		delay *= multiplier
+	}
+	delay = min(delay, float64(limit))
+
+	if jitter > 0 {
+		delay -= delay * jitter * rand.Float64()
+	}
+
+	return time.Duration(delay), true
+}
+
+// ConnState describes the state of a subscription connection, and is reported
+// to [SubscribeConfig.OnStateChange] as it changes.
+type ConnState int
+
+const (
+	// StateConnecting means a connection attempt is in progress.
+	StateConnecting ConnState = iota
+
+	// StateConnected means the connection is established, and events are
+	// being received.
+	StateConnected
+
+	// StateDisconnected means a connection attempt failed, or an established
+	// connection was interrupted. A reconnect may follow.
+	StateDisconnected
+
+	// StateGaveUp means the subscription has terminated with an error, and no
+	// further reconnect attempts will be made.
+	StateGaveUp
+)
+
+// String implements fmt.Stringer.
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateGaveUp:
+		return "gave up"
+	default:
+		return "unknown"
+	}
+}
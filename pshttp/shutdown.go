@@ -0,0 +1,42 @@
+package pshttp
+
+import (
+	"context"
+	"errors"
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// Shutdown gracefully drains the handler. New subscribe requests are rejected
+// with 503 Service Unavailable. Every active subscription is unsubscribed from
+// its broker, sent the values that were already buffered, and then sent a
+// final [ShutdownEvent] suggesting a reconnect delay, before the connection is
+// closed. Shutdown blocks until every subscription is closed, or the context
+// is canceled, whichever comes first.
+//
+// Shutdown doesn't affect publish requests. Callers should typically call
+// Shutdown before [http.Server.Shutdown], which doesn't wait for long-lived
+// subscriptions on its own.
+func (h *Handler[T]) Shutdown(ctx context.Context) error {
+	h.shutdownOnce.Do(func() {
+		// Closing under the lock ensures no subscription is added to the
+		// wait group after this point.
+		h.subsMtx.Lock()
+		defer h.subsMtx.Unlock()
+		h.logger.Info("shutdown", "subscriptions", len(h.subs))
+		close(h.shutdown)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		h.subsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,421 @@
+package pshttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// StreamStats reports the progress of a streaming publish. The handler writes
+// a StreamStats to the response periodically while the stream is active, and
+// once more when the stream ends.
+type StreamStats struct {
+	// Values is the number of values received so far.
+	Values uint64 `json:"values"`
+
+	// Errors is the number of received values that couldn't be decoded, and
+	// therefore weren't published.
+	Errors uint64 `json:"errors"`
+
+	// Stats is the sum of the stats of every published value.
+	Stats ps.Stats `json:"stats"`
+
+	// Error is the most recent error, if any.
+	Error string `json:"error,omitempty"`
+}
+
+func (h *Handler[T]) handlePublishStream(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizePublish(w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.respondError(w, r, http.StatusInternalServerError, fmt.Errorf("response writer must support flushing"))
+		return
+	}
+
+	codec, err := h.codecs.forLines(r)
+	if err != nil {
+		h.respondError(w, r, http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	// Values are rate limited as they're read, but clients which are already
+	// rate limited are rejected before the topic is acquired.
+	if !h.checkPublishRate(w, r, 1) {
+		return
+	}
+
+	broker, release, ok := h.acquireBroker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// HTTP/1 servers consume the request body before writing the response by
+	// default. Streaming stats while publishing requires full duplex. HTTP/2 is
+	// always full duplex, and returns an error here that can be ignored.
+	http.NewResponseController(w).EnableFullDuplex()
+
+	var (
+		logger   = h.requestLogger(r)
+		start    = time.Now()
+		interval = parseDefault(r.URL.Query().Get("interval"), parseDurationMinMax(100*time.Millisecond, 60*time.Second), 1*time.Second)
+		mtx      sync.Mutex
+		stats    StreamStats
+		done     = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+
+		maxLine := 16 * 1024 * 1024
+		if n := h.limits.MaxPublishBytes; n > 0 && n < int64(maxLine) {
+			maxLine = int(n)
+		}
+
+		s := bufio.NewScanner(r.Body)
+		s.Buffer(nil, maxLine)
+		for s.Scan() {
+			line := bytes.TrimSpace(s.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			// Rather than rejecting values beyond the publish rate, slow
+			// down the stream, which applies backpressure to the client.
+			if err := h.waitPublishRate(r, 1); err != nil {
+				break
+			}
+
+			var v T
+			err := codec.Decode(bytes.NewReader(line), &v)
+
+			mtx.Lock()
+			stats.Values++
+			if err != nil {
+				stats.Errors++
+				stats.Error = err.Error()
+			} else {
+				stats.Stats = addStats(stats.Stats, broker.Publish(v))
+			}
+			mtx.Unlock()
+		}
+
+		if err := s.Err(); err != nil {
+			if errors.Is(err, bufio.ErrTooLong) {
+				err = fmt.Errorf("value exceeds %d bytes", maxLine)
+			}
+			mtx.Lock()
+			stats.Error = fmt.Sprintf("read body: %v", err)
+			mtx.Unlock()
+		}
+	}()
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var (
+		enc    = json.NewEncoder(w)
+		ticker = time.NewTicker(interval)
+		write  = func() error {
+			mtx.Lock()
+			snapshot := stats
+			mtx.Unlock()
+			if err := enc.Encode(snapshot); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := write(); err != nil {
+				logger.Warn("publish stream: write stats", "error", err)
+				<-done // the body can't be read after the handler returns
+				return
+			}
+
+		case <-done:
+			err := write()
+			logger.Info("publish stream",
+				"values", stats.Values,
+				"errors", stats.Errors,
+				statsAttr(stats.Stats),
+				"duration", time.Since(start),
+				"error", err,
+			)
+			return
+		}
+	}
+}
+
+// ErrPublisherClosed is returned by [Publisher] methods after the publisher
+// has been closed.
+var ErrPublisherClosed = errors.New("publisher closed")
+
+// PublisherConfig enumerates the optional parameters for a [Publisher].
+type PublisherConfig struct {
+	// Buffer is the number of values that can be queued by Publish before it
+	// blocks. If zero, a default of 1000 is used.
+	Buffer int
+
+	// Interval is how often the handler should report stats for the stream.
+	// If zero, the handler's default is used.
+	Interval time.Duration
+}
+
+// Publisher publishes a continuous stream of values to a remote pub/sub broker
+// over a single long-lived request. Values are queued by Publish, and written
+// to the connection in the background. Publishers are constructed by
+// [Client.NewPublisher].
+type Publisher[T any] struct {
+	encode func(T, *bytes.Buffer) error
+	ops    chan publisherOp
+	done   chan struct{}
+	resp   chan struct{}
+	cancel context.CancelFunc
+
+	closeMtx sync.RWMutex
+	closed   bool
+
+	mtx   sync.Mutex
+	err   error
+	stats StreamStats
+}
+
+type publisherOp struct {
+	line  []byte
+	flush chan struct{} // if non-nil, op is a flush
+	close bool
+}
+
+// NewPublisher opens a streaming publish connection to the remote pub/sub
+// broker. The context governs the lifetime of the connection: canceling it
+// aborts the stream. Callers must call Close when finished publishing.
+func (c *Client[T]) NewPublisher(ctx context.Context, config PublisherConfig) (*Publisher[T], error) {
+	if config.Buffer <= 0 {
+		config.Buffer = 1000
+	}
+
+	u, err := url.Parse(c.endpoint("stream"))
+	if err != nil {
+		return nil, fmt.Errorf("parse URI: %w", err)
+	}
+	if config.Interval > 0 {
+		q := u.Query()
+		q.Set("interval", config.Interval.String())
+		u.RawQuery = q.Encode()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("content-type", c.lineContentType())
+
+	resp, err := c.do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("execute request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, newStatusError(resp)
+	}
+
+	p := &Publisher[T]{
+		encode: c.encodeLine,
+		ops:    make(chan publisherOp, config.Buffer),
+		done:   make(chan struct{}),
+		resp:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	go p.writeLoop(pw)
+	go p.readLoop(resp.Body)
+
+	return p, nil
+}
+
+// Publish encodes the value v, and queues it to be written to the connection.
+// It blocks if the queue is full, until there is room, the context is
+// canceled, or the connection fails. Every value must encode to a single line.
+func (p *Publisher[T]) Publish(ctx context.Context, v T) error {
+	var buf bytes.Buffer
+	if err := p.encode(v, &buf); err != nil {
+		return err
+	}
+	return p.enqueue(ctx, publisherOp{line: buf.Bytes()})
+}
+
+// Flush blocks until every value queued by Publish before the call to Flush
+// has been written to the connection.
+func (p *Publisher[T]) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	if err := p.enqueue(ctx, publisherOp{flush: flushed}); err != nil {
+		return err
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-p.done:
+		return p.failure()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close writes every queued value to the connection, ends the stream, and
+// waits for the final stats from the handler.
+func (p *Publisher[T]) Close() (StreamStats, error) {
+	defer p.cancel()
+
+	p.closeMtx.Lock()
+	closed := p.closed
+	p.closed = true
+	p.closeMtx.Unlock()
+
+	if !closed {
+		select {
+		case p.ops <- publisherOp{close: true}:
+		case <-p.done:
+		}
+	}
+
+	<-p.done
+	<-p.resp
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.stats, p.err
+}
+
+// Stats returns the most recent stats reported by the handler.
+func (p *Publisher[T]) Stats() StreamStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.stats
+}
+
+func (p *Publisher[T]) enqueue(ctx context.Context, op publisherOp) error {
+	p.closeMtx.RLock()
+	defer p.closeMtx.RUnlock()
+
+	if p.closed {
+		return ErrPublisherClosed
+	}
+
+	select {
+	case p.ops <- op:
+		return nil
+	case <-p.done:
+		return p.failure()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// failure returns the error that terminated the publisher.
+func (p *Publisher[T]) failure() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return ErrPublisherClosed
+}
+
+func (p *Publisher[T]) fail(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *Publisher[T]) writeLoop(pw *io.PipeWriter) {
+	defer close(p.done)
+
+	bw := bufio.NewWriter(pw)
+
+	err := func() error {
+		for op := range p.ops {
+			switch {
+			case op.close:
+				return bw.Flush()
+
+			case op.flush != nil:
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+				close(op.flush)
+
+			default:
+				if _, err := bw.Write(op.line); err != nil {
+					return err
+				}
+			}
+
+			// Flush whenever the queue is drained, so values are written
+			// promptly, but batched when they're published quickly.
+			if len(p.ops) == 0 {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		p.fail(fmt.Errorf("write stream: %w", err))
+	}
+
+	pw.CloseWithError(err)
+}
+
+func (p *Publisher[T]) readLoop(body io.ReadCloser) {
+	defer close(p.resp)
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var stats StreamStats
+		err := dec.Decode(&stats)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			p.fail(fmt.Errorf("read stream stats: %w", err))
+			p.cancel() // unblock the write loop
+			return
+		}
+
+		p.mtx.Lock()
+		p.stats = stats
+		p.mtx.Unlock()
+	}
+}
@@ -1,15 +1,28 @@
 package pshttp
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/peterbourgon/ps"
 )
 
 func respondJSON(w http.ResponseWriter, code int, response any) error {
+	if err, ok := response.(error); ok {
+		response = struct {
+			Error string `json:"error"`
+		}{
+			Error: err.Error(),
+		}
+	}
 	body, err := json.MarshalIndent(response, "", "    ")
 	if err != nil {
 		body = []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error()))
@@ -20,6 +33,15 @@ func respondJSON(w http.ResponseWriter, code int, response any) error {
 	return err
 }
 
+// statsAttr returns a log attribute for the given stats.
+func statsAttr(stats ps.Stats) slog.Attr {
+	return slog.Group("stats",
+		"skips", stats.Skips,
+		"sends", stats.Sends,
+		"drops", stats.Drops,
+	)
+}
+
 func requestExplicitlyAccepts(r *http.Request, acceptable ...string) bool {
 	accept := parseAcceptMediaTypes(r)
 	for _, want := range acceptable {
@@ -61,3 +83,36 @@ func parseDurationMinMax(min, max time.Duration) func(string) (time.Duration, er
 		return d, nil
 	}
 }
+
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(s); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+func addStats(a, b ps.Stats) ps.Stats {
+	return ps.Stats{
+		Skips: a.Skips + b.Skips,
+		Sends: a.Sends + b.Sends,
+		Drops: a.Drops + b.Drops,
+	}
+}
+
+// validEventID returns true if the ID can be sent as the ID of a server-sent
+// event, which can't contain newlines or NUL.
+func validEventID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "\r\n\x00")
+}
+
+// validEventData returns true if the data can be sent as the data of a
+// server-sent event as is, which must be UTF-8, and loses carriage returns.
+func validEventData(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, '\r') < 0
+}
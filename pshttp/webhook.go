@@ -0,0 +1,531 @@
+package pshttp
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// Headers set on every webhook delivery request.
+const (
+	// WebhookDeliveryHeader is a unique identifier for each delivered value,
+	// which is the same for every attempt to deliver the value.
+	WebhookDeliveryHeader = "X-PS-Delivery"
+
+	// WebhookAttemptHeader is the attempt number of the delivery, starting
+	// at 1.
+	WebhookAttemptHeader = "X-PS-Attempt"
+
+	// WebhookTimestampHeader is the Unix time of the delivery attempt, in
+	// seconds. It's part of the signed payload.
+	WebhookTimestampHeader = "X-PS-Timestamp"
+
+	// WebhookSignatureHeader is the signature of the delivery, if a secret is
+	// configured, see [SignWebhook].
+	WebhookSignatureHeader = "X-PS-Signature"
+)
+
+var (
+	// ErrInvalidSignature is returned by [VerifyWebhook] for deliveries with
+	// missing or invalid signatures.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+
+	errCircuitOpen = errors.New("circuit open")
+	errQueueFull   = errors.New("retry queue full")
+)
+
+// SignWebhook returns the signature of a webhook delivery, which is
+// "sha256=" followed by the hex encoded HMAC-SHA256 of the timestamp header, a
+// period, and the body, keyed by the secret.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook delivery request with the
+// given body, and returns [ErrInvalidSignature] if it doesn't match. Receivers
+// should also reject deliveries with old timestamps, to prevent replays.
+func VerifyWebhook(secret []byte, header http.Header, body []byte) error {
+	var (
+		timestamp = header.Get(WebhookTimestampHeader)
+		have      = header.Get(WebhookSignatureHeader)
+		want      = SignWebhook(secret, timestamp, body)
+	)
+	if timestamp == "" || !hmac.Equal([]byte(want), []byte(have)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// CircuitState is the state of the circuit breaker of a [Webhook].
+type CircuitState int
+
+const (
+	// CircuitClosed means deliveries are attempted normally.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen means the endpoint failed repeatedly, and deliveries aren't
+	// attempted until the cooldown elapses.
+	CircuitOpen
+
+	// CircuitHalfOpen means the cooldown elapsed, and the next delivery is a
+	// trial: if it succeeds, the circuit closes, otherwise it opens again.
+	CircuitHalfOpen
+)
+
+// String implements fmt.Stringer.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "CircuitState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// WebhookStats describes the deliveries of a [Webhook].
+type WebhookStats struct {
+	// Subscription is the stats of the webhook's subscription to the broker.
+	// Drops are values that weren't received from the broker because the
+	// webhook was busy delivering previous values.
+	Subscription ps.Stats `json:"subscription"`
+
+	// Delivered are values that were delivered successfully.
+	Delivered uint64 `json:"delivered"`
+
+	// Retries are delivery attempts after the first.
+	Retries uint64 `json:"retries"`
+
+	// Failed are values that weren't delivered, because the endpoint rejected
+	// them, or the retry policy gave up.
+	Failed uint64 `json:"failed"`
+
+	// Dropped are values that weren't delivered, because the retry queue was
+	// full.
+	Dropped uint64 `json:"dropped"`
+
+	// Queued is the number of values currently waiting to be retried.
+	Queued int `json:"queued"`
+
+	// Circuit is the current state of the circuit breaker.
+	Circuit CircuitState `json:"circuit"`
+}
+
+// WebhookConfig enumerates the parameters for a webhook returned by
+// [NewWebhook]. URL is required.
+type WebhookConfig[T any] struct {
+	// URL of the endpoint, which receives every value in a POST request.
+	URL string
+
+	// Encode encodes values into request bodies. If nil, [EncodeJSON] is used.
+	Encode EncodeFunc[T]
+
+	// ContentType of request bodies. If empty, application/json is used.
+	ContentType string
+
+	// Secret, if non-empty, is used to sign every request, see
+	// [SignWebhook].
+	Secret []byte
+
+	// Header, if non-nil, is added to every request.
+	Header http.Header
+
+	// HTTPClient is used to make requests. If nil, [http.DefaultClient] is
+	// used.
+	HTTPClient *http.Client
+
+	// Timeout of every delivery attempt. If zero, 10s is used.
+	Timeout time.Duration
+
+	// Retry decides if and when to retry failed deliveries. Responses with
+	// status codes in the 4xx range, except 408 and 429, aren't retried. If
+	// nil, an [ExponentialBackoff] of at most 5 attempts is used.
+	Retry ReconnectPolicy
+
+	// Buffer of the subscription to the broker. If zero, 100 is used.
+	Buffer int
+
+	// QueueSize is the maximum number of values waiting to be retried. Values
+	// which fail while the queue is full are dropped. If zero, 1000 is used.
+	QueueSize int
+
+	// BreakerThreshold is the number of consecutive failed attempts which
+	// open the circuit breaker. If zero, 5 is used.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the circuit breaker stays open, before a
+	// trial delivery is attempted. If zero, 30s is used.
+	BreakerCooldown time.Duration
+
+	// Logger receives log output from the webhook. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+}
+
+// Webhook is a subscriber which delivers values to an HTTP endpoint, one POST
+// request per value. Failed deliveries are retried in the background, up to a
+// limit, and a circuit breaker stops deliveries to endpoints which fail
+// repeatedly.
+type Webhook[T any] struct {
+	url         string
+	encode      EncodeFunc[T]
+	contentType string
+	sign        func(h http.Header, timestamp string, body []byte)
+	header      http.Header
+	client      *http.Client
+	timeout     time.Duration
+	retry       ReconnectPolicy
+	buffer      int
+	queueSize   int
+	threshold   int
+	cooldown    time.Duration
+	logger      *slog.Logger
+
+	mtx       sync.Mutex
+	stats     WebhookStats
+	failures  int // consecutive
+	openUntil time.Time
+	broker    *ps.Broker[T]
+	c         chan T
+}
+
+// NewWebhook returns a new webhook for the configured endpoint.
+func NewWebhook[T any](config WebhookConfig[T]) (*Webhook[T], error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid URL scheme %q", u.Scheme)
+	}
+
+	if config.Encode == nil {
+		config.Encode = EncodeJSON[T]
+	}
+	if config.ContentType == "" {
+		config.ContentType = "application/json"
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Retry == nil {
+		config.Retry = &ExponentialBackoff{Initial: time.Second, Max: time.Minute, Jitter: 0.5, MaxAttempts: 4}
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 100
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1000
+	}
+	if config.BreakerThreshold <= 0 {
+		config.BreakerThreshold = 5
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = 30 * time.Second
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	var sign func(http.Header, string, []byte)
+	if secret := config.Secret; len(secret) > 0 {
+		sign = func(h http.Header, timestamp string, body []byte) {
+			h.Set(WebhookSignatureHeader, SignWebhook(secret, timestamp, body))
+		}
+	}
+
+	return &Webhook[T]{
+		url:         u.String(),
+		encode:      config.Encode,
+		contentType: config.ContentType,
+		sign:        sign,
+		header:      config.Header,
+		client:      config.HTTPClient,
+		timeout:     config.Timeout,
+		retry:       config.Retry,
+		buffer:      config.Buffer,
+		queueSize:   config.QueueSize,
+		threshold:   config.BreakerThreshold,
+		cooldown:    config.BreakerCooldown,
+		logger:      config.Logger.With("component", "pshttp.Webhook", "url", u.Redacted()),
+	}, nil
+}
+
+// Run subscribes to the broker with the allow func, and delivers matching
+// values to the endpoint. It blocks until the context is canceled, and
+// returns the context error. Values waiting to be retried at that point are
+// abandoned. Run may only be called once at a time.
+func (w *Webhook[T]) Run(ctx context.Context, broker *ps.Broker[T], allow func(T) bool) error {
+	c := make(chan T, w.buffer)
+	if err := broker.Subscribe(c, allow); err != nil {
+		return err
+	}
+
+	w.mtx.Lock()
+	w.broker, w.c = broker, c
+	w.mtx.Unlock()
+
+	defer func() {
+		stats, _ := broker.Unsubscribe(c)
+		w.mtx.Lock()
+		w.stats.Subscription = stats
+		w.broker, w.c = nil, nil
+		w.mtx.Unlock()
+	}()
+
+	var (
+		queue deliveryQueue
+		timer = time.NewTimer(time.Hour)
+	)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		// Wake up when the earliest retry is due.
+		var due <-chan time.Time
+		if len(queue) > 0 {
+			timer.Reset(time.Until(queue[0].next))
+			due = timer.C
+		}
+
+		select {
+		case v := <-c:
+			var buf bytes.Buffer
+			if err := w.encode(v, &buf); err != nil {
+				w.logger.Error("encode value", "error", err)
+				w.count(func(s *WebhookStats) { s.Failed++ })
+				break
+			}
+			d := &delivery{id: newDeliveryID(), body: buf.Bytes()}
+			w.attempt(ctx, d, &queue)
+
+		case <-due:
+			d := heap.Pop(&queue).(*delivery)
+			w.attempt(ctx, d, &queue)
+
+		case <-ctx.Done():
+			w.count(func(s *WebhookStats) { s.Queued = 0 })
+			return ctx.Err()
+		}
+
+		timer.Stop()
+		w.count(func(s *WebhookStats) { s.Queued = len(queue) })
+	}
+}
+
+// Stats returns the current delivery stats of the webhook.
+func (w *Webhook[T]) Stats() WebhookStats {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	stats := w.stats
+	if w.broker != nil {
+		stats.Subscription, _ = w.broker.Stats(w.c)
+	}
+	stats.Circuit = w.circuit(time.Now())
+	return stats
+}
+
+// attempt to deliver d, and queue it for retry if it fails.
+func (w *Webhook[T]) attempt(ctx context.Context, d *delivery, queue *deliveryQueue) {
+	now := time.Now()
+
+	w.mtx.Lock()
+	circuit, openUntil := w.circuit(now), w.openUntil
+	w.mtx.Unlock()
+
+	// While the circuit is open, deliveries wait for the trial delivery,
+	// without using up attempts.
+	if circuit == CircuitOpen {
+		d.next = openUntil
+		w.enqueue(d, queue, errCircuitOpen)
+		return
+	}
+
+	if d.attempt == 0 {
+		d.first = now
+	}
+	d.attempt++
+	if d.attempt > 1 {
+		w.count(func(s *WebhookStats) { s.Retries++ })
+	}
+
+	err := w.post(ctx, d)
+	if err == nil {
+		w.mtx.Lock()
+		w.stats.Delivered++
+		w.failures = 0
+		w.openUntil = time.Time{}
+		w.mtx.Unlock()
+		w.logger.Debug("delivered", "delivery", d.id, "attempt", d.attempt)
+		return
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Rejected deliveries mean the endpoint is alive, so they don't count
+	// towards the circuit breaker, and aren't retried.
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && isPermanentStatus(statusErr.StatusCode) {
+		w.logger.Warn("delivery rejected", "delivery", d.id, "attempt", d.attempt, "error", err)
+		w.mtx.Lock()
+		w.stats.Failed++
+		w.failures = 0
+		w.openUntil = time.Time{}
+		w.mtx.Unlock()
+		return
+	}
+
+	var retryAfter time.Duration
+	if statusErr != nil {
+		retryAfter = statusErr.RetryAfter
+	}
+
+	w.mtx.Lock()
+	w.failures++
+	if w.failures >= w.threshold || circuit == CircuitHalfOpen {
+		w.logger.Warn("circuit opened", "failures", w.failures, "cooldown", w.cooldown, "error", err)
+		w.openUntil = now.Add(w.cooldown)
+	}
+	w.mtx.Unlock()
+
+	delay, ok := w.retry.Next(d.attempt, now.Sub(d.first), err)
+	if !ok {
+		w.logger.Warn("delivery failed", "delivery", d.id, "attempt", d.attempt, "error", err)
+		w.count(func(s *WebhookStats) { s.Failed++ })
+		return
+	}
+
+	d.next = now.Add(max(delay, retryAfter))
+	w.enqueue(d, queue, err)
+}
+
+// enqueue d for retry, or drop it if the queue is full.
+func (w *Webhook[T]) enqueue(d *delivery, queue *deliveryQueue, cause error) {
+	if len(*queue) >= w.queueSize {
+		w.logger.Warn("delivery dropped", "delivery", d.id, "error", errQueueFull, "cause", cause)
+		w.count(func(s *WebhookStats) { s.Dropped++ })
+		return
+	}
+	w.logger.Debug("delivery queued", "delivery", d.id, "attempt", d.attempt, "next", d.next, "cause", cause)
+	heap.Push(queue, d)
+}
+
+// post makes a single delivery attempt. Non-2xx responses are returned as a
+// [StatusError].
+func (w *Webhook[T]) post(ctx context.Context, d *delivery) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(d.body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	for k, vs := range w.header {
+		req.Header[k] = vs
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("content-type", w.contentType)
+	req.Header.Set(WebhookDeliveryHeader, d.id)
+	req.Header.Set(WebhookAttemptHeader, strconv.Itoa(d.attempt))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if w.sign != nil {
+		w.sign(req.Header, timestamp, d.body)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newStatusError(resp)
+	}
+
+	return nil
+}
+
+// circuit returns the state of the circuit breaker. The mutex must be held.
+func (w *Webhook[T]) circuit(now time.Time) CircuitState {
+	switch {
+	case w.openUntil.IsZero():
+		return CircuitClosed
+	case now.Before(w.openUntil):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+func (w *Webhook[T]) count(f func(*WebhookStats)) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	f(&w.stats)
+}
+
+// isPermanentStatus returns true for status codes which won't change if the
+// delivery is retried.
+func isPermanentStatus(code int) bool {
+	return code >= 400 && code <= 499 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+// delivery is a single value being delivered to a webhook.
+type delivery struct {
+	id      string
+	body    []byte
+	attempt int
+	first   time.Time // of the first attempt
+	next    time.Time // of the next attempt
+}
+
+// deliveryQueue is a min-heap of deliveries, ordered by their next attempt.
+type deliveryQueue []*delivery
+
+func (q deliveryQueue) Len() int           { return len(q) }
+func (q deliveryQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q deliveryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *deliveryQueue) Push(x any)        { *q = append(*q, x.(*delivery)) }
+
+func (q *deliveryQueue) Pop() any {
+	old := *q
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return d
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,464 @@
+package pshttp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// HubSignatureHeader is the signature of WebSub content distribution requests
+// to subscribers which provided a secret, see [SignHub].
+const HubSignatureHeader = "X-Hub-Signature"
+
+// SignHub returns the WebSub signature of the body, which is "sha256="
+// followed by the hex encoded HMAC-SHA256 of the body, keyed by the secret.
+func SignHub(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// HubConfig enumerates the parameters for a hub returned by [NewHub]. Exactly
+// one of Broker or Registry is required.
+type HubConfig[T any] struct {
+	// Broker, if non-nil, is the only broker served by the hub. Any topic is
+	// accepted in subscription requests, and every subscription receives
+	// every value published to the broker.
+	Broker *ps.Broker[T]
+
+	// Registry, if non-nil, contains the brokers served by the hub. The topic
+	// of each subscription request is the name of a topic in the registry.
+	Registry *ps.Registry[T]
+
+	// URL is the public URL of the hub. If non-empty, it's advertised to
+	// subscribers in the Link header of every content distribution request.
+	URL string
+
+	// Encode encodes values into content distribution requests. If nil,
+	// [EncodeJSON] is used.
+	Encode EncodeFunc[T]
+
+	// ContentType of content distribution requests. If empty,
+	// application/json is used.
+	ContentType string
+
+	// HTTPClient is used to verify intent, and deliver content. If nil,
+	// [http.DefaultClient] is used.
+	HTTPClient *http.Client
+
+	// DefaultLease is used for subscription requests that don't specify a
+	// lease. If zero, 24h is used. Requested leases are clamped to MinLease
+	// and MaxLease, which default to 1m and 30 days.
+	DefaultLease time.Duration
+
+	// MinLease is the minimum lease of a subscription. See DefaultLease.
+	MinLease time.Duration
+
+	// MaxLease is the maximum lease of a subscription. See DefaultLease.
+	MaxLease time.Duration
+
+	// Timeout of intent verification, and of every content distribution
+	// attempt. If zero, 10s is used.
+	Timeout time.Duration
+
+	// Retry decides if and when to retry failed content distribution. See
+	// [WebhookConfig.Retry].
+	Retry ReconnectPolicy
+
+	// Logger receives log output from the hub. If nil, logs are discarded.
+	Logger *slog.Logger
+}
+
+// Hub is an [http.Handler] which implements the hub of the WebSub protocol,
+// for subscribers which can't hold a long-lived connection, and receive
+// callbacks instead.
+//
+// Subscribers POST a form with hub.mode of subscribe or unsubscribe, the
+// hub.topic, a hub.callback URL, and optionally hub.lease_seconds and
+// hub.secret. The hub responds with 202 Accepted, and verifies the intent of
+// the subscriber asynchronously, with a GET request to the callback URL, which
+// must echo the hub.challenge query parameter. Afterwards, every value
+// published to the topic is delivered to the callback URL by a [Webhook], and
+// signed with [SignHub] if a secret was provided, until the lease expires.
+type Hub[T any] struct {
+	broker       *ps.Broker[T]
+	registry     *ps.Registry[T]
+	url          string
+	encode       EncodeFunc[T]
+	contentType  string
+	client       *http.Client
+	defaultLease time.Duration
+	minLease     time.Duration
+	maxLease     time.Duration
+	timeout      time.Duration
+	retry        ReconnectPolicy
+	logger       *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mtx  sync.Mutex
+	subs map[hubKey]*hubSubscription[T]
+}
+
+// HubSubscription describes an active subscription of a [Hub].
+type HubSubscription struct {
+	// Topic of the subscription.
+	Topic string `json:"topic"`
+
+	// Callback URL of the subscriber.
+	Callback string `json:"callback"`
+
+	// Expires is when the lease of the subscription expires.
+	Expires time.Time `json:"expires"`
+
+	// Stats of deliveries to the callback URL.
+	Stats WebhookStats `json:"stats"`
+}
+
+type hubKey struct {
+	topic    string
+	callback string
+}
+
+type hubSubscription[T any] struct {
+	expires time.Time
+	webhook *Webhook[T]
+	cancel  context.CancelFunc
+}
+
+// hubRequest is a validated subscription request.
+type hubRequest struct {
+	mode   string
+	key    hubKey
+	lease  time.Duration
+	secret string
+}
+
+// NewHub returns a new hub for the configured broker or registry. Call
+// [Hub.Close] to end every subscription when the hub is no longer used.
+func NewHub[T any](config HubConfig[T]) (*Hub[T], error) {
+	if (config.Broker == nil) == (config.Registry == nil) {
+		return nil, fmt.Errorf("exactly one of broker or registry is required")
+	}
+	if config.Encode == nil {
+		config.Encode = EncodeJSON[T]
+	}
+	if config.ContentType == "" {
+		config.ContentType = "application/json"
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.MinLease <= 0 {
+		config.MinLease = time.Minute
+	}
+	if config.MaxLease <= 0 {
+		config.MaxLease = 30 * 24 * time.Hour
+	}
+	if config.DefaultLease <= 0 {
+		config.DefaultLease = 24 * time.Hour
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Hub[T]{
+		broker:       config.Broker,
+		registry:     config.Registry,
+		url:          config.URL,
+		encode:       config.Encode,
+		contentType:  config.ContentType,
+		client:       config.HTTPClient,
+		defaultLease: config.DefaultLease,
+		minLease:     config.MinLease,
+		maxLease:     config.MaxLease,
+		timeout:      config.Timeout,
+		retry:        config.Retry,
+		logger:       config.Logger.With("component", "pshttp.Hub"),
+		ctx:          ctx,
+		cancel:       cancel,
+		subs:         map[hubKey]*hubSubscription[T]{},
+	}, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Hub[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req, err := h.parseRequest(r.PostForm)
+	if err != nil {
+		h.logger.Debug("invalid request", "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.logger.Debug("request", "mode", req.mode, "topic", req.key.topic, "callback", req.key.callback, "lease", req.lease)
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.verify(req)
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Hub[T]) parseRequest(form url.Values) (hubRequest, error) {
+	req := hubRequest{
+		mode: form.Get("hub.mode"),
+		key: hubKey{
+			topic:    form.Get("hub.topic"),
+			callback: form.Get("hub.callback"),
+		},
+		lease:  h.defaultLease,
+		secret: form.Get("hub.secret"),
+	}
+
+	switch req.mode {
+	case "subscribe", "unsubscribe":
+	default:
+		return hubRequest{}, fmt.Errorf("invalid hub.mode %q", req.mode)
+	}
+
+	if req.key.topic == "" {
+		return hubRequest{}, fmt.Errorf("hub.topic is required")
+	}
+	if h.registry != nil {
+		// The topic is only acquired once the subscription is verified, so
+		// requests can't create topics.
+		if err := h.registry.Check(req.key.topic); err != nil {
+			return hubRequest{}, fmt.Errorf("hub.topic: %w", err)
+		}
+	}
+
+	u, err := url.Parse(req.key.callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return hubRequest{}, fmt.Errorf("invalid hub.callback %q", req.key.callback)
+	}
+
+	if s := form.Get("hub.lease_seconds"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return hubRequest{}, fmt.Errorf("invalid hub.lease_seconds %q", s)
+		}
+		req.lease = time.Duration(n) * time.Second
+	}
+	req.lease = min(max(req.lease, h.minLease), h.maxLease)
+
+	if len(req.secret) >= 200 {
+		return hubRequest{}, fmt.Errorf("hub.secret must be less than 200 bytes")
+	}
+
+	return req, nil
+}
+
+// verify the intent of the subscriber, and then apply the request.
+func (h *Hub[T]) verify(req hubRequest) {
+	logger := h.logger.With("mode", req.mode, "topic", req.key.topic, "callback", req.key.callback)
+
+	if err := h.challenge(req); err != nil {
+		logger.Warn("intent verification failed", "error", err)
+		return
+	}
+
+	switch req.mode {
+	case "subscribe":
+		if err := h.subscribe(req); err != nil {
+			logger.Error("subscribe", "error", err)
+			return
+		}
+		logger.Info("subscribe", "lease", req.lease)
+
+	case "unsubscribe":
+		h.mtx.Lock()
+		sub, ok := h.subs[req.key]
+		delete(h.subs, req.key)
+		h.mtx.Unlock()
+		if ok {
+			sub.cancel()
+		}
+		logger.Info("unsubscribe", "found", ok)
+	}
+}
+
+// challenge sends a GET request to the callback, and checks that it echoes
+// the challenge.
+func (h *Hub[T]) challenge(req hubRequest) error {
+	ctx, cancel := context.WithTimeout(h.ctx, h.timeout)
+	defer cancel()
+
+	challenge := newDeliveryID()
+
+	u, err := url.Parse(req.key.callback)
+	if err != nil {
+		return err
+	}
+	query := u.Query() // callbacks may have their own query parameters
+	query.Set("hub.mode", req.mode)
+	query.Set("hub.topic", req.key.topic)
+	query.Set("hub.challenge", challenge)
+	if req.mode == "subscribe" {
+		query.Set("hub.lease_seconds", strconv.Itoa(int(req.lease.Seconds())))
+	}
+	u.RawQuery = query.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newStatusError(resp)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if strings.TrimSpace(string(body)) != challenge {
+		return fmt.Errorf("response doesn't match challenge")
+	}
+
+	return nil
+}
+
+// subscribe starts delivering values to the callback, until the lease expires,
+// replacing any existing subscription for the same topic and callback.
+func (h *Hub[T]) subscribe(req hubRequest) error {
+	header := http.Header{}
+	if h.url != "" {
+		header.Add("link", fmt.Sprintf("<%s>; rel=\"hub\"", h.url))
+	}
+	header.Add("link", fmt.Sprintf("<%s>; rel=\"self\"", req.key.topic))
+
+	webhook, err := NewWebhook(WebhookConfig[T]{
+		URL:         req.key.callback,
+		Encode:      h.encode,
+		ContentType: h.contentType,
+		Header:      header,
+		HTTPClient:  h.client,
+		Timeout:     h.timeout,
+		Retry:       h.retry,
+		Logger:      h.logger,
+	})
+	if err != nil {
+		return err
+	}
+	if secret := []byte(req.secret); len(secret) > 0 {
+		webhook.sign = func(h http.Header, _ string, body []byte) {
+			h.Set(HubSignatureHeader, SignHub(secret, body))
+		}
+	}
+
+	broker, release := h.broker, func() {}
+	if h.registry != nil {
+		broker, release, err = h.registry.Acquire(req.key.topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	expires := time.Now().Add(req.lease)
+	ctx, cancel := context.WithDeadline(h.ctx, expires)
+	sub := &hubSubscription[T]{
+		expires: expires,
+		webhook: webhook,
+		cancel:  cancel,
+	}
+
+	h.mtx.Lock()
+	prev := h.subs[req.key]
+	h.subs[req.key] = sub
+	h.mtx.Unlock()
+
+	if prev != nil {
+		prev.cancel() // renewed
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer release()
+		defer cancel()
+
+		err := webhook.Run(ctx, broker, func(T) bool { return true })
+
+		h.mtx.Lock()
+		if h.subs[req.key] == sub {
+			delete(h.subs, req.key)
+		}
+		h.mtx.Unlock()
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			h.logger.Info("lease expired", "topic", req.key.topic, "callback", req.key.callback)
+		}
+	}()
+
+	return nil
+}
+
+// Subscriptions returns every active subscription, ordered by topic and
+// callback.
+func (h *Hub[T]) Subscriptions() []HubSubscription {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	res := make([]HubSubscription, 0, len(h.subs))
+	for key, sub := range h.subs {
+		res = append(res, HubSubscription{
+			Topic:    key.topic,
+			Callback: key.callback,
+			Expires:  sub.expires,
+			Stats:    sub.webhook.Stats(),
+		})
+	}
+	slices.SortFunc(res, func(a, b HubSubscription) int {
+		return strings.Compare(a.Topic+"\n"+a.Callback, b.Topic+"\n"+b.Callback)
+	})
+	return res
+}
+
+// Close ends every subscription, and waits for pending verifications and
+// deliveries to stop.
+func (h *Hub[T]) Close() error {
+	h.cancel()
+	h.wg.Wait()
+	return nil
+}
@@ -0,0 +1,15 @@
+// Package psmqtt implements the server side of MQTT 3.1.1 on top of a
+// [ps.Broker], so MQTT clients like IoT devices can publish and subscribe to
+// an in-process pub/sub broker, without a separate MQTT broker.
+//
+// [Server] supports CONNECT with optional authentication, PUBLISH at QoS 0, 1,
+// and 2, SUBSCRIBE and UNSUBSCRIBE with + and # wildcards, retained messages,
+// keepalive via PINGREQ, and last will messages. Every message published by a
+// client is published to the broker as a [Message], and every connected client
+// is a subscriber to the broker.
+//
+// Some parts of the specification aren't implemented. Sessions aren't
+// persisted, so every connection is treated as a clean session, and
+// unacknowledged messages aren't redelivered after reconnects. Subscriptions
+// are granted at most QoS 1.
+package psmqtt
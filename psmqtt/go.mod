@@ -0,0 +1,16 @@
+module github.com/peterbourgon/ps/psmqtt
+
+go 1.24.0
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/peterbourgon/ps v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/gorilla/websocket v1.5.3 // indirect
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/sync v0.19.0 // indirect
+)
+
+replace github.com/peterbourgon/ps => ../
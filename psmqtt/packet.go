@@ -0,0 +1,228 @@
+package psmqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types, from section 2.2.1 of the specification.
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// CONNACK return codes, from section 3.2.2.3 of the specification.
+const (
+	connackAccepted           = 0
+	connackBadProtocolVersion = 1
+	connackIdentifierRejected = 2
+	connackNotAuthorized      = 5
+)
+
+// subackFailure is the SUBACK return code for rejected topic filters.
+const subackFailure byte = 0x80
+
+var (
+	errMalformed      = errors.New("malformed packet")
+	errPacketTooLarge = errors.New("packet too large")
+)
+
+// packet is a single MQTT control packet.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads a single control packet, whose remaining length must not
+// exceed max bytes.
+func readPacket(r *bufio.Reader, max int) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	var (
+		length     int
+		multiplier = 1
+	)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, fmt.Errorf("%w: invalid remaining length", errMalformed)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > max {
+		return packet{}, fmt.Errorf("%w: %d bytes", errPacketTooLarge, length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// writePacket writes a single control packet. It doesn't flush.
+func writePacket(w *bufio.Writer, kind, flags byte, body []byte) error {
+	w.WriteByte(kind<<4 | flags&0x0f)
+
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+
+	_, err := w.Write(body)
+	return err
+}
+
+// decoder reads fields from the body of a packet. The first error is sticky.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	b := d.b[0]
+	d.b = d.b[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	n := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) rest() []byte {
+	b := d.b
+	d.b = nil
+	return b
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, n)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// connectPacket is a decoded CONNECT packet.
+type connectPacket struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepalive    uint16
+	clientID     string
+	will         *Message
+	username     string
+	password     string
+}
+
+func decodeConnect(body []byte) (connectPacket, error) {
+	var (
+		d  = decoder{b: body}
+		cp connectPacket
+	)
+
+	cp.protocol = d.string()
+	cp.level = d.byte()
+	flags := d.byte()
+	cp.keepalive = d.uint16()
+	if d.err != nil {
+		return connectPacket{}, d.err
+	}
+	if flags&0x01 != 0 {
+		return connectPacket{}, fmt.Errorf("%w: reserved connect flag is set", errMalformed)
+	}
+
+	cp.cleanSession = flags&0x02 != 0
+	cp.clientID = d.string()
+
+	if flags&0x04 != 0 {
+		qos := flags >> 3 & 0x03
+		if qos > 2 {
+			return connectPacket{}, fmt.Errorf("%w: invalid will QoS", errMalformed)
+		}
+		cp.will = &Message{
+			Topic:   d.string(),
+			Payload: d.bytes(),
+			QoS:     qos,
+			Retain:  flags&0x20 != 0,
+		}
+	}
+	if flags&0x80 != 0 {
+		cp.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		cp.password = d.string()
+	}
+
+	return cp, d.err
+}
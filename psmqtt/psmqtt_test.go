@@ -0,0 +1,317 @@
+package psmqtt_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/psmqtt"
+)
+
+func TestMatchTopic(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/b/c", false},
+		{"+/+", "a/b", true},
+		{"+", "a", true},
+		{"+/b", "/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b/c", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	} {
+		if want, have := tc.want, psmqtt.MatchTopic(tc.filter, tc.topic); want != have {
+			t.Errorf("MatchTopic(%q, %q): want %v, have %v", tc.filter, tc.topic, want, have)
+		}
+	}
+}
+
+func TestPahoClient(t *testing.T) {
+	t.Parallel()
+
+	server, addr := newTestServer(t, psmqtt.ServerConfig{})
+
+	// Retained before the subscriber connects.
+	if _, err := server.Publish(psmqtt.Message{Topic: "config/mode", Payload: []byte("eco"), Retain: true}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	msgs := make(chan mqtt.Message, 10)
+	sub := newPahoClient(t, addr, "sub")
+	if tok := sub.SubscribeMultiple(map[string]byte{
+		"sensors/+/temp": 1,
+		"config/#":       0,
+	}, func(_ mqtt.Client, m mqtt.Message) { msgs <- m }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe: %v", tok.Error())
+	}
+
+	m := receive(t, msgs)
+	if want, have := "config/mode", m.Topic(); want != have {
+		t.Errorf("retained topic: want %q, have %q", want, have)
+	}
+	if !m.Retained() {
+		t.Errorf("retained message doesn't have the retain flag")
+	}
+
+	pub := newPahoClient(t, addr, "pub")
+	for _, tc := range []struct {
+		topic string
+		qos   byte
+	}{
+		{"sensors/kitchen/temp", 0},
+		{"sensors/kitchen/humidity", 1}, // not subscribed
+		{"sensors/garage/temp", 1},
+		{"sensors/attic/temp", 2},
+	} {
+		if tok := pub.Publish(tc.topic, tc.qos, false, tc.topic); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish %s: %v", tc.topic, tok.Error())
+		}
+	}
+
+	for _, want := range []struct {
+		topic string
+		qos   byte
+	}{
+		{"sensors/kitchen/temp", 0},
+		{"sensors/garage/temp", 1},
+		{"sensors/attic/temp", 1}, // downgraded
+	} {
+		m := receive(t, msgs)
+		if want, have := want.topic, m.Topic(); want != have {
+			t.Errorf("topic: want %q, have %q", want, have)
+		}
+		if want, have := want.topic, string(m.Payload()); want != have {
+			t.Errorf("payload: want %q, have %q", want, have)
+		}
+		if want, have := want.qos, m.Qos(); want != have {
+			t.Errorf("%s: QoS: want %d, have %d", m.Topic(), want, have)
+		}
+		if m.Retained() {
+			t.Errorf("%s: unexpected retain flag", m.Topic())
+		}
+	}
+
+	// Retained messages with empty payloads delete the retained message.
+	if tok := pub.Publish("config/mode", 0, true, ""); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish: %v", tok.Error())
+	}
+	if m := receive(t, msgs); len(m.Payload()) != 0 {
+		t.Errorf("want empty payload, have %q", m.Payload())
+	}
+
+	if tok := sub.Unsubscribe("sensors/+/temp"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe: %v", tok.Error())
+	}
+	if stats, _ := server.Publish(psmqtt.Message{Topic: "sensors/kitchen/temp"}); stats.Sends != 0 {
+		t.Errorf("after unsubscribe: want 0 sends, have %d", stats.Sends)
+	}
+
+	late := newPahoClient(t, addr, "late")
+	if tok := late.Subscribe("config/#", 0, func(_ mqtt.Client, m mqtt.Message) { msgs <- m }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe: %v", tok.Error())
+	}
+	select {
+	case m := <-msgs:
+		t.Errorf("unexpected message %s %q", m.Topic(), m.Payload())
+	case <-time.After(100 * time.Millisecond):
+		// deleted retained message isn't delivered
+	}
+}
+
+func TestBroker(t *testing.T) {
+	t.Parallel()
+
+	broker := ps.NewBroker[psmqtt.Message]()
+	_, addr := newTestServer(t, psmqtt.ServerConfig{Broker: broker})
+
+	local := make(chan psmqtt.Message, 10)
+	if err := broker.Subscribe(local, func(m psmqtt.Message) bool { return psmqtt.MatchTopic("devices/#", m.Topic) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	msgs := make(chan mqtt.Message, 10)
+	client := newPahoClient(t, addr, "device")
+	if tok := client.Subscribe("commands/+", 1, func(_ mqtt.Client, m mqtt.Message) { msgs <- m }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe: %v", tok.Error())
+	}
+
+	if tok := client.Publish("devices/1/status", 1, false, "online"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish: %v", tok.Error())
+	}
+	if m := <-local; m.Topic != "devices/1/status" || string(m.Payload) != "online" || m.QoS != 1 {
+		t.Errorf("local subscriber: unexpected message %+v", m)
+	}
+
+	if stats := broker.Publish(psmqtt.Message{Topic: "commands/reboot", Payload: []byte("now"), QoS: 1}); stats.Sends != 1 {
+		t.Errorf("local publish: want 1 send, have %s", stats)
+	}
+	if m := receive(t, msgs); m.Topic() != "commands/reboot" || string(m.Payload()) != "now" {
+		t.Errorf("client: unexpected message %s %q", m.Topic(), m.Payload())
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newTestServer(t, psmqtt.ServerConfig{
+		Authenticate: func(clientID, username, password string) error {
+			if username != "user" || password != "secret" {
+				return errors.New("bad credentials")
+			}
+			return nil
+		},
+	})
+
+	for _, tc := range []struct {
+		password string
+		ok       bool
+	}{
+		{"secret", true},
+		{"wrong", false},
+	} {
+		opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetUsername("user").SetPassword(tc.password).SetAutoReconnect(false)
+		client := mqtt.NewClient(opts)
+		tok := client.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			t.Fatalf("%s: connect timed out", tc.password)
+		}
+		if want, have := tc.ok, tok.Error() == nil; want != have {
+			t.Errorf("%s: want ok %v, have error %v", tc.password, want, tok.Error())
+		}
+		client.Disconnect(0)
+	}
+}
+
+func TestKeepaliveWill(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newTestServer(t, psmqtt.ServerConfig{})
+
+	msgs := make(chan mqtt.Message, 10)
+	sub := newPahoClient(t, addr, "watcher")
+	if tok := sub.Subscribe("status/#", 1, func(_ mqtt.Client, m mqtt.Message) { msgs <- m }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe: %v", tok.Error())
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// CONNECT with a keepalive of 1s, and a QoS 1 will of status/dev "gone".
+	connect := []byte{
+		0x10, 33,
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		0x0e, // will QoS 1, will flag, clean session
+		0, 1, // keepalive
+		0, 3, 'd', 'e', 'v',
+		0, 10, 's', 't', 'a', 't', 'u', 's', '/', 'd', 'e', 'v',
+		0, 4, 'g', 'o', 'n', 'e',
+	}
+	mustWrite(t, conn, connect)
+	mustRead(t, r, []byte{0x20, 2, 0, 0})
+
+	mustWrite(t, conn, []byte{0xc0, 0}) // PINGREQ
+	mustRead(t, r, []byte{0xd0, 0})     // PINGRESP
+
+	// Silence for 1.5x the keepalive disconnects the client, and publishes
+	// the will.
+	start := time.Now()
+	m := receive(t, msgs)
+	if want, have := "status/dev", m.Topic(); want != have {
+		t.Errorf("will topic: want %q, have %q", want, have)
+	}
+	if want, have := "gone", string(m.Payload()); want != have {
+		t.Errorf("will payload: want %q, have %q", want, have)
+	}
+	if took := time.Since(start); took < time.Second {
+		t.Errorf("will published after %s, before the keepalive expired", took)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("connection wasn't closed")
+	}
+}
+
+func newTestServer(t *testing.T, config psmqtt.ServerConfig) (*psmqtt.Server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	server := psmqtt.NewServer(config)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return server, ln.Addr().String()
+}
+
+func newPahoClient(t *testing.T, addr, clientID string) mqtt.Client {
+	t.Helper()
+
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetClientID(clientID).SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect: %v", tok.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	return client
+}
+
+func receive(t *testing.T, msgs <-chan mqtt.Message) mqtt.Message {
+	t.Helper()
+
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for message")
+		return nil
+	}
+}
+
+func mustWrite(t *testing.T, conn net.Conn, b []byte) {
+	t.Helper()
+
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func mustRead(t *testing.T, r *bufio.Reader, want []byte) {
+	t.Helper()
+
+	have := make([]byte, len(want))
+	for i := range have {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		have[i] = b
+	}
+	if string(want) != string(have) {
+		t.Fatalf("want %x, have %x", want, have)
+	}
+}
@@ -0,0 +1,680 @@
+package psmqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+)
+
+// ErrServerClosed is returned by [Server.Serve] after the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Message is an application message, as published by MQTT clients to the
+// broker of a [Server].
+type Message struct {
+	// Topic name, e.g. "sensors/kitchen/temperature".
+	Topic string
+
+	// Payload is the opaque content of the message.
+	Payload []byte
+
+	// QoS is the quality of service level of the message: 0, 1, or 2.
+	QoS byte
+
+	// Retain is true if the message should be retained by the server, and
+	// delivered to future subscribers of the topic.
+	Retain bool
+}
+
+// Server implements the server side of MQTT 3.1.1 on top of a single
+// [ps.Broker], which receives every message published by clients. Every client
+// connection is a subscriber to the broker, whose allow func matches the topic
+// filters of the client's subscriptions.
+type Server struct {
+	broker         *ps.Broker[Message]
+	authenticate   func(clientID, username, password string) error
+	buffer         int
+	maxPacketSize  int
+	connectTimeout time.Duration
+	logger         *slog.Logger
+
+	mtx       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	clients   map[string]*connection
+	closed    bool
+	wg        sync.WaitGroup
+
+	rmtx     sync.Mutex
+	retained map[string]Message
+}
+
+// ServerConfig enumerates the optional parameters for a server returned by
+// [NewServer].
+type ServerConfig struct {
+	// Broker receives every message published by clients, and to which
+	// clients subscribe. Values published directly to the broker are
+	// delivered to matching clients, but aren't retained. If nil, a new
+	// broker is created.
+	Broker *ps.Broker[Message]
+
+	// Authenticate, if non-nil, is called with the client identifier and
+	// credentials of every CONNECT packet. Connections are rejected with a
+	// "not authorized" return code if it returns an error.
+	Authenticate func(clientID, username, password string) error
+
+	// Buffer is the buffer of every client subscription. If zero, 100 is
+	// used.
+	Buffer int
+
+	// MaxPacketSize is the maximum remaining length of packets from clients.
+	// Clients which send larger packets are disconnected. If zero, 1MiB is
+	// used.
+	MaxPacketSize int
+
+	// ConnectTimeout is the time allowed for clients to send a CONNECT packet
+	// after connecting. If zero, 10s is used.
+	ConnectTimeout time.Duration
+
+	// Logger receives log output from the server. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+}
+
+// NewServer returns a new server.
+func NewServer(config ServerConfig) *Server {
+	if config.Broker == nil {
+		config.Broker = ps.NewBroker[Message]()
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 100
+	}
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = 1024 * 1024
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = 10 * time.Second
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return &Server{
+		broker:         config.Broker,
+		authenticate:   config.Authenticate,
+		buffer:         config.Buffer,
+		maxPacketSize:  config.MaxPacketSize,
+		connectTimeout: config.ConnectTimeout,
+		logger:         config.Logger.With("component", "psmqtt.Server"),
+		listeners:      map[net.Listener]struct{}{},
+		conns:          map[net.Conn]struct{}{},
+		clients:        map[string]*connection{},
+		retained:       map[string]Message{},
+	}
+}
+
+// Publish a message to the broker, as if it were published by a client. If
+// the message is retained, it replaces the retained message of its topic, or
+// deletes it if the payload is empty.
+func (s *Server) Publish(m Message) (ps.Stats, error) {
+	if err := validateTopic(m.Topic); err != nil {
+		return ps.Stats{}, err
+	}
+	if m.QoS > 2 {
+		return ps.Stats{}, fmt.Errorf("invalid QoS %d", m.QoS)
+	}
+
+	if m.Retain {
+		s.rmtx.Lock()
+		if len(m.Payload) == 0 {
+			delete(s.retained, m.Topic)
+		} else {
+			s.retained[m.Topic] = m
+		}
+		s.rmtx.Unlock()
+	}
+
+	return s.broker.Publish(m), nil
+}
+
+// retainedMatching returns the retained messages whose topics match the
+// filter.
+func (s *Server) retainedMatching(filter string) []Message {
+	s.rmtx.Lock()
+	defer s.rmtx.Unlock()
+
+	var res []Message
+	for topic, m := range s.retained {
+		if MatchTopic(filter, topic) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// Serve accepts connections from the listener, and serves each of them in a
+// separate goroutine. It blocks until the listener fails, or the server is
+// closed, in which case it returns [ErrServerClosed].
+func (s *Server) Serve(ln net.Listener) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.listeners, ln)
+		s.mtx.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			s.mtx.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// Close closes every listener and active connection, and waits for their
+// subscriptions to end. Last will messages of closed connections are
+// published.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	var errs []error
+	for ln := range s.listeners {
+		errs = append(errs, ln.Close())
+	}
+	for conn := range s.conns {
+		errs = append(errs, conn.Close())
+	}
+	s.mtx.Unlock()
+
+	s.wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// ServeConn serves a single connection, until it's closed by the client, or
+// the server is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		s.wg.Done()
+	}()
+
+	c := &connection{
+		server:        s,
+		conn:          conn,
+		r:             bufio.NewReader(conn),
+		w:             bufio.NewWriter(conn),
+		logger:        s.logger.With("remote_addr", conn.RemoteAddr().String()),
+		subscriptions: map[string]byte{},
+		pending:       map[uint16]bool{},
+	}
+	c.serve()
+}
+
+// register the connection under its client identifier, and close any existing
+// connection with the same identifier, as required by the specification.
+func (s *Server) register(c *connection) {
+	s.mtx.Lock()
+	prev := s.clients[c.clientID]
+	s.clients[c.clientID] = c
+	s.mtx.Unlock()
+
+	if prev != nil {
+		c.logger.Info("taking over existing session", "client_id", c.clientID)
+		prev.conn.Close()
+	}
+}
+
+func (s *Server) deregister(c *connection) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.clients[c.clientID] == c {
+		delete(s.clients, c.clientID)
+	}
+}
+
+// connection is a single client connection to a server.
+type connection struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	logger *slog.Logger
+
+	wmtx   sync.Mutex
+	w      *bufio.Writer
+	nextID uint16
+
+	// Only accessed by the serve goroutine.
+	clientID  string
+	keepalive time.Duration
+	will      *Message
+	pending   map[uint16]bool // QoS 2 packet identifiers awaiting PUBREL
+
+	smtx          sync.RWMutex
+	subscriptions map[string]byte // topic filter to granted QoS
+}
+
+func (c *connection) serve() {
+	defer c.conn.Close()
+
+	if err := c.connect(); err != nil {
+		c.logger.Debug("connect failed", "error", err)
+		return
+	}
+	defer c.server.deregister(c)
+
+	var (
+		sub     = make(chan Message, c.server.buffer)
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+		start   = time.Now()
+	)
+	if err := c.server.broker.Subscribe(sub, c.allow); err != nil {
+		c.logger.Error("subscribe", "error", err)
+		return
+	}
+	go c.forward(sub, done, stopped)
+
+	err := c.loop()
+
+	stats, _ := c.server.broker.Unsubscribe(sub)
+	close(done)
+	<-stopped
+
+	c.logger.Info("disconnect",
+		slog.Group("stats", "skips", stats.Skips, "sends", stats.Sends, "drops", stats.Drops),
+		"duration", time.Since(start),
+		"error", err,
+	)
+
+	if c.will != nil {
+		if _, err := c.server.Publish(*c.will); err != nil {
+			c.logger.Warn("publish will", "topic", c.will.Topic, "error", err)
+		}
+	}
+}
+
+// connect reads the CONNECT packet, and replies with a CONNACK packet. It
+// returns an error if the connection should be closed.
+func (c *connection) connect() error {
+	c.conn.SetReadDeadline(time.Now().Add(c.server.connectTimeout))
+
+	p, err := readPacket(c.r, c.server.maxPacketSize)
+	if err != nil {
+		return err
+	}
+	if p.kind != packetConnect {
+		return fmt.Errorf("%w: first packet isn't CONNECT", errMalformed)
+	}
+
+	cp, err := decodeConnect(p.body)
+	if err != nil {
+		return err
+	}
+	if cp.protocol != "MQTT" {
+		return fmt.Errorf("%w: unsupported protocol %q", errMalformed, cp.protocol)
+	}
+	if cp.level != 4 {
+		c.connack(connackBadProtocolVersion)
+		return fmt.Errorf("unsupported protocol level %d", cp.level)
+	}
+
+	if cp.clientID == "" {
+		if !cp.cleanSession {
+			c.connack(connackIdentifierRejected)
+			return fmt.Errorf("empty client identifier requires a clean session")
+		}
+		cp.clientID = newClientID()
+	}
+
+	if cp.will != nil {
+		if err := validateTopic(cp.will.Topic); err != nil {
+			return fmt.Errorf("will: %w", err)
+		}
+	}
+
+	if c.server.authenticate != nil {
+		if err := c.server.authenticate(cp.clientID, cp.username, cp.password); err != nil {
+			c.connack(connackNotAuthorized)
+			return fmt.Errorf("authenticate: %w", err)
+		}
+	}
+
+	c.clientID = cp.clientID
+	c.keepalive = time.Duration(cp.keepalive) * time.Second
+	c.will = cp.will
+	c.logger = c.logger.With("client_id", c.clientID)
+
+	c.server.register(c)
+
+	c.logger.Info("connect",
+		"username", cp.username,
+		"keepalive", c.keepalive,
+		"clean_session", cp.cleanSession,
+		"will", cp.will != nil,
+	)
+
+	// Sessions aren't persisted, so there's never a session present.
+	return c.connack(connackAccepted)
+}
+
+// loop reads and handles packets until the connection fails, or the client
+// disconnects.
+func (c *connection) loop() error {
+	for {
+		// The server must disconnect clients which are silent for one and a
+		// half times the keepalive period.
+		var deadline time.Time
+		if c.keepalive > 0 {
+			deadline = time.Now().Add(c.keepalive * 3 / 2)
+		}
+		c.conn.SetReadDeadline(deadline)
+
+		p, err := readPacket(c.r, c.server.maxPacketSize)
+		if err != nil {
+			return err
+		}
+
+		switch p.kind {
+		case packetPublish:
+			err = c.handlePublish(p)
+		case packetPuback, packetPubrec, packetPubcomp:
+			// QoS 1 and 2 acknowledgements for messages sent to the client
+			// don't need a response, because sessions aren't persisted.
+		case packetPubrel:
+			err = c.handlePubrel(p)
+		case packetSubscribe:
+			err = c.handleSubscribe(p)
+		case packetUnsubscribe:
+			err = c.handleUnsubscribe(p)
+		case packetPingreq:
+			err = c.write(packetPingresp, 0, nil)
+		case packetDisconnect:
+			c.will = nil // discarded on normal disconnect
+			return nil
+		default:
+			err = fmt.Errorf("%w: unexpected packet type %d", errMalformed, p.kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *connection) handlePublish(p packet) error {
+	var (
+		d      = decoder{b: p.body}
+		qos    = p.flags >> 1 & 0x03
+		retain = p.flags&0x01 != 0
+		topic  = d.string()
+		id     uint16
+	)
+	if qos > 0 {
+		id = d.uint16()
+	}
+	payload := d.rest()
+	if d.err != nil {
+		return d.err
+	}
+	if qos > 2 {
+		return fmt.Errorf("%w: invalid QoS", errMalformed)
+	}
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+
+	// QoS 2 messages are delivered when they're first received, and then
+	// acknowledged without being delivered again until they're released.
+	if qos == 2 && c.pending[id] {
+		return c.write(packetPubrec, 0, appendUint16(nil, id))
+	}
+
+	stats, err := c.server.Publish(Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+	if err != nil {
+		return err
+	}
+	c.logger.Debug("publish", "topic", topic, "qos", qos, "retain", retain, "bytes", len(payload), slog.Group("stats", "skips", stats.Skips, "sends", stats.Sends, "drops", stats.Drops))
+
+	switch qos {
+	case 1:
+		return c.write(packetPuback, 0, appendUint16(nil, id))
+	case 2:
+		c.pending[id] = true
+		return c.write(packetPubrec, 0, appendUint16(nil, id))
+	default:
+		return nil
+	}
+}
+
+func (c *connection) handlePubrel(p packet) error {
+	d := decoder{b: p.body}
+	id := d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+	delete(c.pending, id)
+	return c.write(packetPubcomp, 0, appendUint16(nil, id))
+}
+
+func (c *connection) handleSubscribe(p packet) error {
+	if p.flags != 0x02 {
+		return fmt.Errorf("%w: invalid SUBSCRIBE flags", errMalformed)
+	}
+
+	d := decoder{b: p.body}
+	id := d.uint16()
+
+	var (
+		filters []string
+		codes   []byte
+	)
+	for d.err == nil && len(d.b) > 0 {
+		filter, qos := d.string(), d.byte()
+		if d.err != nil {
+			break
+		}
+		if qos > 2 {
+			return fmt.Errorf("%w: invalid QoS", errMalformed)
+		}
+		filters = append(filters, filter)
+		codes = append(codes, min(qos, 1)) // QoS 2 is downgraded to 1
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(filters) == 0 {
+		return fmt.Errorf("%w: SUBSCRIBE without topic filters", errMalformed)
+	}
+
+	c.smtx.Lock()
+	for i, filter := range filters {
+		if err := validateFilter(filter); err != nil {
+			codes[i] = subackFailure
+			continue
+		}
+		c.subscriptions[filter] = codes[i]
+	}
+	c.smtx.Unlock()
+
+	c.logger.Info("subscribe", "filters", filters, "granted", codes)
+
+	if err := c.write(packetSuback, 0, append(appendUint16(nil, id), codes...)); err != nil {
+		return err
+	}
+
+	// Retained messages are sent to new subscriptions, with the retain flag.
+	for i, filter := range filters {
+		if codes[i] == subackFailure {
+			continue
+		}
+		for _, m := range c.server.retainedMatching(filter) {
+			if err := c.publish(m.Topic, m.Payload, min(m.QoS, codes[i]), true, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *connection) handleUnsubscribe(p packet) error {
+	if p.flags != 0x02 {
+		return fmt.Errorf("%w: invalid UNSUBSCRIBE flags", errMalformed)
+	}
+
+	d := decoder{b: p.body}
+	id := d.uint16()
+
+	var filters []string
+	for d.err == nil && len(d.b) > 0 {
+		filters = append(filters, d.string())
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	c.smtx.Lock()
+	for _, filter := range filters {
+		delete(c.subscriptions, filter)
+	}
+	c.smtx.Unlock()
+
+	c.logger.Info("unsubscribe", "filters", filters)
+
+	return c.write(packetUnsuback, 0, appendUint16(nil, id))
+}
+
+// allow is the allow func of the connection's broker subscription.
+func (c *connection) allow(m Message) bool {
+	_, ok := c.grantedQoS(m.Topic)
+	return ok
+}
+
+// grantedQoS returns the maximum QoS granted to the subscriptions which match
+// the topic, and false if there are no matching subscriptions.
+func (c *connection) grantedQoS(topic string) (byte, bool) {
+	c.smtx.RLock()
+	defer c.smtx.RUnlock()
+
+	var (
+		qos byte
+		ok  bool
+	)
+	for filter, granted := range c.subscriptions {
+		if MatchTopic(filter, topic) {
+			qos, ok = max(qos, granted), true
+		}
+	}
+	return qos, ok
+}
+
+// forward messages from the broker subscription to the client, until done is
+// closed.
+func (c *connection) forward(sub <-chan Message, done <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	for {
+		select {
+		case m := <-sub:
+			granted, ok := c.grantedQoS(m.Topic)
+			if !ok {
+				continue // unsubscribed in the meantime
+			}
+			// The retain flag is cleared for established subscriptions.
+			if err := c.publish(m.Topic, m.Payload, min(m.QoS, granted), false, len(sub) == 0); err != nil {
+				c.logger.Debug("forward", "topic", m.Topic, "error", err)
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// publish writes a PUBLISH packet to the client. Writes are only flushed if
+// flush is true, so bursts of messages are batched.
+func (c *connection) publish(topic string, payload []byte, qos byte, retain, flush bool) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	body := appendString(nil, topic)
+	if qos > 0 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID++ // zero isn't a valid packet identifier
+		}
+		body = appendUint16(body, c.nextID)
+	}
+	body = append(body, payload...)
+
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+
+	if err := writePacket(c.w, packetPublish, flags, body); err != nil {
+		return err
+	}
+	if flush {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+// write a packet to the client, and flush.
+func (c *connection) write(kind, flags byte, body []byte) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	if err := writePacket(c.w, kind, flags, body); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *connection) connack(code byte) error {
+	return c.write(packetConnack, 0, []byte{0, code})
+}
+
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "ps-" + hex.EncodeToString(b)
+}
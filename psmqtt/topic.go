@@ -0,0 +1,75 @@
+package psmqtt
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrInvalidTopic is returned when publishing a message whose topic name
+	// is empty, or contains wildcards.
+	ErrInvalidTopic = errors.New("invalid topic name")
+
+	errInvalidFilter = errors.New("invalid topic filter")
+)
+
+// validateTopic returns an error if name isn't a valid topic name, i.e. it's
+// empty, or contains wildcards or NUL.
+func validateTopic(name string) error {
+	if name == "" || len(name) > 65535 || !utf8.ValidString(name) || strings.ContainsAny(name, "+#\x00") {
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+// validateFilter returns an error if filter isn't a valid topic filter. The
+// multi-level wildcard # must be the last level, and wildcards must occupy an
+// entire level.
+func validateFilter(filter string) error {
+	if filter == "" || len(filter) > 65535 || !utf8.ValidString(filter) || strings.ContainsRune(filter, 0) {
+		return errInvalidFilter
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return errInvalidFilter
+		case level != "#" && level != "+" && strings.ContainsAny(level, "+#"):
+			return errInvalidFilter
+		}
+	}
+
+	return nil
+}
+
+// MatchTopic returns true if the topic name matches the topic filter, which may
+// contain + and # wildcards. Per the specification, filters starting with a
+// wildcard don't match topic names starting with $.
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	for {
+		f, frest, fmore := strings.Cut(filter, "/")
+		t, trest, tmore := strings.Cut(topic, "/")
+
+		switch {
+		case f == "#":
+			return true
+		case f != "+" && f != t:
+			return false
+		case !fmore && !tmore:
+			return true
+		case !fmore:
+			return false
+		case !tmore:
+			// "a/#" matches "a", the parent level.
+			return frest == "#"
+		}
+
+		filter, topic = frest, trest
+	}
+}
@@ -0,0 +1,29 @@
+// Package psresp serves pub/sub brokers over the Redis serialization protocol
+// (RESP), so redis-cli and existing Redis client libraries can publish and
+// subscribe to them.
+//
+// [Server] serves the brokers of a [ps.Registry], where each Redis channel is a
+// topic in the registry. It supports PUBLISH, SUBSCRIBE, UNSUBSCRIBE,
+// PSUBSCRIBE, PUNSUBSCRIBE, PING, ECHO, QUIT, and RESET, with the same
+// semantics as Redis. In particular, the reply to PUBLISH is the number of
+// subscribers which received the message, i.e. [ps.Stats.Sends].
+//
+//	$ redis-cli -p 6380 subscribe news
+//	1) "subscribe"
+//	2) "news"
+//	3) (integer) 1
+//	1) "message"
+//	2) "news"
+//	3) "hello"
+//
+//	$ redis-cli -p 6380 publish news hello
+//	(integer) 1
+//
+// Patterns are Redis glob-style patterns: * matches any sequence of bytes,
+// including /, ? matches any byte, [...] matches a class of bytes, and \
+// escapes the next byte. A pattern subscription receives messages from every
+// matching topic which exists when it's made, and from every matching topic
+// which is later published or subscribed to via the server. Values published
+// directly to the broker of a new topic, without going through the server,
+// aren't delivered to pattern subscriptions made before the topic existed.
+package psresp
@@ -0,0 +1,16 @@
+module github.com/peterbourgon/ps/psresp
+
+go 1.24
+
+require (
+	github.com/peterbourgon/ps v0.0.0-00010101000000-000000000000
+	github.com/redis/go-redis/v9 v9.12.1
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/peterbourgon/eventsource v0.0.0-20240918134904-0c90791d8b55 // indirect
+)
+
+replace github.com/peterbourgon/ps => ../
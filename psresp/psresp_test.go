@@ -0,0 +1,232 @@
+package psresp_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/psresp"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestProtocol(t *testing.T) {
+	t.Parallel()
+
+	registry, addr := newTestServer(t)
+
+	sub := newTestConn(t, addr)
+	pub := newTestConn(t, addr)
+
+	pub.roundTrip("PING", "+PONG\r\n")
+	pub.roundTrip("*2\r\n$4\r\nPING\r\n$2\r\nhi\r\n", "$2\r\nhi\r\n")
+	pub.roundTrip("FOO", "-ERR unknown command 'foo'\r\n")
+	pub.roundTrip("PUBLISH news", "-ERR wrong number of arguments for 'publish' command\r\n")
+	pub.roundTrip("PUBLISH news hello", ":0\r\n")
+
+	sub.roundTrip("SUBSCRIBE news sport", "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n")
+	sub.roundTrip("PSUBSCRIBE n*", "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n")
+	sub.roundTrip("PUBLISH news hello", "-ERR Can't execute 'publish': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n")
+	sub.roundTrip("PING", "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	pub.roundTrip("*3\r\n$7\r\nPUBLISH\r\n$5\r\nsport\r\n$4\r\ngoal\r\n", ":1\r\n")
+	sub.read("*3\r\n$7\r\nmessage\r\n$5\r\nsport\r\n$4\r\ngoal\r\n")
+
+	// The pattern matches a topic created after the pattern subscription.
+	pub.roundTrip("PUBLISH nothing void", ":1\r\n")
+	sub.read("*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$7\r\nnothing\r\n$4\r\nvoid\r\n")
+
+	pub.roundTrip("PUBLISH news hello", ":2\r\n")
+	sub.readAny(
+		"*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n",
+		"*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n",
+	)
+
+	sub.roundTrip("UNSUBSCRIBE news", "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n")
+	sub.roundTrip("PUNSUBSCRIBE", "*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:1\r\n")
+	pub.roundTrip("PUBLISH news hello", ":0\r\n")
+	sub.roundTrip("UNSUBSCRIBE", "*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:0\r\n")
+	sub.roundTrip("UNSUBSCRIBE", "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n")
+	sub.roundTrip("PING", "+PONG\r\n")
+
+	pub.roundTrip("PUBLISH a/b x", "-ERR channel \"a/b\": unknown topic\r\n")
+	pub.roundTrip("QUIT", "+OK\r\n")
+	if _, err := pub.r.ReadByte(); err != io.EOF {
+		t.Errorf("after QUIT: want EOF, have %v", err)
+	}
+
+	for _, topic := range registry.Topics() {
+		if topic.Subscribers != 0 {
+			t.Errorf("%s: want 0 subscribers, have %d", topic.Name, topic.Subscribers)
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newTestServer(t)
+
+	sub := newTestConn(t, addr)
+	pub := newTestConn(t, addr)
+
+	// Patterns are interpreted as Redis does: an unterminated class ends with
+	// the pattern, and ranges may be reversed.
+	sub.roundTrip("PSUBSCRIBE sp[o [t-n]ews", "*3\r\n$10\r\npsubscribe\r\n$4\r\nsp[o\r\n:1\r\n*3\r\n$10\r\npsubscribe\r\n$8\r\n[t-n]ews\r\n:2\r\n")
+
+	pub.roundTrip("PUBLISH spo x", ":1\r\n")
+	sub.read("*4\r\n$8\r\npmessage\r\n$4\r\nsp[o\r\n$3\r\nspo\r\n$1\r\nx\r\n")
+	pub.roundTrip("PUBLISH news y", ":1\r\n")
+	sub.read("*4\r\n$8\r\npmessage\r\n$8\r\n[t-n]ews\r\n$4\r\nnews\r\n$1\r\ny\r\n")
+	pub.roundTrip("PUBLISH spa z", ":0\r\n")
+	pub.roundTrip("PUBLISH aews z", ":0\r\n")
+}
+
+func TestRedisClient(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	pubsub := client.Subscribe(ctx, "orders")
+	t.Cleanup(func() { pubsub.Close() })
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := pubsub.PSubscribe(ctx, "order*"); err != nil {
+		t.Fatalf("psubscribe: %v", err)
+	}
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatalf("psubscribe: %v", err)
+	}
+
+	n, err := client.Publish(ctx, "orders", "42").Result()
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if want, have := int64(2), n; want != have {
+		t.Errorf("publish: want %d, have %d", want, have)
+	}
+
+	var patterns int
+	for range 2 {
+		msg, err := pubsub.ReceiveMessage(ctx)
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if want, have := "orders", msg.Channel; want != have {
+			t.Errorf("channel: want %q, have %q", want, have)
+		}
+		if want, have := "42", msg.Payload; want != have {
+			t.Errorf("payload: want %q, have %q", want, have)
+		}
+		if msg.Pattern != "" {
+			patterns++
+		}
+	}
+	if want, have := 1, patterns; want != have {
+		t.Errorf("pattern messages: want %d, have %d", want, have)
+	}
+}
+
+func newTestServer(t *testing.T) (*ps.Registry[string], string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	registry := ps.NewRegistry[string](ps.RegistryConfig{})
+	server := psresp.NewServer(psresp.ServerConfig[string]{
+		Registry: registry,
+		Codec:    psresp.StringCodec(),
+	})
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return registry, ln.Addr().String()
+}
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestConn(t *testing.T, addr string) *testConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// roundTrip writes a command, which is terminated with CRLF if it's an inline
+// command, and reads the expected reply.
+func (c *testConn) roundTrip(command, want string) {
+	c.t.Helper()
+
+	if command[0] != '*' {
+		command += "\r\n"
+	}
+	if _, err := c.conn.Write([]byte(command)); err != nil {
+		c.t.Fatalf("%q: write: %v", command, err)
+	}
+	c.read(want)
+}
+
+func (c *testConn) read(want string) {
+	c.t.Helper()
+
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	if have := string(buf); want != have {
+		c.t.Fatalf("want %q, have %q", want, have)
+	}
+}
+
+// readAny reads each of the wanted replies, in any order.
+func (c *testConn) readAny(wants ...string) {
+	c.t.Helper()
+
+	var total int
+	for _, want := range wants {
+		total += len(want)
+	}
+	buf := make([]byte, total)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	have := string(buf)
+	for _, want := range wants {
+		if len(have) >= len(want) && have[:len(want)] == want {
+			have = have[len(want):]
+			continue
+		}
+		if len(have) >= len(want) && have[len(have)-len(want):] == want {
+			have = have[:len(have)-len(want)]
+			continue
+		}
+		c.t.Fatalf("want %q in any order, have %q", wants, string(buf))
+	}
+}
@@ -0,0 +1,127 @@
+package psresp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxBulkLen is the maximum length of a bulk string in a command.
+const maxBulkLen = 64 * 1024 * 1024
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads a single command, either as an array of bulk strings, as
+// sent by client libraries, or as an inline command, as typed into telnet.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] != '*' {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		var args [][]byte
+		for _, f := range strings.Fields(line) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+
+	n, err := readLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([][]byte, 0, n)
+	for range n {
+		size, err := readLength(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: expected CRLF", errProtocol)
+		}
+		args = append(args, buf[:size])
+	}
+
+	return args, nil
+}
+
+// readLength reads a line like *3 or $5, and returns the length.
+func readLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, fmt.Errorf("%w: expected '%c', got %q", errProtocol, prefix, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: invalid length %q", errProtocol, line[1:])
+	}
+	return n, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writer writes RESP2 replies.
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w writer) error(s string) {
+	w.WriteByte('-')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w writer) integer(n int) {
+	w.WriteByte(':')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(b)))
+	w.WriteString("\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
@@ -0,0 +1,746 @@
+package psresp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+// ErrServerClosed is returned by [Server.Serve] after the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Server serves the brokers in a [ps.Registry] over the Redis protocol, to
+// connections accepted from one or more listeners. Redis channels map to
+// topics in the registry.
+type Server[T any] struct {
+	registry *ps.Registry[T]
+	codec    pshttp.Codec[T]
+	buffer   int
+	logger   *slog.Logger
+
+	mtx       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	patterns  map[*patternSub[T]]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// ServerConfig enumerates the parameters for a server returned by
+// [NewServer]. Registry is required.
+type ServerConfig[T any] struct {
+	// Registry contains the brokers served by the server, one per channel.
+	Registry *ps.Registry[T]
+
+	// Codec is used to decode published messages, and to encode messages for
+	// subscribers. If empty, the [pshttp.JSONCodec] is used. Use
+	// [StringCodec] to publish and receive arbitrary strings, like redis-cli
+	// does.
+	Codec pshttp.Codec[T]
+
+	// Buffer is the buffer of every subscription. If zero, 100 is used.
+	Buffer int
+
+	// Logger receives log output from the server. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+}
+
+// NewServer returns a new server for the configured registry.
+func NewServer[T any](config ServerConfig[T]) *Server[T] {
+	if config.Codec.Encode == nil || config.Codec.Decode == nil {
+		config.Codec = pshttp.JSONCodec[T]()
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 100
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return &Server[T]{
+		registry:  config.Registry,
+		codec:     config.Codec,
+		buffer:    config.Buffer,
+		logger:    config.Logger.With("component", "psresp.Server"),
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+		patterns:  map[*patternSub[T]]struct{}{},
+	}
+}
+
+// StringCodec returns a codec for strings, which are encoded as-is. It's
+// useful with clients like redis-cli, which publish and expect arbitrary text.
+func StringCodec() pshttp.Codec[string] {
+	return pshttp.Codec[string]{
+		MediaType: "text/plain",
+		Encode: func(v string, w io.Writer) error {
+			_, err := io.WriteString(w, v)
+			return err
+		},
+		Decode: func(r io.Reader, v *string) error {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			*v = string(data)
+			return nil
+		},
+		Binary: true,
+	}
+}
+
+// Serve accepts connections from the listener, and serves each of them in a
+// separate goroutine. It blocks until the listener fails, or the server is
+// closed, in which case it returns [ErrServerClosed].
+func (s *Server[T]) Serve(ln net.Listener) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.listeners, ln)
+		s.mtx.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			s.mtx.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// Close closes every listener and active connection, and waits for their
+// subscriptions to end.
+func (s *Server[T]) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	var errs []error
+	for ln := range s.listeners {
+		errs = append(errs, ln.Close())
+	}
+	for conn := range s.conns {
+		errs = append(errs, conn.Close())
+	}
+	s.mtx.Unlock()
+
+	s.wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// ServeConn serves a single connection, until it's closed by the client, or
+// the server is closed.
+func (s *Server[T]) ServeConn(conn net.Conn) {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		s.wg.Done()
+	}()
+
+	c := &connection[T]{
+		server:   s,
+		conn:     conn,
+		w:        writer{bufio.NewWriter(conn)},
+		logger:   s.logger.With("remote_addr", conn.RemoteAddr().String()),
+		channels: map[string]*attachment[T]{},
+		patterns: map[string]*patternSub[T]{},
+	}
+	c.serve()
+}
+
+// attachPatterns attaches every pattern subscription which matches the channel
+// to the channel's broker, so that they receive values published to it.
+func (s *Server[T]) attachPatterns(channel string) {
+	s.mtx.Lock()
+	var matches []*patternSub[T]
+	for p := range s.patterns {
+		if p.match(channel) {
+			matches = append(matches, p)
+		}
+	}
+	s.mtx.Unlock()
+
+	for _, p := range matches {
+		p.attach(channel)
+	}
+}
+
+// connection is a single client connection to a server.
+type connection[T any] struct {
+	server *Server[T]
+	conn   net.Conn
+	logger *slog.Logger
+
+	wmtx sync.Mutex
+	w    writer
+
+	// Only accessed by the serve goroutine.
+	channels map[string]*attachment[T]
+	patterns map[string]*patternSub[T]
+}
+
+func (c *connection[T]) serve() {
+	defer c.conn.Close()
+	defer c.unsubscribeAll()
+
+	c.logger.Debug("connect")
+
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(r)
+		if errors.Is(err, errProtocol) {
+			c.reply(func(w writer) { w.error("ERR " + err.Error()) })
+			c.logger.Debug("disconnect", "error", err)
+			return
+		}
+		if err != nil {
+			c.logger.Debug("disconnect", "error", err)
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if !c.handle(strings.ToUpper(string(args[0])), args[1:]) {
+			return
+		}
+	}
+}
+
+// handle a single command, and return false if the connection should be
+// closed.
+func (c *connection[T]) handle(cmd string, args [][]byte) bool {
+	subscribed := c.count() > 0
+
+	switch cmd {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING", "QUIT", "RESET":
+		// allowed in any context
+	default:
+		if subscribed {
+			c.reply(func(w writer) {
+				w.error(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmd)))
+			})
+			return true
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		c.reply(func(w writer) {
+			switch {
+			case subscribed:
+				w.array(2)
+				w.bulk([]byte("pong"))
+				if len(args) > 0 {
+					w.bulk(args[0])
+				} else {
+					w.bulk(nil)
+				}
+			case len(args) > 0:
+				w.bulk(args[0])
+			default:
+				w.simple("PONG")
+			}
+		})
+
+	case "ECHO":
+		if len(args) != 1 {
+			c.replyArity(cmd)
+			break
+		}
+		c.reply(func(w writer) { w.bulk(args[0]) })
+
+	case "QUIT":
+		c.reply(func(w writer) { w.simple("OK") })
+		return false
+
+	case "RESET":
+		c.unsubscribeAll()
+		c.reply(func(w writer) { w.simple("RESET") })
+
+	case "PUBLISH":
+		if len(args) != 2 {
+			c.replyArity(cmd)
+			break
+		}
+		c.handlePublish(string(args[0]), args[1])
+
+	case "SUBSCRIBE":
+		if len(args) < 1 {
+			c.replyArity(cmd)
+			break
+		}
+		for _, channel := range args {
+			c.handleSubscribe(string(channel))
+		}
+
+	case "UNSUBSCRIBE":
+		channels := toStrings(args)
+		if len(channels) == 0 {
+			channels = sortedKeys(c.channels)
+		}
+		c.handleUnsubscribe("unsubscribe", channels, c.unsubscribeChannel)
+
+	case "PSUBSCRIBE":
+		if len(args) < 1 {
+			c.replyArity(cmd)
+			break
+		}
+		for _, pattern := range args {
+			c.handlePSubscribe(string(pattern))
+		}
+
+	case "PUNSUBSCRIBE":
+		patterns := toStrings(args)
+		if len(patterns) == 0 {
+			patterns = sortedKeys(c.patterns)
+		}
+		c.handleUnsubscribe("punsubscribe", patterns, c.unsubscribePattern)
+
+	default:
+		c.reply(func(w writer) { w.error(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd))) })
+	}
+
+	return true
+}
+
+func (c *connection[T]) handlePublish(channel string, payload []byte) {
+	broker, release, err := c.server.registry.Acquire(channel)
+	if err != nil {
+		c.reply(func(w writer) { w.error(fmt.Sprintf("ERR channel %q: %v", channel, err)) })
+		return
+	}
+	defer release()
+
+	var v T
+	if err := c.server.codec.Decode(bytes.NewReader(payload), &v); err != nil {
+		c.reply(func(w writer) { w.error(fmt.Sprintf("ERR decode message: %v", err)) })
+		return
+	}
+
+	c.server.attachPatterns(channel)
+
+	stats := broker.Publish(v)
+	c.reply(func(w writer) { w.integer(int(stats.Sends)) })
+}
+
+func (c *connection[T]) handleSubscribe(channel string) {
+	if _, ok := c.channels[channel]; !ok {
+		a, err := c.server.newAttachment(channel, "")
+		if err != nil {
+			c.reply(func(w writer) { w.error(fmt.Sprintf("ERR channel %q: %v", channel, err)) })
+			return
+		}
+		c.channels[channel] = a
+		c.server.attachPatterns(channel)
+		c.logger.Info("subscribe", "channel", channel)
+		defer a.start(c) // after the confirmation
+	}
+
+	count := c.count()
+	c.reply(func(w writer) {
+		w.array(3)
+		w.bulk([]byte("subscribe"))
+		w.bulk([]byte(channel))
+		w.integer(count)
+	})
+}
+
+func (c *connection[T]) handlePSubscribe(pattern string) {
+	if _, ok := c.patterns[pattern]; !ok {
+		p := &patternSub[T]{
+			conn:     c,
+			pattern:  pattern,
+			attached: map[string]*attachment[T]{},
+		}
+		c.patterns[pattern] = p
+
+		c.server.mtx.Lock()
+		c.server.patterns[p] = struct{}{}
+		c.server.mtx.Unlock()
+
+		for _, t := range c.server.registry.Topics() {
+			if p.match(t.Name) {
+				p.attach(t.Name)
+			}
+		}
+
+		c.logger.Info("psubscribe", "pattern", pattern)
+		defer p.start() // after the confirmation
+	}
+
+	count := c.count()
+	c.reply(func(w writer) {
+		w.array(3)
+		w.bulk([]byte("psubscribe"))
+		w.bulk([]byte(pattern))
+		w.integer(count)
+	})
+}
+
+func (c *connection[T]) handleUnsubscribe(kind string, names []string, unsubscribe func(string)) {
+	if len(names) == 0 {
+		c.reply(func(w writer) {
+			w.array(3)
+			w.bulk([]byte(kind))
+			w.null()
+			w.integer(c.count())
+		})
+		return
+	}
+
+	for _, name := range names {
+		unsubscribe(name)
+		count := c.count()
+		c.reply(func(w writer) {
+			w.array(3)
+			w.bulk([]byte(kind))
+			w.bulk([]byte(name))
+			w.integer(count)
+		})
+	}
+}
+
+func (c *connection[T]) unsubscribeChannel(channel string) {
+	a, ok := c.channels[channel]
+	if !ok {
+		return
+	}
+	delete(c.channels, channel)
+	stats := a.stop()
+	c.logger.Info("unsubscribe", "channel", channel, slog.Group("stats", "skips", stats.Skips, "sends", stats.Sends, "drops", stats.Drops))
+}
+
+func (c *connection[T]) unsubscribePattern(pattern string) {
+	p, ok := c.patterns[pattern]
+	if !ok {
+		return
+	}
+	delete(c.patterns, pattern)
+
+	c.server.mtx.Lock()
+	delete(c.server.patterns, p)
+	c.server.mtx.Unlock()
+
+	p.stop()
+	c.logger.Info("punsubscribe", "pattern", pattern)
+}
+
+func (c *connection[T]) unsubscribeAll() {
+	for channel := range c.channels {
+		c.unsubscribeChannel(channel)
+	}
+	for pattern := range c.patterns {
+		c.unsubscribePattern(pattern)
+	}
+}
+
+// count returns the number of channel and pattern subscriptions.
+func (c *connection[T]) count() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (c *connection[T]) reply(f func(w writer)) {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	f(c.w)
+	c.w.Flush()
+}
+
+func (c *connection[T]) replyArity(cmd string) {
+	c.reply(func(w writer) {
+		w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+	})
+}
+
+// message writes a message to the connection. Writes are only flushed if flush
+// is true, so bursts of messages are batched.
+func (c *connection[T]) message(parts [][]byte, flush bool) {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	c.w.array(len(parts))
+	for _, p := range parts {
+		c.w.bulk(p)
+	}
+	if flush {
+		c.w.Flush()
+	}
+}
+
+// attachment is a subscription to a single broker, on behalf of a channel or
+// pattern subscription.
+type attachment[T any] struct {
+	channel string
+	pattern string // empty for channel subscriptions
+	broker  *ps.Broker[T]
+	release func()
+	c       chan T
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (s *Server[T]) newAttachment(channel, pattern string) (*attachment[T], error) {
+	broker, release, err := s.registry.Acquire(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &attachment[T]{
+		channel: channel,
+		pattern: pattern,
+		broker:  broker,
+		release: release,
+		c:       make(chan T, s.buffer),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := broker.Subscribe(a.c, func(T) bool { return true }); err != nil {
+		release()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// start forwarding values to the connection.
+func (a *attachment[T]) start(c *connection[T]) {
+	a.once.Do(func() { go a.forward(c) })
+}
+
+func (a *attachment[T]) forward(c *connection[T]) {
+	defer close(a.stopped)
+
+	var (
+		buf    bytes.Buffer
+		binary = c.server.codec.Binary
+	)
+	for {
+		select {
+		case v := <-a.c:
+			buf.Reset()
+			if err := c.server.codec.Encode(v, &buf); err != nil {
+				c.logger.Error("encode message", "channel", a.channel, "error", err)
+				continue
+			}
+			data := buf.Bytes()
+			if !binary {
+				data = bytes.TrimRight(data, "\n")
+			}
+
+			parts := [][]byte{[]byte("message"), []byte(a.channel), data}
+			if a.pattern != "" {
+				parts = [][]byte{[]byte("pmessage"), []byte(a.pattern), []byte(a.channel), data}
+			}
+			c.message(parts, len(a.c) == 0)
+
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// stop the attachment, and return its final stats.
+func (a *attachment[T]) stop() ps.Stats {
+	stats, _ := a.broker.Unsubscribe(a.c)
+	close(a.done)
+	a.once.Do(func() { close(a.stopped) }) // never started
+	<-a.stopped
+	a.release()
+	return stats
+}
+
+// patternSub is a pattern subscription of a connection. It's attached to every
+// matching channel which exists when it's created, and to new matching
+// channels as they're published or subscribed to via the server.
+type patternSub[T any] struct {
+	conn    *connection[T]
+	pattern string
+
+	mtx      sync.Mutex
+	attached map[string]*attachment[T]
+	started  bool
+	stopped  bool
+}
+
+func (p *patternSub[T]) match(channel string) bool {
+	return matchGlob(p.pattern, channel)
+}
+
+func (p *patternSub[T]) attach(channel string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.stopped {
+		return
+	}
+	if _, ok := p.attached[channel]; ok {
+		return
+	}
+
+	a, err := p.conn.server.newAttachment(channel, p.pattern)
+	if err != nil {
+		p.conn.logger.Warn("psubscribe: attach", "pattern", p.pattern, "channel", channel, "error", err)
+		return
+	}
+	p.attached[channel] = a
+	if p.started {
+		a.start(p.conn)
+	}
+}
+
+func (p *patternSub[T]) start() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.started = true
+	for _, a := range p.attached {
+		a.start(p.conn)
+	}
+}
+
+func (p *patternSub[T]) stop() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.stopped = true
+	for channel, a := range p.attached {
+		a.stop()
+		delete(p.attached, channel)
+	}
+}
+
+func toStrings(args [][]byte) []string {
+	res := make([]string, len(args))
+	for i, a := range args {
+		res[i] = string(a)
+	}
+	return res
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// matchGlob reports whether s matches the Redis glob-style pattern. Unlike
+// [path.Match], * and ? match any byte, including /, and malformed patterns are
+// interpreted as Redis does, rather than rejected: an unterminated class ends
+// with the pattern, and a trailing backslash matches itself.
+func matchGlob(pattern, s string) bool {
+	var (
+		p, i       int
+		star, mark = -1, 0
+	)
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, mark = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if ok, next := matchByte(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Backtrack: the last * consumes one more byte.
+		mark++
+		p, i = star+1, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte reports whether c matches the single-byte pattern element at
+// pattern[p], which isn't *, and returns the index of the next element.
+func matchByte(pattern string, p int, c byte) (bool, int) {
+	switch pattern[p] {
+	case '?':
+		return true, p + 1
+
+	case '\\':
+		if p+1 < len(pattern) {
+			return pattern[p+1] == c, p + 2
+		}
+		return c == '\\', p + 1
+
+	case '[':
+		p++
+		negate := p < len(pattern) && pattern[p] == '^'
+		if negate {
+			p++
+		}
+		match := false
+		for p < len(pattern) && pattern[p] != ']' {
+			switch {
+			case pattern[p] == '\\' && p+1 < len(pattern):
+				match = match || pattern[p+1] == c
+				p += 2
+			case p+2 < len(pattern) && pattern[p+1] == '-':
+				lo, hi := pattern[p], pattern[p+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				match = match || lo <= c && c <= hi
+				p += 3
+			default:
+				match = match || pattern[p] == c
+				p++
+			}
+		}
+		if p < len(pattern) {
+			p++ // ]
+		}
+		return match != negate, p
+
+	default:
+		return pattern[p] == c, p + 1
+	}
+}
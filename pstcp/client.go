@@ -0,0 +1,233 @@
+package pstcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+// Client represents a remote pub/sub broker served by a [Server]. It provides
+// publish and subscribe functionality similar to a normal [ps.Broker].
+//
+// Publishes share a single connection, which is dialed on demand, and redialed
+// after errors. Every subscription uses a separate connection.
+type Client[T any] struct {
+	network string
+	address string
+	codec   pshttp.Codec[T]
+	dialer  net.Dialer
+
+	mtx  sync.Mutex
+	conn *clientConn
+}
+
+// NewDefaultClient calls [NewClient] with the [pshttp.JSONCodec].
+func NewDefaultClient[T any](network, address string) *Client[T] {
+	return NewClient(network, address, pshttp.JSONCodec[T]())
+}
+
+// NewClient returns a client for the server at the given network address, e.g.
+// "tcp" and "localhost:1234", or "unix" and "/run/ps.sock". The codec must
+// match the codec of the server.
+func NewClient[T any](network, address string, codec pshttp.Codec[T]) *Client[T] {
+	return &Client[T]{
+		network: network,
+		address: address,
+		codec:   codec,
+	}
+}
+
+// Publish the value v to the remote pub/sub broker.
+func (c *Client[T]) Publish(ctx context.Context, v T) (ps.Stats, error) {
+	var buf bytes.Buffer
+	if err := c.codec.Encode(v, &buf); err != nil {
+		return ps.Stats{}, fmt.Errorf("encode value: %w", err)
+	}
+	data := bytes.TrimSpace(buf.Bytes())
+	if bytes.ContainsAny(data, "\r\n") {
+		return ps.Stats{}, fmt.Errorf("encoded value contains a newline")
+	}
+
+	text, err := c.roundTrip(ctx, CommandPub+" "+string(data))
+	if err != nil {
+		return ps.Stats{}, err
+	}
+
+	return parseStats(text)
+}
+
+// Ping the server.
+func (c *Client[T]) Ping(ctx context.Context) error {
+	_, err := c.roundTrip(ctx, CommandPing)
+	return err
+}
+
+// Close the shared publish connection, if it's open. The client may still be
+// used afterwards.
+func (c *Client[T]) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// roundTrip sends a command over the shared connection, and returns the text
+// of the reply.
+func (c *Client[T]) roundTrip(ctx context.Context, command string) (string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.conn == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return "", err
+		}
+		c.conn = conn
+	}
+
+	text, err := c.conn.roundTrip(ctx, command)
+	var serverErr *ServerError
+	if err != nil && !errors.As(err, &serverErr) {
+		c.conn.Close() // the connection is in an unknown state
+		c.conn = nil
+	}
+	return text, err
+}
+
+// Subscribe to values published to the remote pub/sub broker, over a new
+// connection, and forward them to ch. The optional filter is parsed by the
+// server. Subscribe blocks until the context is canceled, or the connection
+// fails. It doesn't reconnect.
+func (c *Client[T]) Subscribe(ctx context.Context, ch chan<- T, filter string) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	command := CommandSub
+	if filter != "" {
+		command += " " + filter
+	}
+	if _, err := conn.roundTrip(ctx, command); err != nil {
+		return err
+	}
+
+	// Reads block indefinitely, so close the connection to interrupt them.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for {
+		reply, text, err := conn.readLine()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		if reply != ReplyMsg {
+			continue // replies to commands we didn't send
+		}
+
+		var v T
+		if err := c.codec.Decode(strings.NewReader(text), &v); err != nil {
+			return fmt.Errorf("decode value: %w", err)
+		}
+
+		select {
+		case ch <- v:
+			// good
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client[T]) dial(ctx context.Context) (*clientConn, error) {
+	conn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	return &clientConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}, nil
+}
+
+// ServerError is returned when the server replies with ERR.
+type ServerError struct {
+	// Message from the server.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+type clientConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// roundTrip writes a command, and reads lines until the reply, skipping MSG
+// lines.
+func (c *clientConn) roundTrip(ctx context.Context, command string) (string, error) {
+	deadline, _ := ctx.Deadline() // zero means no deadline
+	if err := c.SetDeadline(deadline); err != nil {
+		return "", fmt.Errorf("set deadline: %w", err)
+	}
+	defer c.SetDeadline(time.Time{})
+
+	// Interrupt blocked reads and writes if the context is canceled.
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if _, err := c.Write([]byte(command + "\n")); err != nil {
+		return "", fmt.Errorf("write: %w", err)
+	}
+
+	for {
+		reply, text, err := c.readLine()
+		if err != nil {
+			return "", fmt.Errorf("read: %w", err)
+		}
+		switch reply {
+		case ReplyOK, ReplyPong:
+			return text, nil
+		case ReplyErr:
+			return "", &ServerError{Message: text}
+		}
+	}
+}
+
+func (c *clientConn) readLine() (reply, text string, err error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	reply, text, _ = strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	return reply, text, nil
+}
+
+func parseStats(text string) (ps.Stats, error) {
+	var stats ps.Stats
+	if _, err := fmt.Sscanf(text, "skips=%d sends=%d drops=%d", &stats.Skips, &stats.Sends, &stats.Drops); err != nil {
+		return ps.Stats{}, fmt.Errorf("parse stats %q: %w", text, err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,26 @@
+// Package pstcp provides a line-oriented text interface to a [ps.Broker], over
+// TCP, Unix domain sockets, or any other stream-oriented network.
+//
+// [Server] serves a broker to connections accepted from a [net.Listener]. The
+// protocol is simple enough to use from a terminal with nc or socat. Clients
+// send commands, one per line, and receive exactly one reply per command, in
+// order. Subscribed connections also receive MSG lines, with values encoded by
+// the server's codec, interleaved with replies.
+//
+//	$ nc localhost 1234
+//	PING
+//	PONG
+//	SUB
+//	OK
+//	PUB {"a":1}
+//	OK skips=0 sends=1 drops=0
+//	MSG {"a":1}
+//	STATS
+//	OK skips=0 sends=1 drops=0
+//	UNSUB
+//	OK skips=0 sends=1 drops=0
+//
+// See the Command and Reply constants for details. [Client] wraps the address
+// of a server, and provides publish and subscribe methods similar to a
+// [ps.Broker].
+package pstcp
@@ -0,0 +1,45 @@
+package pstcp
+
+// Commands are sent by clients, one per line. Command names are case
+// insensitive, and separated from their argument, if any, by a single space.
+// Lines may end with \n or \r\n.
+const (
+	// CommandPub publishes the encoded value which makes up the rest of the
+	// line, e.g. PUB {"a":1}. The reply is OK with the publish stats.
+	CommandPub = "PUB"
+
+	// CommandSub subscribes the connection to published values, with an
+	// optional filter, e.g. SUB or SUB a>1. The reply is OK, and values are
+	// subsequently sent as MSG lines. A connection has at most one
+	// subscription.
+	CommandSub = "SUB"
+
+	// CommandUnsub ends the subscription of the connection. The reply is OK
+	// with the final stats of the subscription, and no MSG lines follow it.
+	CommandUnsub = "UNSUB"
+
+	// CommandStats requests the stats of the subscription of the connection.
+	// The reply is OK with the stats.
+	CommandStats = "STATS"
+
+	// CommandPing requests a PONG reply.
+	CommandPing = "PING"
+)
+
+// Replies are sent by servers, one per line. Every command receives exactly
+// one OK, ERR, or PONG reply, in order. MSG lines may be interleaved with
+// replies. Stats are formatted as skips=N sends=N drops=N.
+const (
+	// ReplyOK indicates a command succeeded, optionally followed by stats.
+	ReplyOK = "OK"
+
+	// ReplyErr indicates a command failed, followed by an error message.
+	ReplyErr = "ERR"
+
+	// ReplyMsg carries a published value to a subscribed connection, followed
+	// by the encoded value.
+	ReplyMsg = "MSG"
+
+	// ReplyPong is the reply to PING.
+	ReplyPong = "PONG"
+)
@@ -0,0 +1,163 @@
+package pstcp_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pstcp"
+)
+
+func TestProtocol(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newTestServer(t, "tcp", "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		command string
+		want    []string
+	}{
+		{"PING", []string{"PONG"}},
+		{"ping\r", []string{"PONG"}},
+		{"STATS", []string{"ERR not subscribed"}},
+		{"SUB", []string{"OK"}},
+		{"SUB", []string{"ERR already subscribed"}},
+		{"PUB 123", []string{"MSG 123", "OK skips=0 sends=1 drops=0"}},
+		{"PUB invalid", []string{"ERR decode value: invalid character 'i' looking for beginning of value"}},
+		{"STATS", []string{"OK skips=0 sends=1 drops=0"}},
+		{"UNSUB", []string{"OK skips=0 sends=1 drops=0"}},
+		{"PUB 456", []string{"OK skips=0 sends=0 drops=0"}},
+		{"SUB 2", []string{"OK"}},
+		{"PUB 3", []string{"OK skips=1 sends=0 drops=0"}},
+		{"PUB 4", []string{"MSG 4", "OK skips=0 sends=1 drops=0"}},
+		{"FOO", []string{`ERR unknown command "FOO"`}},
+	} {
+		if _, err := conn.Write([]byte(tc.command + "\n")); err != nil {
+			t.Fatalf("%s: write: %v", tc.command, err)
+		}
+		// MSG lines may be interleaved with replies in any order.
+		var have []string
+		for range tc.want {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: read: %v", tc.command, err)
+			}
+			have = append(have, strings.TrimSuffix(line, "\n"))
+		}
+		slices.Sort(have)
+		if want := slices.Sorted(slices.Values(tc.want)); !slices.Equal(want, have) {
+			t.Errorf("%s: want %q, have %q", tc.command, want, have)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			t.Parallel()
+
+			address := "127.0.0.1:0"
+			if network == "unix" {
+				address = filepath.Join(t.TempDir(), "ps.sock")
+			}
+			broker, addr := newTestServer(t, network, address)
+			client := pstcp.NewDefaultClient[int64](network, addr)
+			t.Cleanup(func() { client.Close() })
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if err := client.Ping(ctx); err != nil {
+				t.Fatalf("ping: %v", err)
+			}
+
+			var (
+				valc = make(chan int64, 10)
+				done = make(chan error, 1)
+			)
+			go func() { done <- client.Subscribe(ctx, valc, "3") }()
+			for len(broker.ActiveSubscribers()) == 0 {
+				time.Sleep(time.Millisecond) // wait for the subscription
+			}
+
+			for v := range int64(7) {
+				if _, err := client.Publish(ctx, v); err != nil {
+					t.Fatalf("publish: %v", err)
+				}
+			}
+			for _, want := range []int64{0, 3, 6} {
+				if have := <-valc; want != have {
+					t.Errorf("want %v, have %v", want, have)
+				}
+			}
+
+			cancel()
+			if err := <-done; !errors.Is(err, context.Canceled) {
+				t.Errorf("subscribe: want %v, have %v", context.Canceled, err)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	t.Parallel()
+
+	_, addr := newTestServer(t, "tcp", "127.0.0.1:0")
+	client := pstcp.NewDefaultClient[string]("tcp", addr)
+	t.Cleanup(func() { client.Close() })
+
+	ctx := context.Background()
+
+	var serverErr *pstcp.ServerError
+	if _, err := client.Publish(ctx, "not an int"); !errors.As(err, &serverErr) {
+		t.Errorf("publish: want server error, have %v", err)
+	}
+	if err := client.Subscribe(ctx, make(chan string), "invalid"); !errors.As(err, &serverErr) {
+		t.Errorf("subscribe: want server error, have %v", err)
+	}
+	if err := client.Ping(ctx); err != nil {
+		t.Errorf("ping after errors: %v", err)
+	}
+}
+
+func newTestServer(t *testing.T, network, address string) (*ps.Broker[int64], string) {
+	t.Helper()
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	broker := ps.NewBroker[int64]()
+	server := pstcp.NewServer(pstcp.ServerConfig[int64]{
+		Broker: broker,
+		Filter: func(filter string) (func(int64) bool, error) {
+			n, err := strconv.ParseInt(filter, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return func(v int64) bool { return v%n == 0 }, nil
+		},
+	})
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return broker, ln.Addr().String()
+}
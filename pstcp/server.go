@@ -0,0 +1,368 @@
+package pstcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ps"
+	"github.com/peterbourgon/ps/pshttp"
+)
+
+// ErrServerClosed is returned by [Server.Serve] after the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Server serves a [ps.Broker] over the line protocol to connections accepted
+// from one or more listeners, e.g. TCP or Unix domain sockets.
+type Server[T any] struct {
+	broker *ps.Broker[T]
+	codec  pshttp.Codec[T]
+	filter func(string) (func(T) bool, error)
+	buffer int
+	logger *slog.Logger
+
+	mtx       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// ServerConfig enumerates the parameters for a server returned by
+// [NewServer]. Broker is required.
+type ServerConfig[T any] struct {
+	// Broker is the pub/sub broker served by the server.
+	Broker *ps.Broker[T]
+
+	// Codec is used to decode published values, and to encode values for
+	// subscribers. Encoded values must be a single line of text, so binary
+	// codecs aren't supported. If empty, the [pshttp.JSONCodec] is used.
+	Codec pshttp.Codec[T]
+
+	// Filter, if non-nil, parses the optional filter of SUB commands into an
+	// allow func for the subscription. If nil, filters are rejected.
+	Filter func(filter string) (allow func(T) bool, err error)
+
+	// Buffer is the buffer of every subscription. If zero, 100 is used.
+	Buffer int
+
+	// Logger receives log output from the server. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+}
+
+// NewServer returns a new server for the configured broker.
+func NewServer[T any](config ServerConfig[T]) *Server[T] {
+	if config.Codec.Encode == nil || config.Codec.Decode == nil {
+		config.Codec = pshttp.JSONCodec[T]()
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 100
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return &Server[T]{
+		broker:    config.Broker,
+		codec:     config.Codec,
+		filter:    config.Filter,
+		buffer:    config.Buffer,
+		logger:    config.Logger.With("component", "pstcp.Server"),
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections from the listener, and serves each of them in a
+// separate goroutine. It blocks until the listener fails, or the server is
+// closed, in which case it returns [ErrServerClosed].
+func (s *Server[T]) Serve(ln net.Listener) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.listeners, ln)
+		s.mtx.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			s.mtx.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// Close closes every listener and active connection, and waits for their
+// subscriptions to end.
+func (s *Server[T]) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	var errs []error
+	for ln := range s.listeners {
+		errs = append(errs, ln.Close())
+	}
+	for conn := range s.conns {
+		errs = append(errs, conn.Close())
+	}
+	s.mtx.Unlock()
+
+	s.wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// ServeConn serves a single connection, until it's closed by the client, or
+// the server is closed.
+func (s *Server[T]) ServeConn(conn net.Conn) {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		s.wg.Done()
+	}()
+
+	c := &connection[T]{
+		server: s,
+		conn:   conn,
+		w:      bufio.NewWriter(conn),
+		logger: s.logger.With("remote_addr", conn.RemoteAddr().String()),
+	}
+	c.serve()
+}
+
+// connection is a single client connection to a server.
+type connection[T any] struct {
+	server *Server[T]
+	conn   net.Conn
+	logger *slog.Logger
+
+	wmtx sync.Mutex
+	w    *bufio.Writer
+
+	sub *subscription[T] // only accessed by the serve goroutine
+}
+
+type subscription[T any] struct {
+	c       chan T
+	done    chan struct{}
+	stopped chan struct{}
+	start   time.Time
+}
+
+func (c *connection[T]) serve() {
+	defer c.conn.Close()
+	defer c.unsubscribe()
+
+	c.logger.Debug("connect")
+
+	s := bufio.NewScanner(c.conn)
+	s.Buffer(nil, 16*1024*1024)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case CommandPub:
+			c.handlePub(arg)
+		case CommandSub:
+			c.handleSub(strings.TrimSpace(arg))
+		case CommandUnsub:
+			c.handleUnsub()
+		case CommandStats:
+			c.handleStats()
+		case CommandPing:
+			c.write(ReplyPong, "")
+		default:
+			c.write(ReplyErr, fmt.Sprintf("unknown command %q", cmd))
+		}
+	}
+
+	c.logger.Debug("disconnect", "error", s.Err())
+}
+
+func (c *connection[T]) handlePub(arg string) {
+	var v T
+	if err := c.server.codec.Decode(strings.NewReader(arg), &v); err != nil {
+		c.write(ReplyErr, fmt.Sprintf("decode value: %v", err))
+		return
+	}
+	stats := c.server.broker.Publish(v)
+	c.write(ReplyOK, stats.String())
+}
+
+func (c *connection[T]) handleSub(filter string) {
+	if c.sub != nil {
+		c.write(ReplyErr, ps.ErrAlreadySubscribed.Error())
+		return
+	}
+
+	allow := func(T) bool { return true }
+	if filter != "" {
+		if c.server.filter == nil {
+			c.write(ReplyErr, "filters aren't supported")
+			return
+		}
+		a, err := c.server.filter(filter)
+		if err != nil {
+			c.write(ReplyErr, fmt.Sprintf("invalid filter: %v", err))
+			return
+		}
+		allow = a
+	}
+
+	sub := &subscription[T]{
+		c:       make(chan T, c.server.buffer),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		start:   time.Now(),
+	}
+	if err := c.server.broker.Subscribe(sub.c, allow); err != nil {
+		c.write(ReplyErr, err.Error())
+		return
+	}
+	c.sub = sub
+
+	c.logger.Info("subscribe", "filter", filter, "buffer", c.server.buffer)
+	c.write(ReplyOK, "")
+
+	go c.forward(sub)
+}
+
+// forward writes values from the subscription to the connection, until the
+// subscription ends.
+func (c *connection[T]) forward(sub *subscription[T]) {
+	defer close(sub.stopped)
+
+	var buf bytes.Buffer
+	for {
+		select {
+		case v := <-sub.c:
+			buf.Reset()
+			if err := c.server.codec.Encode(v, &buf); err != nil {
+				c.logger.Error("encode value", "error", err)
+				continue
+			}
+			data := bytes.TrimSpace(buf.Bytes())
+			if bytes.ContainsAny(data, "\r\n") {
+				c.logger.Error("encode value", "error", "encoded value contains a newline")
+				continue
+			}
+			c.writeMessage(data, len(sub.c) == 0)
+
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func (c *connection[T]) handleUnsub() {
+	if c.sub == nil {
+		c.write(ReplyErr, ps.ErrNotSubscribed.Error())
+		return
+	}
+	stats, err := c.unsubscribe()
+	if err != nil {
+		c.write(ReplyErr, err.Error())
+		return
+	}
+	c.write(ReplyOK, stats.String())
+}
+
+func (c *connection[T]) handleStats() {
+	if c.sub == nil {
+		c.write(ReplyErr, ps.ErrNotSubscribed.Error())
+		return
+	}
+	stats, err := c.server.broker.Stats(c.sub.c)
+	if err != nil {
+		c.write(ReplyErr, err.Error())
+		return
+	}
+	c.write(ReplyOK, stats.String())
+}
+
+// unsubscribe ends the active subscription, if any.
+func (c *connection[T]) unsubscribe() (ps.Stats, error) {
+	if c.sub == nil {
+		return ps.Stats{}, nil
+	}
+	sub := c.sub
+	c.sub = nil
+
+	stats, err := c.server.broker.Unsubscribe(sub.c)
+	close(sub.done)
+	<-sub.stopped // no more MSG lines after this point
+
+	c.logger.Info("unsubscribe",
+		slog.Group("stats", "skips", stats.Skips, "sends", stats.Sends, "drops", stats.Drops),
+		"duration", time.Since(sub.start),
+		"error", err,
+	)
+
+	return stats, err
+}
+
+// write a reply line to the connection.
+func (c *connection[T]) write(reply, text string) {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	c.w.WriteString(reply)
+	if text != "" {
+		c.w.WriteByte(' ')
+		c.w.WriteString(text)
+	}
+	c.w.WriteByte('\n')
+	c.w.Flush()
+}
+
+// writeMessage writes a MSG line to the connection. Writes are only flushed
+// if flush is true, so bursts of values are batched.
+func (c *connection[T]) writeMessage(data []byte, flush bool) {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	c.w.WriteString(ReplyMsg)
+	c.w.WriteByte(' ')
+	c.w.Write(data)
+	c.w.WriteByte('\n')
+	if flush {
+		c.w.Flush()
+	}
+}
@@ -0,0 +1,197 @@
+package ps
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownTopic indicates that a topic doesn't exist, and can't be created.
+var ErrUnknownTopic = errors.New("unknown topic")
+
+// Registry is a set of brokers for values of type T, identified by topic name.
+// Brokers are created on demand, and optionally garbage collected when they're
+// no longer in use.
+type Registry[T any] struct {
+	mtx       sync.Mutex
+	topics    map[string]*topic[T]
+	allowlist map[string]bool
+	idle      time.Duration
+	broker    BrokerConfig
+	swept     time.Time
+}
+
+// RegistryConfig enumerates the optional parameters for a registry.
+type RegistryConfig struct {
+	// Allowlist, if non-empty, is the complete set of valid topic names.
+	// Acquiring any other topic fails with [ErrUnknownTopic]. If empty, a
+	// broker is created for any topic the first time it's acquired.
+	Allowlist []string
+
+	// IdleTimeout, if non-zero, enables garbage collection of brokers which
+	// haven't been acquired for at least that long, and which have no active
+	// subscribers. Collected topics are recreated on demand.
+	IdleTimeout time.Duration
+
+	// Broker configures every broker in the registry.
+	Broker BrokerConfig
+}
+
+// TopicInfo describes a topic in a registry.
+type TopicInfo struct {
+	// Name of the topic.
+	Name string `json:"name"`
+
+	// Subscribers is the number of active subscribers to the topic.
+	Subscribers int `json:"subscribers"`
+
+	// Stats is the sum of the stats of every active subscriber.
+	Stats Stats `json:"stats"`
+}
+
+// NewRegistry returns a new, empty registry.
+func NewRegistry[T any](config RegistryConfig) *Registry[T] {
+	r := &Registry[T]{
+		topics: map[string]*topic[T]{},
+		idle:   config.IdleTimeout,
+		broker: config.Broker,
+		swept:  time.Now(),
+	}
+
+	if len(config.Allowlist) > 0 {
+		r.allowlist = map[string]bool{}
+		for _, name := range config.Allowlist {
+			r.allowlist[name] = true
+		}
+	}
+
+	return r
+}
+
+// Acquire returns the broker for the named topic, creating it if necessary.
+// The broker won't be garbage collected until the returned release func is
+// called. Callers must call release exactly once, when they're done using the
+// broker.
+func (r *Registry[T]) Acquire(name string) (*Broker[T], func(), error) {
+	if !r.valid(name) {
+		return nil, nil, ErrUnknownTopic
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.maybeSweep()
+
+	t, ok := r.topics[name]
+	if !ok {
+		t = &topic[T]{broker: NewBrokerConfig[T](r.broker)}
+		r.topics[name] = t
+	}
+
+	t.refs++
+	t.used = time.Now()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			r.mtx.Lock()
+			defer r.mtx.Unlock()
+			t.refs--
+			t.used = time.Now()
+		})
+	}
+
+	return t.broker, release, nil
+}
+
+// Check returns [ErrUnknownTopic] if the named topic can't be acquired, without
+// creating it.
+func (r *Registry[T]) Check(name string) error {
+	if !r.valid(name) {
+		return ErrUnknownTopic
+	}
+	return nil
+}
+
+// valid returns true if the name is a valid topic name, and permitted by the
+// allowlist, if any. The allowlist is immutable, so no lock is required.
+func (r *Registry[T]) valid(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/\x00") {
+		return false
+	}
+	return r.allowlist == nil || r.allowlist[name]
+}
+
+// Topics returns information about every topic currently in the registry,
+// ordered by name.
+func (r *Registry[T]) Topics() []TopicInfo {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.maybeSweep()
+
+	res := make([]TopicInfo, 0, len(r.topics))
+	for name, t := range r.topics {
+		info := TopicInfo{Name: name}
+		for _, stats := range t.broker.ActiveSubscribers() {
+			info.Subscribers++
+			info.Stats.Skips += stats.Skips
+			info.Stats.Sends += stats.Sends
+			info.Stats.Drops += stats.Drops
+		}
+		res = append(res, info)
+	}
+
+	slices.SortFunc(res, func(a, b TopicInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return res
+}
+
+// Sweep garbage collects idle topics immediately, and returns the names of the
+// collected topics. Sweeps also happen automatically, as the registry is used.
+// If the registry has no idle timeout, Sweep does nothing.
+func (r *Registry[T]) Sweep() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.sweep()
+}
+
+func (r *Registry[T]) maybeSweep() {
+	if r.idle > 0 && time.Since(r.swept) >= r.idle/2 {
+		r.sweep()
+	}
+}
+
+func (r *Registry[T]) sweep() []string {
+	if r.idle <= 0 {
+		return nil
+	}
+
+	var (
+		now       = time.Now()
+		collected []string
+	)
+
+	for name, t := range r.topics {
+		if t.refs > 0 || now.Sub(t.used) < r.idle || len(t.broker.ActiveSubscribers()) > 0 {
+			continue
+		}
+		delete(r.topics, name)
+		collected = append(collected, name)
+	}
+
+	r.swept = now
+
+	return collected
+}
+
+type topic[T any] struct {
+	broker *Broker[T]
+	refs   int
+	used   time.Time
+}